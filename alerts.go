@@ -0,0 +1,470 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Alerts report plugs drawing over or under a power threshold, plugs
+// going offline, and a daily energy over a budget. Each alert is notified
+// once when it fires, and once when it is resolved, to the notifiers of
+// the configuration (see notify.go). Active alerts are kept in memory.
+
+const (
+	ALERT_POWER   = "power"
+	ALERT_OFFLINE = "offline"
+	ALERT_ENERGY  = "energy"
+
+	ALERT_FIRING   = "firing"
+	ALERT_RESOLVED = "resolved"
+
+	// Notifications waiting to be sent, further ones are dropped
+	ALERT_QUEUE_SIZE = 100
+)
+
+type PowerAlertConfig struct {
+	Name string
+	// Plug watched, every plug when empty
+	Plug string
+	// "above" or "below" `Threshold` watts for `Duration` seconds. Once
+	// firing, the alert is resolved when the power goes back past the
+	// threshold by `Hysteresis` watts
+	Condition  string
+	Threshold  float64
+	Hysteresis float64
+	Duration   int
+}
+
+type EnergyAlertConfig struct {
+	Name string
+	// Plug watched, all plugs combined when empty
+	Plug string
+	// Energy per day, in kWh, days start at midnight in the tariff
+	// timezone
+	Budget float64
+}
+
+type Alert struct {
+	Name     string
+	Kind     string
+	Plug     string `json:",omitempty"`
+	PlugName string `json:",omitempty"`
+	Status   string
+	Message  string
+	// Power in W or daily energy in kWh when the alert fired, and the
+	// threshold or budget it went past
+	Value     float64 `json:",omitempty"`
+	Threshold float64 `json:",omitempty"`
+	Since     time.Time
+	Resolved  *time.Time `json:",omitempty"`
+}
+
+type powerAlertState struct {
+	active bool
+	// when the condition last started to hold
+	since time.Time
+}
+
+// Daily energy of a plug, from its cumulative energy counter.
+type dayEnergy struct {
+	day time.Time
+	// cumulative energy at the start of the day, in Wmin
+	baseline   uint64
+	cumulative uint64
+	// no measurement was received since startup, the energy is the one
+	// stored, in `cumulative`
+	stored bool
+}
+
+func (d *dayEnergy) kwh() float64 {
+	return energy_kwh(d.cumulative - d.baseline)
+}
+
+type AlertManager struct {
+	mutex         sync.Mutex
+	power         []PowerAlertConfig
+	energy        []EnergyAlertConfig
+	offline       bool
+	offline_delay time.Duration
+	// active alerts by key, see `alert_key`
+	active         map[string]*Alert
+	power_states   map[string]*powerAlertState
+	days           map[string]*dayEnergy
+	offline_timers map[string]*time.Timer
+	notifiers      []Notifier
+	notifications  chan Alert
+}
+
+var alert_manager *AlertManager
+
+func new_alert_manager() (*AlertManager, error) {
+	m := &AlertManager{
+		offline:        viper.GetBool("alerts.offline.enabled"),
+		offline_delay:  time.Duration(viper.GetInt("alerts.offline.delay")) * time.Second,
+		active:         make(map[string]*Alert),
+		power_states:   make(map[string]*powerAlertState),
+		days:           make(map[string]*dayEnergy),
+		offline_timers: make(map[string]*time.Timer),
+		notifications:  make(chan Alert, ALERT_QUEUE_SIZE),
+	}
+	if err := viper.UnmarshalKey("alerts.power", &m.power); err != nil {
+		return nil, err
+	}
+	for i := range m.power {
+		config := &m.power[i]
+		config.Condition = strings.ToLower(config.Condition)
+		if config.Name == "" {
+			return nil, errors.New("power alerts need a name")
+		}
+		if config.Condition != RULE_ABOVE && config.Condition != RULE_BELOW {
+			return nil, fmt.Errorf("power alert '%s': unknown condition '%s', expected '%s' or '%s'",
+				config.Name, config.Condition, RULE_ABOVE, RULE_BELOW)
+		}
+		if config.Threshold < 0 || config.Hysteresis < 0 || config.Duration < 0 {
+			return nil, fmt.Errorf("power alert '%s': threshold, hysteresis and duration must be positive", config.Name)
+		}
+	}
+	if err := viper.UnmarshalKey("alerts.energy", &m.energy); err != nil {
+		return nil, err
+	}
+	for _, config := range m.energy {
+		if config.Name == "" {
+			return nil, errors.New("energy alerts need a name")
+		}
+		if config.Budget <= 0 {
+			return nil, fmt.Errorf("energy alert '%s': budget must be positive", config.Name)
+		}
+	}
+
+	notifiers, err := load_notifiers()
+	if err != nil {
+		return nil, err
+	}
+	m.notifiers = notifiers
+	if len(m.energy) > 0 {
+		m.seed_days(time.Now())
+	}
+	go m.run()
+	return m, nil
+}
+
+func alert_key(kind string, name string, plugId string) string {
+	return kind + "/" + name + "/" + plugId
+}
+
+// Name of a plug, and its label in messages: "Name (MAC)", only its
+// MAC when it has no name.
+func plug_label(plugId string) (string, string) {
+	plug, err := store.GetPlug(plugId)
+	if err != nil || plug.Name == "" {
+		return "", plugId
+	}
+	return plug.Name, fmt.Sprintf("%s (%s)", plug.Name, plugId)
+}
+
+// Fire an alert, unless it is already active. Must be called with the
+// mutex held.
+func (m *AlertManager) fire(key string, alert Alert, now time.Time, notifications []Alert) []Alert {
+	if _, ok := m.active[key]; ok {
+		return notifications
+	}
+	alert.Status = ALERT_FIRING
+	alert.Since = now
+	m.active[key] = &alert
+	return append(notifications, alert)
+}
+
+// Resolve an alert if it is active. Must be called with the mutex held.
+func (m *AlertManager) resolve(key string, now time.Time, notifications []Alert) []Alert {
+	alert, ok := m.active[key]
+	if !ok {
+		return notifications
+	}
+	delete(m.active, key)
+	alert.Status = ALERT_RESOLVED
+	alert.Resolved = &now
+	return append(notifications, *alert)
+}
+
+// Evaluate the alerts of the plug of a measurement.
+func (m *AlertManager) observe(measure Measure) {
+	if m == nil {
+		return
+	}
+	now := time.Now()
+	notifications := make([]Alert, 0)
+	m.mutex.Lock()
+
+	// the plug is online again
+	m.stop_offline_timer(measure.Id)
+	notifications = m.resolve(alert_key(ALERT_OFFLINE, ALERT_OFFLINE, measure.Id), now, notifications)
+
+	for _, config := range m.power {
+		if config.Plug != "" && config.Plug != measure.Id {
+			continue
+		}
+		key := alert_key(ALERT_POWER, config.Name, measure.Id)
+		state, ok := m.power_states[key]
+		if !ok {
+			state = &powerAlertState{}
+			m.power_states[key] = state
+		}
+		if !threshold_holds(config.Condition, config.Threshold, config.Hysteresis, measure.Power, state.active) {
+			state.active = false
+			notifications = m.resolve(key, now, notifications)
+			continue
+		}
+		if !state.active {
+			state.active = true
+			state.since = now
+		}
+		if _, firing := m.active[key]; firing || now.Sub(state.since) < time.Duration(config.Duration)*time.Second {
+			continue
+		}
+		name, label := plug_label(measure.Id)
+		notifications = m.fire(key, Alert{
+			Name:      config.Name,
+			Kind:      ALERT_POWER,
+			Plug:      measure.Id,
+			PlugName:  name,
+			Message:   fmt.Sprintf("%s draws %.1f W, %s %.1f W", label, measure.Power, config.Condition, config.Threshold),
+			Value:     measure.Power,
+			Threshold: config.Threshold,
+		}, now, notifications)
+	}
+
+	if len(m.energy) > 0 {
+		today := m.advance_day(measure, now)
+		for _, config := range m.energy {
+			if config.Plug != "" && config.Plug != measure.Id {
+				continue
+			}
+			key := alert_key(ALERT_ENERGY, config.Name, config.Plug)
+			energy := m.daily_energy(config.Plug, today)
+			if energy <= config.Budget {
+				notifications = m.resolve(key, now, notifications)
+				continue
+			}
+			if _, firing := m.active[key]; firing {
+				continue
+			}
+			name, label := "", "All plugs"
+			if config.Plug != "" {
+				name, label = plug_label(config.Plug)
+			}
+			notifications = m.fire(key, Alert{
+				Name:      config.Name,
+				Kind:      ALERT_ENERGY,
+				Plug:      config.Plug,
+				PlugName:  name,
+				Message:   fmt.Sprintf("%s used %.2f kWh today, over the %.2f kWh budget", label, energy, config.Budget),
+				Value:     energy,
+				Threshold: config.Budget,
+			}, now, notifications)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, alert := range notifications {
+		m.notify(alert)
+	}
+}
+
+// Energy stored today, in Wmin.
+func stored_energy_today(plugId string, today time.Time, now time.Time) uint64 {
+	slots, err := plug_energy_slots(plugId, today, now)
+	if err != nil {
+		log.Error("Could not read the energy of today: ", err)
+	}
+	energy := uint64(0)
+	for _, slot := range slots {
+		energy += slot.Energy
+	}
+	return energy
+}
+
+// Daily energy of all known plugs from the stored rollups, so that the
+// budget of all plugs also counts those that send no measurement after
+// startup.
+func (m *AlertManager) seed_days(now time.Time) {
+	plugs, err := store.GetPlugs()
+	if err != nil {
+		log.Error("Could not read the plugs to seed their energy of today: ", err)
+		return
+	}
+	today := period_start(PERIOD_DAY, now, tariffs.Location())
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, plug := range plugs {
+		m.days[plug.Id] = &dayEnergy{day: today, cumulative: stored_energy_today(plug.Id, today, now), stored: true}
+	}
+}
+
+// Update the daily energy of the plug of a measurement, returns the
+// start of the current day. Must be called with the mutex held.
+func (m *AlertManager) advance_day(measure Measure, now time.Time) time.Time {
+	today := period_start(PERIOD_DAY, now, tariffs.Location())
+	d, ok := m.days[measure.Id]
+	if !ok || d.stored || !d.day.Equal(today) {
+		started := !ok || d.stored
+		d = &dayEnergy{day: today, baseline: measure.Cumulative}
+		if started {
+			// started during the day, count the energy already stored
+			d.baseline -= min(stored_energy_today(measure.Id, today, now), d.baseline)
+		}
+		m.days[measure.Id] = d
+	}
+	d.cumulative = measure.Cumulative
+	return today
+}
+
+// Energy of a plug today, or of all plugs when `plugId` is empty, in kWh.
+// Must be called with the mutex held.
+func (m *AlertManager) daily_energy(plugId string, today time.Time) float64 {
+	energy := 0.0
+	for id, d := range m.days {
+		if (plugId == "" || id == plugId) && d.day.Equal(today) {
+			energy += d.kwh()
+		}
+	}
+	return energy
+}
+
+// Must be called with the mutex held.
+func (m *AlertManager) stop_offline_timer(plugId string) {
+	if timer, ok := m.offline_timers[plugId]; ok {
+		timer.Stop()
+		delete(m.offline_timers, plugId)
+	}
+}
+
+// Report the plug offline if it is still unavailable after the offline
+// delay.
+func (m *AlertManager) PlugAvailability(plugId string, is_available bool) {
+	if is_available {
+		m.plug_online(plugId)
+		return
+	}
+	if !m.offline {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, pending := m.offline_timers[plugId]; pending {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(m.offline_delay, func() {
+		m.plug_offline(plugId, timer)
+	})
+	m.offline_timers[plugId] = timer
+}
+
+func (m *AlertManager) plug_offline(plugId string, timer *time.Timer) {
+	m.mutex.Lock()
+	if m.offline_timers[plugId] != timer {
+		// back online in the meantime
+		m.mutex.Unlock()
+		return
+	}
+	delete(m.offline_timers, plugId)
+	name, label := plug_label(plugId)
+	notifications := m.fire(alert_key(ALERT_OFFLINE, ALERT_OFFLINE, plugId), Alert{
+		Name:     ALERT_OFFLINE,
+		Kind:     ALERT_OFFLINE,
+		Plug:     plugId,
+		PlugName: name,
+		Message:  fmt.Sprintf("%s is offline", label),
+	}, time.Now(), nil)
+	m.mutex.Unlock()
+
+	for _, alert := range notifications {
+		m.notify(alert)
+	}
+}
+
+func (m *AlertManager) plug_online(plugId string) {
+	m.mutex.Lock()
+	m.stop_offline_timer(plugId)
+	notifications := m.resolve(alert_key(ALERT_OFFLINE, ALERT_OFFLINE, plugId), time.Now(), nil)
+	m.mutex.Unlock()
+
+	for _, alert := range notifications {
+		m.notify(alert)
+	}
+}
+
+// A described plug could be reached.
+func (m *AlertManager) PlugDescribed(plug_desc PlugDescription) {
+	m.plug_online(plug_desc.Id)
+}
+
+// Resolve the alerts of a forgotten plug, and forget its state.
+func (m *AlertManager) PlugForgotten(plugId string) {
+	now := time.Now()
+	notifications := make([]Alert, 0)
+	m.mutex.Lock()
+	m.stop_offline_timer(plugId)
+	for key, alert := range m.active {
+		if alert.Plug == plugId {
+			notifications = m.resolve(key, now, notifications)
+		}
+	}
+	for _, config := range m.power {
+		delete(m.power_states, alert_key(ALERT_POWER, config.Name, plugId))
+	}
+	delete(m.days, plugId)
+	m.mutex.Unlock()
+
+	for _, alert := range notifications {
+		m.notify(alert)
+	}
+}
+
+// Active alerts, or those of a plug, oldest first.
+func (m *AlertManager) Active(plugId string) []Alert {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	alerts := make([]Alert, 0, len(m.active))
+	for _, alert := range m.active {
+		if plugId == "" || alert.Plug == plugId {
+			alerts = append(alerts, *alert)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].Since.Before(alerts[j].Since)
+	})
+	return alerts
+}
+
+// Queue the notification of an alert, without blocking the caller.
+func (m *AlertManager) notify(alert Alert) {
+	if alert.Status == ALERT_FIRING {
+		log.Warnf("Alert %s: %s", alert.Name, alert.Message)
+	} else {
+		log.Infof("Alert %s resolved: %s", alert.Name, alert.Message)
+	}
+	select {
+	case m.notifications <- alert:
+	default:
+		log.Error("Too many alert notifications pending, dropping alert ", alert.Name)
+	}
+}
+
+// Send the queued notifications to every notifier.
+func (m *AlertManager) run() {
+	for alert := range m.notifications {
+		for _, n := range m.notifiers {
+			if err := n.Notify(alert); err != nil {
+				log.Warnf("Could not notify alert %s with %s: %s", alert.Name, n, err)
+			}
+		}
+	}
+}
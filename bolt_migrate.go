@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The META bucket records the version of the database layout, and the
+// progress of a migration that was interrupted.
+// Files created before versioning have no META bucket and are at version 0.
+const (
+	META_BUCKET            = "META"
+	SCHEMA_VERSION_KEY     = "schema_version"
+	MIGRATION_PROGRESS_KEY = "migration_progress"
+
+	// Maximum number of keys migrated in a single write transaction
+	MIGRATION_BATCH_SIZE = 10000
+)
+
+// A BoltMigration upgrades the database from version `Version - 1`
+// to `Version`.
+// Step migrates the next batch of at most MIGRATION_BATCH_SIZE keys after
+// `progress`, and advances it. It returns whether the migration is
+// complete, with a short summary of the changes it made. Each batch is
+// committed with its progress, so that an interrupted migration resumes
+// where it stopped.
+// Count only reads the database, it summarizes the keys that Step would
+// change from `progress`, for dry runs.
+type BoltMigration struct {
+	Version     int
+	Description string
+	Step        func(tx *bolt.Tx, progress *BoltMigrationProgress) (string, bool, error)
+	Count       func(tx *bolt.Tx, progress BoltMigrationProgress) (string, error)
+}
+
+// Position of a migration: the next key to migrate is in the top-level
+// bucket `Bucket`, or in its nested bucket `Nested`, after `Key`.
+type BoltMigrationProgress struct {
+	Version int
+	Bucket  string
+	Nested  string `json:",omitempty"`
+	Key     []byte `json:",omitempty"`
+	// Keys migrated so far
+	Count int
+}
+
+// Ordered list of all migrations, the last one gives the current version.
+var bolt_migrations = []BoltMigration{
+	{1, "binary time keys for measurements and rollups", migrate_time_keys, count_time_keys},
+	{2, "cumulative energy of measurements", migrate_cumulative_energy, count_cumulative_energy},
+}
+
+// Used to roll back the transaction of a dry run
+var errDryRun = errors.New("dry run")
+
+func bolt_schema_version(tx *bolt.Tx) (int, error) {
+	b := tx.Bucket([]byte(META_BUCKET))
+	if b == nil {
+		return 0, nil
+	}
+	v := b.Get([]byte(SCHEMA_VERSION_KEY))
+	if v == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(v))
+}
+
+func set_bolt_schema_version(tx *bolt.Tx, version int) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(META_BUCKET))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(SCHEMA_VERSION_KEY), []byte(strconv.Itoa(version)))
+}
+
+// Saved progress of the migration to `version`, if it was interrupted.
+func bolt_migration_progress(tx *bolt.Tx, version int) (BoltMigrationProgress, error) {
+	progress := BoltMigrationProgress{Version: version}
+	b := tx.Bucket([]byte(META_BUCKET))
+	if b == nil {
+		return progress, nil
+	}
+	v := b.Get([]byte(MIGRATION_PROGRESS_KEY))
+	if v == nil {
+		return progress, nil
+	}
+	var saved BoltMigrationProgress
+	if err := json.Unmarshal(v, &saved); err != nil {
+		return progress, fmt.Errorf("Unmarshal json migration progress from db: %s %s", v, err)
+	}
+	if saved.Version != version {
+		return progress, nil
+	}
+	return saved, nil
+}
+
+func set_bolt_migration_progress(tx *bolt.Tx, progress BoltMigrationProgress) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(META_BUCKET))
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(MIGRATION_PROGRESS_KEY), encoded)
+}
+
+func (s *BoltStore) Migrate(dry_run bool) (reports []MigrationReport, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var version int
+	fresh := true
+	err = s.db.View(func(tx *bolt.Tx) error {
+		version, err = bolt_schema_version(tx)
+		fresh = tx.ForEach(func(_ []byte, _ *bolt.Bucket) error {
+			return errors.New("not empty")
+		}) == nil
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading schema version: %s", err)
+	}
+
+	latest := bolt_migrations[len(bolt_migrations)-1].Version
+	if fresh {
+		// A new database is created with the current layout
+		if dry_run {
+			return nil, nil
+		}
+		return nil, s.db.Update(func(tx *bolt.Tx) error {
+			return set_bolt_schema_version(tx, latest)
+		})
+	}
+	if version > latest {
+		return nil, fmt.Errorf("database schema version %d is newer than supported version %d", version, latest)
+	}
+
+	for _, migration := range bolt_migrations {
+		if migration.Version <= version {
+			continue
+		}
+		report := MigrationReport{
+			From:        migration.Version - 1,
+			To:          migration.Version,
+			Description: migration.Description,
+		}
+		if dry_run {
+			// Nothing is written, every pending migration is counted on the
+			// current layout
+			err := s.db.View(func(tx *bolt.Tx) error {
+				progress, err := bolt_migration_progress(tx, migration.Version)
+				if err != nil {
+					return err
+				}
+				report.Changes, err = migration.Count(tx, progress)
+				return err
+			})
+			if err != nil {
+				return reports, fmt.Errorf("migration to version %d: %s", migration.Version, err)
+			}
+			reports = append(reports, report)
+			continue
+		}
+		start := time.Now()
+		var err error
+		if report.Changes, err = s.apply_migration(migration); err != nil {
+			return reports, fmt.Errorf("migration to version %d: %s", migration.Version, err)
+		}
+		reports = append(reports, report)
+		log.Infof("Migrated database to version %d (%s) in %v: %s",
+			migration.Version, migration.Description, time.Since(start), report.Changes)
+	}
+	return reports, nil
+}
+
+// Run a migration batch by batch, each in its own write transaction.
+func (s *BoltStore) apply_migration(migration BoltMigration) (changes string, err error) {
+	for done := false; !done; {
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			progress, err := bolt_migration_progress(tx, migration.Version)
+			if err != nil {
+				return err
+			}
+			if progress.Count > 0 {
+				log.Debugf("Migrating database to version %d, %d keys done", migration.Version, progress.Count)
+			}
+			if changes, done, err = migration.Step(tx, &progress); err != nil {
+				return err
+			}
+			if !done {
+				return set_bolt_migration_progress(tx, progress)
+			}
+			if err := set_bolt_schema_version(tx, migration.Version); err != nil {
+				return err
+			}
+			return tx.Bucket([]byte(META_BUCKET)).Delete([]byte(MIGRATION_PROGRESS_KEY))
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return changes, nil
+}
+
+// Version 1.
+// Earlier versions keyed measurements and rollups with RFC3339 strings,
+// which lost readings sharing the same second.
+// Rewrite these keys into binary time keys. String keys all start with
+// an ASCII digit and sort after binary keys.
+func migrate_time_keys(tx *bolt.Tx, progress *BoltMigrationProgress) (string, bool, error) {
+	budget := MIGRATION_BATCH_SIZE
+	// Rewrite the string keys of a bucket until the budget is spent,
+	// returns whether some are left.
+	rewrite := func(b *bolt.Bucket, is_measure bool) (bool, error) {
+		type entry struct{ k, v []byte }
+		var entries []entry
+		c := b.Cursor()
+		k, v := c.Seek([]byte("0"))
+		for ; k != nil && len(entries) < budget; k, v = c.Next() {
+			entries = append(entries, entry{append([]byte{}, k...), append([]byte{}, v...)})
+		}
+		left := k != nil
+		for _, e := range entries {
+			t, err := time.Parse(time.RFC3339, string(e.k))
+			if err != nil {
+				return false, fmt.Errorf("invalid time key %s: %s", e.k, err)
+			}
+			key := time_key(t)
+			if is_measure {
+				if key, err = measure_key(b, t); err != nil {
+					return false, err
+				}
+			}
+			if err := b.Delete(e.k); err != nil {
+				return false, err
+			}
+			if err := b.Put(key, e.v); err != nil {
+				return false, err
+			}
+		}
+		budget -= len(entries)
+		progress.Count += len(entries)
+		return left, nil
+	}
+
+	// Rewritten keys leave the range of string keys, only the buckets
+	// already done are skipped when resuming.
+	c := tx.Cursor()
+	for name, _ := c.Seek([]byte(progress.Bucket)); name != nil; name, _ = c.Next() {
+		if string(name) != progress.Bucket {
+			progress.Bucket = string(name)
+			progress.Nested = ""
+		}
+		b := tx.Bucket(name)
+		if is_measure_bucket(name) {
+			left, err := rewrite(b, true)
+			if err != nil || left {
+				return "", false, err
+			}
+			continue
+		}
+		for _, rb := range rollup_buckets {
+			if string(name) != rb {
+				continue
+			}
+			nc := b.Cursor()
+			for plug, v := nc.Seek([]byte(progress.Nested)); plug != nil; plug, v = nc.Next() {
+				if v != nil {
+					continue
+				}
+				progress.Nested = string(plug)
+				left, err := rewrite(b.Bucket(plug), false)
+				if err != nil || left {
+					return "", false, err
+				}
+			}
+		}
+	}
+	return fmt.Sprintf("%d keys rewritten", progress.Count), true, nil
+}
+
+// Keys of measurements and rollups still keyed by a string.
+func count_time_keys(tx *bolt.Tx, _ BoltMigrationProgress) (string, error) {
+	count := 0
+	count_bucket := func(b *bolt.Bucket) {
+		c := b.Cursor()
+		for k, _ := c.Seek([]byte("0")); k != nil; k, _ = c.Next() {
+			count++
+		}
+	}
+	err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if is_measure_bucket(name) {
+			count_bucket(b)
+			return nil
+		}
+		for _, rb := range rollup_buckets {
+			if string(name) != rb {
+				continue
+			}
+			return b.ForEach(func(plug []byte, v []byte) error {
+				if v == nil {
+					count_bucket(b.Bucket(plug))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return fmt.Sprintf("%d keys to rewrite", count), err
+}
+
+// Version 2.
+// Set the cumulative energy of the measurements already stored, and save
+// the energy counters of all plugs. The counters are saved after each
+// batch, they carry the energy of a plug over to the next batch.
+func migrate_cumulative_energy(tx *bolt.Tx, progress *BoltMigrationProgress) (string, bool, error) {
+	counters := make(EnergyCounters)
+	saved, err := get_energy_counters(tx)
+	if err != nil {
+		return "", false, err
+	}
+	for i := range saved {
+		counters[saved[i].Id] = &saved[i]
+	}
+
+	budget := MIGRATION_BATCH_SIZE
+	done := true
+	c := tx.Cursor()
+	for name, _ := c.Seek([]byte(progress.Bucket)); name != nil && done; name, _ = c.Next() {
+		if !is_measure_bucket(name) {
+			continue
+		}
+		if string(name) != progress.Bucket {
+			progress.Bucket = string(name)
+			progress.Key = nil
+		}
+		b := tx.Bucket(name)
+		type entry struct {
+			k []byte
+			m Measure
+		}
+		var entries []entry
+		mc := b.Cursor()
+		k, v := mc.First()
+		if progress.Key != nil {
+			if k, v = mc.Seek(progress.Key); bytes.Equal(k, progress.Key) {
+				k, v = mc.Next()
+			}
+		}
+		for ; k != nil && len(entries) < budget; k, v = mc.Next() {
+			var m Measure
+			if err := json.Unmarshal(v, &m); err != nil {
+				return "", false, fmt.Errorf("Unmarshal json measure from db: %s %s", v, err)
+			}
+			entries = append(entries, entry{append([]byte{}, k...), m})
+		}
+		done = k == nil
+		for _, e := range entries {
+			counters.advance(&e.m)
+			encoded, err := json.Marshal(e.m)
+			if err != nil {
+				return "", false, err
+			}
+			if err := b.Put(e.k, encoded); err != nil {
+				return "", false, err
+			}
+			progress.Key = e.k
+		}
+		budget -= len(entries)
+		progress.Count += len(entries)
+	}
+
+	updated := make([]EnergyCounter, 0, len(counters))
+	for _, c := range counters {
+		updated = append(updated, *c)
+	}
+	if err := put_energy_counters(tx, updated); err != nil {
+		return "", false, err
+	}
+	if !done {
+		return "", false, nil
+	}
+	return fmt.Sprintf("%d measurements of %d plugs updated", progress.Count, len(counters)), true, nil
+}
+
+// Measurements left to update after `progress`.
+func count_cumulative_energy(tx *bolt.Tx, progress BoltMigrationProgress) (string, error) {
+	count, plugs := 0, 0
+	c := tx.Cursor()
+	for name, _ := c.Seek([]byte(progress.Bucket)); name != nil; name, _ = c.Next() {
+		if !is_measure_bucket(name) {
+			continue
+		}
+		mc := tx.Bucket(name).Cursor()
+		k, _ := mc.First()
+		if string(name) == progress.Bucket && progress.Key != nil {
+			if k, _ = mc.Seek(progress.Key); bytes.Equal(k, progress.Key) {
+				k, _ = mc.Next()
+			}
+		}
+		if k != nil {
+			plugs++
+		}
+		for ; k != nil; k, _ = mc.Next() {
+			count++
+		}
+	}
+	return fmt.Sprintf("%d measurements of %d plugs to update", count, plugs), nil
+}
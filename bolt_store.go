@@ -0,0 +1,961 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Layout of the bbolt database:
+//   - META: schema version (see bolt_migrate.go) and other metadata
+//   - PLUGS: plug descriptions, keyed by MAC
+//   - one bucket per plug, named after its MAC, holding the raw measurements
+//     keyed by time (see `measure_key`)
+//   - ROLLUPS_MINUTE, ROLLUPS_HOUR, ROLLUPS_DAY: one nested bucket per plug
+//     holding the rollups keyed by the start of their period (see `time_key`)
+//   - PRICES: hourly energy prices keyed by the start of the hour
+//   - ENERGY_COUNTERS: energy counter of each plug, keyed by MAC
+//   - SCHEDULES: switching schedules keyed by id
+//   - RULES: automation rules declared through the API, keyed by name
+//   - RULE_FIRINGS: firings of the automation rules, keyed by time (see
+//     `measure_key`)
+//   - RULE_FIRINGS_BY_RULE: one nested bucket per rule holding the keys of
+//     its firings in RULE_FIRINGS
+const (
+	PLUG_BUCKET        = "PLUGS"
+	PRICE_BUCKET       = "PRICES"
+	COUNTER_BUCKET     = "ENERGY_COUNTERS"
+	SCHEDULE_BUCKET    = "SCHEDULES"
+	RULE_BUCKET        = "RULES"
+	RULE_FIRING_BUCKET = "RULE_FIRINGS"
+	RULE_FIRING_INDEX  = "RULE_FIRINGS_BY_RULE"
+
+	// Size of the time prefix of all keys
+	TIME_KEY_SIZE = 8
+
+	// Maximum number of keys deleted in a single write transaction
+	PRUNE_BATCH_SIZE = 10000
+)
+
+var rollup_buckets = map[string]string{
+	ROLLUP_MINUTE: "ROLLUPS_MINUTE",
+	ROLLUP_HOUR:   "ROLLUPS_HOUR",
+	ROLLUP_DAY:    "ROLLUPS_DAY",
+}
+
+// Store implementation backed by a bbolt database file.
+type BoltStore struct {
+	path string
+	db   *bolt.DB
+	// bbolt handles concurrent transactions by itself, the lock only
+	// protects `db` when the file is swapped by a compaction.
+	lock sync.RWMutex
+	// number of stored rule firings, counted by the first PutRuleFiring
+	// (-1 until then) and kept up to date afterwards
+	firing_mutex sync.Mutex
+	firing_count int
+}
+
+func open_bolt_store(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening db %s: %s", path, err)
+	}
+	return &BoltStore{path: path, db: db, firing_count: -1}, nil
+}
+
+func (s *BoltStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.db.Close()
+}
+
+func (s *BoltStore) view(fn func(*bolt.Tx) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.db.View(fn)
+}
+
+func (s *BoltStore) update(fn func(*bolt.Tx) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.db.Update(fn)
+}
+
+func (s *BoltStore) PersistRecords(measures []Measure) error {
+	err := s.update(func(tx *bolt.Tx) error {
+		for _, measure := range measures {
+			// create bucket for that plug if needed
+			b, err := tx.CreateBucketIfNotExists([]byte(measure.Id))
+			if err != nil {
+				return err
+			}
+
+			key, err := measure_key(b, time.Unix(int64(measure.Timestamp), 0))
+			if err != nil {
+				return err
+			}
+			encoded, err := json.Marshal(measure)
+			if err != nil {
+				return err
+			}
+
+			err = b.Put(key, []byte(encoded))
+			if err != nil {
+				return fmt.Errorf("insert Measure: %d %s", measure.Timestamp, err)
+			}
+			if err := update_rollups(tx, measure); err != nil {
+				return err
+			}
+		}
+		return put_energy_counters(tx, counters_of(measures))
+	})
+	if err != nil {
+		return fmt.Errorf("persist %d records: %s", len(measures), err)
+	}
+	return nil
+}
+
+func (s *BoltStore) GetEnergyCounters() (counters []EnergyCounter, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		counters, err = get_energy_counters(tx)
+		return err
+	})
+	return counters, err
+}
+
+func get_energy_counters(tx *bolt.Tx) ([]EnergyCounter, error) {
+	counters := make([]EnergyCounter, 0)
+	b := tx.Bucket([]byte(COUNTER_BUCKET))
+	if b == nil {
+		return counters, nil
+	}
+	err := b.ForEach(func(k []byte, v []byte) error {
+		var c EnergyCounter
+		if err := json.Unmarshal(v, &c); err != nil {
+			return fmt.Errorf("Unmarshal json energy counter from db: %s %s", v, err)
+		}
+		counters = append(counters, c)
+		return nil
+	})
+	return counters, err
+}
+
+// Save energy counters, unless a more recent state is already saved.
+func put_energy_counters(tx *bolt.Tx, counters []EnergyCounter) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(COUNTER_BUCKET))
+	if err != nil {
+		return err
+	}
+	for _, c := range counters {
+		if v := b.Get([]byte(c.Id)); v != nil {
+			var saved EnergyCounter
+			if err := json.Unmarshal(v, &saved); err == nil && saved.LastTimestamp > c.LastTimestamp {
+				continue
+			}
+		}
+		encoded, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(c.Id), encoded); err != nil {
+			return fmt.Errorf("save energy counter %s: %s", c.Id, err)
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) PersistPlug(plug_desc PlugDescription) error {
+	err := s.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(PLUG_BUCKET))
+		if err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(plug_desc)
+		if err != nil {
+			return err
+		}
+
+		err = b.Put([]byte(plug_desc.Mac), []byte(encoded))
+		if err != nil {
+			return fmt.Errorf("insert plug: %s %s", plug_desc.Hostname, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("persist plug %v: %s", plug_desc, err)
+	}
+	return nil
+}
+
+func (s *BoltStore) GetPlugs() (plugs []PlugDescription, err error) {
+	plugs = make([]PlugDescription, 0, 10)
+	err = s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(PLUG_BUCKET))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var p PlugDescription
+			err := json.Unmarshal(v, &p)
+			if err != nil {
+				return fmt.Errorf("Unmarshal json plug from db: %s %s", v, err)
+			}
+			plugs = append(plugs, p)
+		}
+
+		return nil
+	})
+	return plugs, err
+}
+
+func (s *BoltStore) GetPlug(plugId string) (plug PlugDescription, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(PLUG_BUCKET))
+		if b == nil {
+			return ErrPlugNotFound
+		}
+		v := b.Get([]byte(plugId))
+		if v == nil {
+			return ErrPlugNotFound
+		}
+		err := json.Unmarshal(v, &plug)
+		if err != nil {
+			return fmt.Errorf("Unmarshal json plug from db: %s %s", v, err)
+		}
+		return nil
+	})
+	return plug, err
+}
+
+func (s *BoltStore) UpdatePlugAvailability(plugId string, is_available bool) error {
+	log.Debug("updt_plug_availability ", plugId)
+	err := s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(PLUG_BUCKET))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(plugId))
+		if v == nil {
+			return nil
+		}
+		var plug PlugDescription
+		err := json.Unmarshal(v, &plug)
+		if err != nil {
+			return fmt.Errorf("Unmarshal json plug from db: %s %s", v, err)
+		}
+
+		plug.Is_available = is_available
+		if is_available {
+			plug.LastSeen = time.Now()
+		}
+
+		encoded, err := json.Marshal(plug)
+		if err != nil {
+			return err
+		}
+
+		err = b.Put([]byte(plug.Mac), []byte(encoded))
+		if err != nil {
+			return fmt.Errorf("insert put plug: %s %s", plug.Hostname, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("updating plug availability %s: %s", plugId, err)
+	}
+	return nil
+}
+
+func (s *BoltStore) DeletePlug(plugId string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(PLUG_BUCKET))
+		if b == nil || b.Get([]byte(plugId)) == nil {
+			return ErrPlugNotFound
+		}
+		return b.Delete([]byte(plugId))
+	})
+}
+
+func (s *BoltStore) GetMeasurements(plugId string, from time.Time, to time.Time, limit int) (measures []Measure, err error) {
+	measures = make([]Measure, 0)
+	err = s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(plugId))
+		if b == nil {
+			// no measurement recorded yet for that plug
+			return nil
+		}
+		c := b.Cursor()
+
+		for k, v := c.Seek(time_key(from)); k != nil; k, v = c.Next() {
+			if key_time(k).After(to) {
+				break
+			}
+			var m Measure
+			err := json.Unmarshal(v, &m)
+			if err != nil {
+				return fmt.Errorf("Unmarshal json measure from db: %s %s", v, err)
+			}
+			measures = append(measures, m)
+			if limit > 0 && len(measures) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return measures, err
+}
+
+// Big-endian unix nanoseconds, which sort in chronological order.
+func time_key(t time.Time) []byte {
+	key := make([]byte, TIME_KEY_SIZE)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+func key_time(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[:TIME_KEY_SIZE])))
+}
+
+// Measurement keys are a time key followed by the big-endian sequence
+// number of the bucket, so that several readings with the same timestamp
+// never overwrite each other.
+func measure_key(b *bolt.Bucket, t time.Time) ([]byte, error) {
+	seq, err := b.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, TIME_KEY_SIZE+8)
+	copy(key, time_key(t))
+	binary.BigEndian.PutUint64(key[TIME_KEY_SIZE:], seq)
+	return key, nil
+}
+
+func rollup_key(start uint64) []byte {
+	return time_key(time.Unix(int64(start), 0))
+}
+
+// Aggregate a measurement into the rollups of its plug, for every
+// resolution. Must be called within a write transaction.
+func update_rollups(tx *bolt.Tx, measure Measure) error {
+	for _, resolution := range ROLLUP_RESOLUTIONS {
+		rb, err := tx.CreateBucketIfNotExists([]byte(rollup_buckets[resolution]))
+		if err != nil {
+			return err
+		}
+		b, err := rb.CreateBucketIfNotExists([]byte(measure.Id))
+		if err != nil {
+			return err
+		}
+
+		start := rollup_start(resolution, measure.Timestamp)
+		key := rollup_key(start)
+
+		var rollup Rollup
+		if v := b.Get(key); v != nil {
+			if err := json.Unmarshal(v, &rollup); err != nil {
+				return fmt.Errorf("Unmarshal json rollup from db: %s %s", v, err)
+			}
+			aggregate_measure(&rollup, measure, rollup.LastEnergy, rollup.LastTimestamp)
+		} else {
+			rollup = new_rollup(resolution, measure)
+			// Energy consumed since the last reading of the previous period
+			// is accounted for in this period.
+			_, last := b.Cursor().Last()
+			if last != nil {
+				var previous Rollup
+				if err := json.Unmarshal(last, &previous); err != nil {
+					return fmt.Errorf("Unmarshal json rollup from db: %s %s", last, err)
+				}
+				aggregate_measure(&rollup, measure, previous.LastEnergy, previous.LastTimestamp)
+			} else {
+				aggregate_measure(&rollup, measure, measure.Energy, 0)
+			}
+		}
+
+		encoded, err := json.Marshal(rollup)
+		if err != nil {
+			return err
+		}
+		err = b.Put(key, encoded)
+		if err != nil {
+			return fmt.Errorf("insert rollup: %s %s", key, err)
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) GetRollups(plugId string, resolution string, from time.Time, to time.Time, limit int) (rollups []Rollup, err error) {
+	if !is_rollup_resolution(resolution) {
+		return nil, fmt.Errorf("invalid rollup resolution: %s", resolution)
+	}
+
+	rollups = make([]Rollup, 0)
+	err = s.view(func(tx *bolt.Tx) error {
+		rb := tx.Bucket([]byte(rollup_buckets[resolution]))
+		if rb == nil {
+			return nil
+		}
+		b := rb.Bucket([]byte(plugId))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+
+		start := rollup_key(rollup_start(resolution, uint64(from.Unix())))
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			var rollup Rollup
+			err := json.Unmarshal(v, &rollup)
+			if err != nil {
+				return fmt.Errorf("Unmarshal json rollup from db: %s %s", v, err)
+			}
+			if int64(rollup.Start) < from.Unix() {
+				continue
+			}
+			if int64(rollup.Start) > to.Unix() {
+				break
+			}
+			rollups = append(rollups, rollup)
+			if limit > 0 && len(rollups) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return rollups, err
+}
+
+func (s *BoltStore) PutPrices(prices []Price) error {
+	err := s.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(PRICE_BUCKET))
+		if err != nil {
+			return err
+		}
+		for _, price := range prices {
+			encoded, err := json.Marshal(price)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(rollup_key(price.Start), encoded); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("persist %d prices: %s", len(prices), err)
+	}
+	return nil
+}
+
+func (s *BoltStore) GetPrices(from time.Time, to time.Time) (prices []Price, err error) {
+	prices = make([]Price, 0)
+	err = s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(PRICE_BUCKET))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(time_key(from)); k != nil; k, v = c.Next() {
+			if key_time(k).After(to) {
+				break
+			}
+			var price Price
+			if err := json.Unmarshal(v, &price); err != nil {
+				return fmt.Errorf("Unmarshal json price from db: %s %s", v, err)
+			}
+			prices = append(prices, price)
+		}
+		return nil
+	})
+	return prices, err
+}
+
+func schedule_key(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func (s *BoltStore) GetSchedules() (schedules []Schedule, err error) {
+	schedules = make([]Schedule, 0)
+	err = s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(SCHEDULE_BUCKET))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var schedule Schedule
+			if err := json.Unmarshal(v, &schedule); err != nil {
+				return fmt.Errorf("Unmarshal json schedule from db: %s %s", v, err)
+			}
+			schedules = append(schedules, schedule)
+			return nil
+		})
+	})
+	return schedules, err
+}
+
+func (s *BoltStore) GetSchedule(id uint64) (schedule Schedule, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(SCHEDULE_BUCKET))
+		if b == nil {
+			return ErrScheduleNotFound
+		}
+		v := b.Get(schedule_key(id))
+		if v == nil {
+			return ErrScheduleNotFound
+		}
+		if err := json.Unmarshal(v, &schedule); err != nil {
+			return fmt.Errorf("Unmarshal json schedule from db: %s %s", v, err)
+		}
+		return nil
+	})
+	return schedule, err
+}
+
+func (s *BoltStore) PutSchedule(schedule Schedule) (Schedule, error) {
+	err := s.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(SCHEDULE_BUCKET))
+		if err != nil {
+			return err
+		}
+		if schedule.Id == 0 {
+			if schedule.Id, err = b.NextSequence(); err != nil {
+				return err
+			}
+		} else if b.Get(schedule_key(schedule.Id)) == nil {
+			return ErrScheduleNotFound
+		}
+		encoded, err := json.Marshal(schedule)
+		if err != nil {
+			return err
+		}
+		return b.Put(schedule_key(schedule.Id), encoded)
+	})
+	return schedule, err
+}
+
+func (s *BoltStore) SetScheduleLastRun(id uint64, last_run time.Time) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(SCHEDULE_BUCKET))
+		if b == nil {
+			return ErrScheduleNotFound
+		}
+		v := b.Get(schedule_key(id))
+		if v == nil {
+			return ErrScheduleNotFound
+		}
+		var schedule Schedule
+		if err := json.Unmarshal(v, &schedule); err != nil {
+			return fmt.Errorf("Unmarshal json schedule from db: %s %s", v, err)
+		}
+		schedule.LastRun = last_run
+		encoded, err := json.Marshal(schedule)
+		if err != nil {
+			return err
+		}
+		return b.Put(schedule_key(id), encoded)
+	})
+}
+
+func (s *BoltStore) DeleteSchedule(id uint64) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(SCHEDULE_BUCKET))
+		if b == nil || b.Get(schedule_key(id)) == nil {
+			return ErrScheduleNotFound
+		}
+		return b.Delete(schedule_key(id))
+	})
+}
+
+func (s *BoltStore) GetRules() (rules []Rule, err error) {
+	rules = make([]Rule, 0)
+	err = s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(RULE_BUCKET))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var rule Rule
+			if err := json.Unmarshal(v, &rule); err != nil {
+				return fmt.Errorf("Unmarshal json rule from db: %s %s", v, err)
+			}
+			rules = append(rules, rule)
+			return nil
+		})
+	})
+	return rules, err
+}
+
+func (s *BoltStore) PutRule(rule Rule) error {
+	rule.Source = ""
+	encoded, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(RULE_BUCKET))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(rule.Name), encoded)
+	})
+}
+
+func (s *BoltStore) DeleteRule(name string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(RULE_BUCKET))
+		if b == nil || b.Get([]byte(name)) == nil {
+			return ErrRuleNotFound
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+func (s *BoltStore) PutRuleFiring(firing RuleFiring, keep int) error {
+	encoded, err := json.Marshal(firing)
+	if err != nil {
+		return err
+	}
+	s.firing_mutex.Lock()
+	defer s.firing_mutex.Unlock()
+	count := s.firing_count
+	err = s.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(RULE_FIRING_BUCKET))
+		if err != nil {
+			return err
+		}
+		index, err := tx.CreateBucketIfNotExists([]byte(RULE_FIRING_INDEX))
+		if err != nil {
+			return err
+		}
+		rb, err := index.CreateBucketIfNotExists([]byte(firing.Rule))
+		if err != nil {
+			return err
+		}
+		if count < 0 {
+			count = b.Stats().KeyN
+		}
+		key, err := measure_key(b, firing.Time)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(key, encoded); err != nil {
+			return fmt.Errorf("save firing of rule '%s': %s", firing.Rule, err)
+		}
+		if err := rb.Put(key, []byte{}); err != nil {
+			return err
+		}
+		count++
+
+		// drop the oldest firings
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && keep > 0 && count > keep; k, v = c.First() {
+			var dropped RuleFiring
+			if err := json.Unmarshal(v, &dropped); err != nil {
+				return fmt.Errorf("Unmarshal json rule firing from db: %s %s", v, err)
+			}
+			if rb := index.Bucket([]byte(dropped.Rule)); rb != nil {
+				if err := rb.Delete(k); err != nil {
+					return err
+				}
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			count--
+		}
+		return nil
+	})
+	if err != nil {
+		// counted again on the next firing
+		s.firing_count = -1
+		return err
+	}
+	s.firing_count = count
+	return nil
+}
+
+func (s *BoltStore) GetRuleFirings(rule string, limit int) (firings []RuleFiring, err error) {
+	firings = make([]RuleFiring, 0)
+	err = s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(RULE_FIRING_BUCKET))
+		if b == nil {
+			return nil
+		}
+		// keys of the firings of all rules, or of the rule from its index
+		c := b.Cursor()
+		if rule != "" {
+			index := tx.Bucket([]byte(RULE_FIRING_INDEX))
+			if index == nil || index.Bucket([]byte(rule)) == nil {
+				return nil
+			}
+			c = index.Bucket([]byte(rule)).Cursor()
+		}
+		for k, _ := c.Last(); k != nil && (limit <= 0 || len(firings) < limit); k, _ = c.Prev() {
+			v := b.Get(k)
+			var firing RuleFiring
+			if err := json.Unmarshal(v, &firing); err != nil {
+				return fmt.Errorf("Unmarshal json rule firing from db: %s %s", v, err)
+			}
+			firings = append(firings, firing)
+		}
+		return nil
+	})
+	return firings, err
+}
+
+func (s *BoltStore) GetMeta(key string) (value string, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(META_BUCKET)); b != nil {
+			value = string(b.Get([]byte(key)))
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *BoltStore) PutMeta(key string, value string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(META_BUCKET))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), []byte(value))
+	})
+}
+
+func (s *BoltStore) RebuildRollups(plugId string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		for _, resolution := range ROLLUP_RESOLUTIONS {
+			rb := tx.Bucket([]byte(rollup_buckets[resolution]))
+			if rb == nil || rb.Bucket([]byte(plugId)) == nil {
+				continue
+			}
+			if err := rb.DeleteBucket([]byte(plugId)); err != nil {
+				return err
+			}
+		}
+
+		b := tx.Bucket([]byte(plugId))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var m Measure
+			err := json.Unmarshal(v, &m)
+			if err != nil {
+				return fmt.Errorf("Unmarshal json measure from db: %s %s", v, err)
+			}
+			if err := update_rollups(tx, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Measurement buckets are the top-level buckets named after a plug.
+func is_measure_bucket(name []byte) bool {
+	if string(name) == PLUG_BUCKET || string(name) == META_BUCKET ||
+		string(name) == PRICE_BUCKET || string(name) == COUNTER_BUCKET ||
+		string(name) == SCHEDULE_BUCKET || string(name) == RULE_BUCKET ||
+		string(name) == RULE_FIRING_BUCKET || string(name) == RULE_FIRING_INDEX {
+		return false
+	}
+	for _, rb := range rollup_buckets {
+		if string(name) == rb {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *BoltStore) Prune(policy RetentionPolicy, now time.Time) (report PruneReport, err error) {
+	if cutoff := retention_cutoff(policy.RawDays, now); !cutoff.IsZero() {
+		var plugs [][]byte
+		s.view(func(tx *bolt.Tx) error {
+			return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+				if is_measure_bucket(name) {
+					plugs = append(plugs, append([]byte{}, name...))
+				}
+				return nil
+			})
+		})
+		for _, plug := range plugs {
+			count, err := s.prune_bucket([][]byte{plug}, cutoff)
+			report.Raw += count
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+
+	for _, resolution := range ROLLUP_RESOLUTIONS {
+		cutoff := retention_cutoff(policy.rollup_days(resolution), now)
+		if cutoff.IsZero() {
+			continue
+		}
+		rb_name := []byte(rollup_buckets[resolution])
+		var plugs [][]byte
+		s.view(func(tx *bolt.Tx) error {
+			rb := tx.Bucket(rb_name)
+			if rb == nil {
+				return nil
+			}
+			return rb.ForEach(func(name []byte, v []byte) error {
+				if v == nil {
+					plugs = append(plugs, append([]byte{}, name...))
+				}
+				return nil
+			})
+		})
+		count := 0
+		for _, plug := range plugs {
+			n, err := s.prune_bucket([][]byte{rb_name, plug}, cutoff)
+			count += n
+			if err != nil {
+				return report, err
+			}
+		}
+		report.add_rollups(resolution, count)
+	}
+
+	report.Total = report.Raw + report.Minute + report.Hour + report.Day
+	return report, nil
+}
+
+// Delete all keys older than `cutoff` in the bucket at `path`.
+// Keys are time-ordered, deletion is done in batches to keep
+// write transactions small.
+func (s *BoltStore) prune_bucket(path [][]byte, cutoff time.Time) (count int, err error) {
+	for {
+		deleted := 0
+		err = s.update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(path[0])
+			for _, name := range path[1:] {
+				if b == nil {
+					break
+				}
+				b = b.Bucket(name)
+			}
+			if b == nil {
+				return nil
+			}
+
+			var keys [][]byte
+			cutoff_key := time_key(cutoff)
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil && len(keys) < PRUNE_BATCH_SIZE; k, _ = c.Next() {
+				if bytes.Compare(k[:TIME_KEY_SIZE], cutoff_key) >= 0 {
+					break
+				}
+				keys = append(keys, k)
+			}
+			for _, k := range keys {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			deleted = len(keys)
+			return nil
+		})
+		count += deleted
+		if err != nil || deleted < PRUNE_BATCH_SIZE {
+			return count, err
+		}
+	}
+}
+
+// Rewrite the database file to reclaim the space freed by deleted keys,
+// bbolt never shrinks its file by itself.
+// The store is unavailable while the file is rewritten.
+func (s *BoltStore) Compact() (before int64, after int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tmp_path := s.path + ".compact"
+	// left over by an interrupted compaction
+	if err := os.Remove(tmp_path); err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	dst, err := bolt.Open(tmp_path, 0666, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = s.db.View(func(stx *bolt.Tx) error {
+		return stx.ForEach(func(name []byte, sb *bolt.Bucket) error {
+			return dst.Update(func(dtx *bolt.Tx) error {
+				b, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copy_bucket(sb, b)
+			})
+		})
+	})
+	dst.Close()
+	if err != nil {
+		os.Remove(tmp_path)
+		return 0, 0, fmt.Errorf("compacting %s: %s", s.path, err)
+	}
+
+	if fi, err := os.Stat(s.path); err == nil {
+		before = fi.Size()
+	}
+	if fi, err := os.Stat(tmp_path); err == nil {
+		after = fi.Size()
+	}
+
+	// The compacted file is opened before it replaces the original, the
+	// current handle is kept until then, so that the store stays usable
+	// if anything fails. No write happens meanwhile, the lock is held.
+	compacted, err := bolt.Open(tmp_path, 0666, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		os.Remove(tmp_path)
+		return before, before, fmt.Errorf("opening compacted db %s: %s", tmp_path, err)
+	}
+	if err := os.Rename(tmp_path, s.path); err != nil {
+		compacted.Close()
+		os.Remove(tmp_path)
+		return before, before, fmt.Errorf("replacing db %s with the compacted one: %s", s.path, err)
+	}
+	old := s.db
+	s.db = compacted
+	if err := old.Close(); err != nil {
+		log.Warn("Could not close the uncompacted db: ", err)
+	}
+	log.Infof("Compacted %s from %d to %d bytes", s.path, before, after)
+	return before, after, nil
+}
+
+func copy_bucket(src *bolt.Bucket, dst *bolt.Bucket) error {
+	// keys are mostly appended in order, pages can be filled completely
+	dst.FillPercent = 1.0
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			nested, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copy_bucket(src.Bucket(k), nested)
+		}
+		return dst.Put(k, v)
+	})
+}
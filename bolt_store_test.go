@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Measurements of 10 plugs, one second apart.
+func benchmark_measures(count int) []Measure {
+	measures := make([]Measure, count)
+	for i := range measures {
+		measures[i] = Measure{
+			Id:         fmt.Sprintf("AABBCC0000%02d", i%10),
+			Power:      float64(i % 2000),
+			Energy:     uint32(i),
+			Plug:       "SHPLG-S",
+			Timestamp:  uint64(1700000000 + i/10),
+			Cumulative: uint64(i),
+		}
+	}
+	return measures
+}
+
+// Stores the same measurements with one transaction per measurement, and
+// with one transaction per batch.
+func BenchmarkPersistRecords(b *testing.B) {
+	measures := benchmark_measures(1000)
+	for _, batch_size := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("batch=%d", batch_size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				s, err := open_bolt_store(filepath.Join(b.TempDir(), "plugmeter.db"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				for start := 0; start < len(measures); start += batch_size {
+					end := min(start+batch_size, len(measures))
+					if err := s.PersistRecords(measures[start:end]); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				s.Close()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(measures)), "ns/measure")
+		})
+	}
+}
+
+// A database written before versioning, with measurements keyed by RFC3339
+// strings and no cumulative energy: a dry run lists both migrations
+// without writing anything.
+func TestBoltMigrateDryRun(t *testing.T) {
+	s, err := open_bolt_store(filepath.Join(t.TempDir(), "plugmeter.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("AABBCC001122"))
+		if err != nil {
+			return err
+		}
+		start := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+		for i := 0; i < 3; i++ {
+			at := start.Add(time.Duration(i) * time.Second)
+			encoded, err := json.Marshal(Measure{Id: "AABBCC001122", Power: 600, Energy: uint32(i * 10),
+				Timestamp: uint64(at.Unix())})
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(at.Format(time.RFC3339)), encoded); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(dry_run bool, expected []string) {
+		reports, err := s.Migrate(dry_run)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reports) != len(expected) {
+			t.Fatalf("dry run %v: %d reports, want %d: %v", dry_run, len(reports), len(expected), reports)
+		}
+		for i, r := range reports {
+			if r.To != i+1 || r.Changes != expected[i] {
+				t.Errorf("dry run %v: report %d -> %d: %s, want %d -> %d: %s",
+					dry_run, r.From, r.To, r.Changes, i, i+1, expected[i])
+			}
+		}
+	}
+	check(true, []string{"3 keys to rewrite", "3 measurements of 1 plugs to update"})
+	check(false, []string{"3 keys rewritten", "3 measurements of 1 plugs updated"})
+	check(true, nil)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Shelly Gen1 devices multicast their status with CoIoT, CoAP messages
+// sent over UDP to 224.0.1.187:5683 whenever it changes, and periodically
+// otherwise. When enabled, the listener turns the status of the plugs
+// being polled into measurements, and their polling is suspended as long
+// as they keep pushing updates.
+// See https://shelly-api-docs.shelly.cloud/gen1/#coiot-protocol
+
+const (
+	// CoAP code 0.30, used by Shelly for status updates
+	COIOT_CODE_STATUS = 30
+	// CoAP options
+	COAP_OPTION_URI_PATH  = 11
+	COIOT_OPTION_DEVICEID = 3332
+	// CoIoT v2 sensor ids
+	COIOT_SENSOR_OUTPUT      = 1101
+	COIOT_SENSOR_POWER       = 4101
+	COIOT_SENSOR_ENERGY      = 4103
+	COIOT_SENSOR_TEMPERATURE = 3104
+)
+
+// A decoded CoIoT status: the device id option,
+// "<type>#<id>#<coiot version>", and sensor values by id.
+type CoiotStatus struct {
+	DeviceType string
+	DeviceId   string
+	Values     map[int]float64
+}
+
+// Payload of a status, `G` is a list of [channel, sensor id, value].
+type coiotPayload struct {
+	G [][]interface{}
+}
+
+// Decode a CoAP message, only status updates are accepted.
+func decode_coiot(packet []byte) (CoiotStatus, error) {
+	var status CoiotStatus
+	if len(packet) < 4 || packet[0]>>6 != 1 {
+		return status, errors.New("not a CoAP message")
+	}
+	token_length := int(packet[0] & 0x0f)
+	if packet[1] != COIOT_CODE_STATUS {
+		return status, errors.New("not a CoIoT status")
+	}
+	pos := 4 + token_length
+	if pos > len(packet) {
+		return status, errors.New("truncated CoAP message")
+	}
+
+	// options are encoded as deltas from the previous option number
+	option := 0
+	path := make([]string, 0)
+	var payload []byte
+	for pos < len(packet) {
+		if packet[pos] == 0xff {
+			payload = packet[pos+1:]
+			break
+		}
+		delta := int(packet[pos] >> 4)
+		length := int(packet[pos] & 0x0f)
+		pos++
+		var err error
+		if delta, pos, err = coap_option_value(packet, delta, pos); err != nil {
+			return status, err
+		}
+		if length, pos, err = coap_option_value(packet, length, pos); err != nil {
+			return status, err
+		}
+		if pos+length > len(packet) {
+			return status, errors.New("truncated CoAP option")
+		}
+		option += delta
+		value := string(packet[pos : pos+length])
+		pos += length
+
+		switch option {
+		case COAP_OPTION_URI_PATH:
+			path = append(path, value)
+		case COIOT_OPTION_DEVICEID:
+			parts := strings.Split(value, "#")
+			if len(parts) < 2 {
+				return status, errors.New("invalid CoIoT device id " + value)
+			}
+			status.DeviceType = parts[0]
+			status.DeviceId = strings.ToUpper(parts[1])
+		}
+	}
+	if strings.Join(path, "/") != "cit/s" {
+		return status, errors.New("not a CoIoT status")
+	}
+	if status.DeviceId == "" {
+		return status, errors.New("CoIoT status without device id")
+	}
+
+	var decoded coiotPayload
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		return status, err
+	}
+	status.Values = make(map[int]float64, len(decoded.G))
+	for _, g := range decoded.G {
+		if len(g) != 3 {
+			continue
+		}
+		sensor, ok := g[1].(float64)
+		if !ok {
+			continue
+		}
+		if value, ok := g[2].(float64); ok {
+			status.Values[int(sensor)] = value
+		}
+	}
+	return status, nil
+}
+
+// Extended CoAP option deltas and lengths, 13 and 14 are followed by one
+// and two more bytes.
+func coap_option_value(packet []byte, value int, pos int) (int, int, error) {
+	switch value {
+	case 13:
+		if pos+1 > len(packet) {
+			return 0, pos, errors.New("truncated CoAP option")
+		}
+		return int(packet[pos]) + 13, pos + 1, nil
+	case 14:
+		if pos+2 > len(packet) {
+			return 0, pos, errors.New("truncated CoAP option")
+		}
+		return int(binary.BigEndian.Uint16(packet[pos:])) + 269, pos + 2, nil
+	case 15:
+		return 0, pos, errors.New("invalid CoAP option")
+	}
+	return value, pos, nil
+}
+
+type coiotPlug struct {
+	host        string
+	last_update time.Time
+}
+
+// Plugs whose CoIoT updates are accepted, by mac address.
+type CoiotListener struct {
+	mutex sync.Mutex
+	plugs map[string]*coiotPlug
+	// Polling resumes when a plug did not push anything for this long
+	fallback_timeout time.Duration
+}
+
+// nil when CoIoT is disabled
+var coiot *CoiotListener
+
+func new_coiot_listener(fallback_timeout int) *CoiotListener {
+	return &CoiotListener{
+		plugs:            make(map[string]*coiotPlug),
+		fallback_timeout: time.Duration(fallback_timeout) * time.Second,
+	}
+}
+
+// Accept the updates of a plug being polled.
+func (l *CoiotListener) watch(plug_desc PlugDescription, plug_host string) {
+	if l == nil || plug_desc.Driver != "shelly" || plug_desc.Generation != SHELLY_GEN1 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.plugs[plug_desc.Mac] = &coiotPlug{host: plug_host}
+}
+
+func (l *CoiotListener) forget(mac string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.plugs, mac)
+}
+
+// Whether a plug pushed an update recently, so that it does not need to
+// be polled.
+func (l *CoiotListener) is_pushing(mac string) bool {
+	if l == nil {
+		return false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	plug, ok := l.plugs[mac]
+	return ok && time.Since(plug.last_update) < l.fallback_timeout
+}
+
+// Find the watched plug of a status, the device id is the mac address,
+// or only its end for some devices.
+func (l *CoiotListener) match(status CoiotStatus) (string, *coiotPlug) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for mac, plug := range l.plugs {
+		if strings.HasSuffix(mac, status.DeviceId) {
+			return mac, plug
+		}
+	}
+	return "", nil
+}
+
+// Convert a status to a measurement of a watched plug.
+func (l *CoiotListener) measure_of(status CoiotStatus, from net.IP) (Measure, bool) {
+	power, has_power := status.Values[COIOT_SENSOR_POWER]
+	energy, has_energy := status.Values[COIOT_SENSOR_ENERGY]
+	if !has_power || !has_energy {
+		return Measure{}, false
+	}
+	mac, plug := l.match(status)
+	if plug == nil {
+		log.Debugf("Ignoring CoIoT status of %s#%s from %v, not a polled plug", status.DeviceType, status.DeviceId, from)
+		return Measure{}, false
+	}
+
+	l.mutex.Lock()
+	plug.last_update = time.Now()
+	host := plug.host
+	l.mutex.Unlock()
+
+	return Measure{
+		Id:          mac,
+		Power:       power,
+		Energy:      uint32(energy),
+		Plug:        host,
+		Timestamp:   uint64(time.Now().Unix()),
+		Temperature: status.Values[COIOT_SENSOR_TEMPERATURE],
+	}, true
+}
+
+// Listen for CoIoT status updates on `address`, and send the
+// measurements of watched plugs on the `measurements` channel.
+func (l *CoiotListener) listen(address string, measurements chan Measure) {
+	addr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		log.Error("Invalid CoIoT address, plugs are polled: ", err)
+		return
+	}
+	var conn *net.UDPConn
+	if addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp4", nil, addr)
+	} else {
+		conn, err = net.ListenUDP("udp4", addr)
+	}
+	if err != nil {
+		log.Error("Could not listen for CoIoT updates, plugs are polled: ", err)
+		return
+	}
+	defer conn.Close()
+	log.Info("Listening for CoIoT updates on ", address)
+
+	buffer := make([]byte, 4096)
+	for {
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			log.Error("Error reading CoIoT update: ", err)
+			continue
+		}
+		status, err := decode_coiot(buffer[:n])
+		if err != nil {
+			log.Debugf("Ignoring CoAP message from %v: %s", from, err)
+			continue
+		}
+		if measure, ok := l.measure_of(status, from.IP); ok {
+			measurements <- measure
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Status of a Shelly Plug S (SHPLG-S) with CoIoT v2: Uri-Path "cit/s",
+// device id "SHPLG-S#A1B2C3#2", validity and serial options, then the
+// payload {"G":[[0,1101,1],[0,4101,42.5],[0,4103,3500],[0,3104,31.2],[0,3105,0]]}
+const COIOT_SHPLG_S_STATUS = "501e1234b36369740173ed0bec035348504c472d53234131423243332332d2439600820075ff" +
+	"7b2247223a5b5b302c313130312c315d2c5b302c343130312c34322e355d2c5b302c343130332c333530305d2c" +
+	"5b302c333130342c33312e325d2c5b302c333130352c305d5d7d"
+
+func coiot_packet(t *testing.T, encoded string) []byte {
+	packet, err := hex.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+func TestDecodeCoiot(t *testing.T) {
+	status, err := decode_coiot(coiot_packet(t, COIOT_SHPLG_S_STATUS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.DeviceType != "SHPLG-S" || status.DeviceId != "A1B2C3" {
+		t.Errorf("device: %s %s", status.DeviceType, status.DeviceId)
+	}
+	expected := map[int]float64{
+		COIOT_SENSOR_OUTPUT:      1,
+		COIOT_SENSOR_POWER:       42.5,
+		COIOT_SENSOR_ENERGY:      3500,
+		COIOT_SENSOR_TEMPERATURE: 31.2,
+		3105:                     0,
+	}
+	if len(status.Values) != len(expected) {
+		t.Errorf("values: %v", status.Values)
+	}
+	for sensor, value := range expected {
+		if status.Values[sensor] != value {
+			t.Errorf("sensor %d: %v, want %v", sensor, status.Values[sensor], value)
+		}
+	}
+}
+
+// Every truncation of a status must be rejected, without panicking.
+func TestDecodeCoiotTruncated(t *testing.T) {
+	packet := coiot_packet(t, COIOT_SHPLG_S_STATUS)
+	for length := 0; length < len(packet); length++ {
+		if _, err := decode_coiot(packet[:length]); err == nil {
+			t.Errorf("status truncated to %d bytes was decoded", length)
+		}
+	}
+}
+
+func TestDecodeCoiotMalformed(t *testing.T) {
+	status := COIOT_SHPLG_S_STATUS
+	payload := strings.Index(status, "ff7b22")
+	tests := map[string]string{
+		"CoAP version 2":          "901e" + status[4:],
+		"not a status":            "5001" + status[4:],
+		"token longer than all":   "5f1e1234b3636974",
+		"reserved option delta":   "501e1234f0",
+		"reserved option length":  "501e1234bf",
+		"option longer than all":  "501e1234b863697401",
+		"other path":              strings.Replace(status, "b36369740173", "b36369740174", 1),
+		"device id without id":    "501e1234b36369740173e70bec5348504c472d53ff" + status[payload+2:],
+		"no device id":            "501e1234b36369740173ff" + status[payload+2:],
+		"payload is not json":     status[:payload] + "ff" + hex.EncodeToString([]byte("G=1")),
+		"payload is not a status": status[:payload] + "ff" + hex.EncodeToString([]byte(`{"G":12}`)),
+	}
+	for name, encoded := range tests {
+		if _, err := decode_coiot(coiot_packet(t, encoded)); err == nil {
+			t.Errorf("%s: packet was decoded", name)
+		}
+	}
+}
+
+// Unknown values in the payload are ignored.
+func TestDecodeCoiotInvalidValues(t *testing.T) {
+	payload := `{"G":[[0,4101,"on"],[0,"4103",12],[0,3104],[0,1101,1]]}`
+	status := COIOT_SHPLG_S_STATUS
+	packet := coiot_packet(t, status[:strings.Index(status, "ff7b22")]+"ff"+hex.EncodeToString([]byte(payload)))
+	decoded, err := decode_coiot(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Values) != 1 || decoded.Values[COIOT_SENSOR_OUTPUT] != 1 {
+		t.Errorf("values: %v", decoded.Values)
+	}
+}
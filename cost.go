@@ -0,0 +1,145 @@
+package main
+
+import (
+	"time"
+)
+
+// Cost of the energy consumed by plugs, priced with the tariffs, or the
+// imported spot prices, from the energy deltas of the rollups: minute
+// rollups are used when available, hour rollups once some minute rollups
+// of the hour have been pruned.
+
+type CostPeriod struct {
+	Start time.Time
+	End   time.Time
+	// in kWh
+	Energy float64
+	Cost   float64
+}
+
+type PlugCost struct {
+	Id   string
+	Name string
+	// in kWh
+	Energy  float64
+	Cost    float64
+	Periods []CostPeriod `json:",omitempty"`
+}
+
+type CostReport struct {
+	Currency string
+	From     time.Time
+	To       time.Time
+	// Calendar period the costs are grouped by, if any
+	Period string `json:",omitempty"`
+	// Total energy of all plugs, in kWh
+	Energy     float64
+	EnergyCost float64
+	// Daily charges of the days overlapping the range, counted once
+	// for all plugs
+	FixedCharge float64
+	Cost        float64
+	Plugs       []PlugCost
+	// Totals by period, including the daily charges
+	Periods []CostPeriod `json:",omitempty"`
+}
+
+// Energy consumed during a minute or an hour, in watt-minute.
+type energySlot struct {
+	Start  time.Time
+	Energy uint64
+}
+
+const WMIN_PER_KWH = 60000
+
+// Energy consumed by a plug in [from, to), from minute rollups, or hour
+// rollups for the hours whose minute rollups were pruned (see
+// `energy_rollups`).
+func plug_energy_slots(plugId string, from time.Time, to time.Time) ([]energySlot, error) {
+	rollups, err := energy_rollups(plugId, from, to, false)
+	if err != nil {
+		return nil, err
+	}
+	slots := make([]energySlot, 0, len(rollups))
+	for _, r := range rollups {
+		slots = append(slots, energySlot{time.Unix(int64(r.Start), 0), r.EnergyDelta})
+	}
+	return slots, nil
+}
+
+// Periods of `period` covering [from, to), nil without period.
+func cost_periods(period string, from time.Time, to time.Time, loc *time.Location) []CostPeriod {
+	if period == "" {
+		return nil
+	}
+	periods := make([]CostPeriod, 0)
+	for start := period_start(period, from, loc); start.Before(to); start = period_next(period, start) {
+		periods = append(periods, CostPeriod{Start: start, End: period_next(period, start)})
+	}
+	return periods
+}
+
+// Index of the period containing `ts`, -1 if none.
+func cost_period_index(periods []CostPeriod, ts time.Time) int {
+	for i := range periods {
+		if !ts.Before(periods[i].Start) && ts.Before(periods[i].End) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Compute the cost of the energy consumed by `plugs` in [from, to),
+// grouped by `period` if not empty.
+func compute_cost(t *Tariffs, plugs []PlugDescription, from time.Time, to time.Time, period string) (CostReport, error) {
+	loc := t.Location()
+	report := CostReport{
+		Currency: t.Currency,
+		From:     from.In(loc),
+		To:       to.In(loc),
+		Period:   period,
+		Plugs:    make([]PlugCost, 0, len(plugs)),
+		Periods:  cost_periods(period, from, to, loc),
+	}
+
+	spot, err := spot_prices(t, from, to)
+	if err != nil {
+		return report, err
+	}
+
+	for _, plug := range plugs {
+		slots, err := plug_energy_slots(plug.Mac, from, to)
+		if err != nil {
+			return report, err
+		}
+		plug_cost := PlugCost{
+			Id:      plug.Mac,
+			Name:    plug.Name,
+			Periods: cost_periods(period, from, to, loc),
+		}
+		for _, slot := range slots {
+			price := t.energy_price(slot.Start, spot)
+			energy := float64(slot.Energy) / WMIN_PER_KWH
+			plug_cost.Energy += energy
+			plug_cost.Cost += energy * price
+			if i := cost_period_index(plug_cost.Periods, slot.Start); i >= 0 {
+				plug_cost.Periods[i].Energy += energy
+				plug_cost.Periods[i].Cost += energy * price
+				report.Periods[i].Energy += energy
+				report.Periods[i].Cost += energy * price
+			}
+		}
+		report.Energy += plug_cost.Energy
+		report.EnergyCost += plug_cost.Cost
+		report.Plugs = append(report.Plugs, plug_cost)
+	}
+
+	for day := period_start(PERIOD_DAY, from, loc); day.Before(to); day = period_next(PERIOD_DAY, day) {
+		report.FixedCharge += t.DailyCharge
+		if i := cost_period_index(report.Periods, day); i >= 0 {
+			report.Periods[i].Cost += t.DailyCharge
+		}
+	}
+	report.Cost = report.EnergyCost + report.FixedCharge
+	return report, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const COST_TEST_PLUG = "AABBCC001122"
+
+// Store three hours of 600 W measurements, every 30 seconds from `start`,
+// in a temporary store, then prune the minute rollups older than `pruned`.
+// Returns the energy of the three hours, in Wmin.
+func store_pruned_hours(t *testing.T, start time.Time, pruned time.Time) uint64 {
+	previous_store, previous_location := store, rollup_location
+	var err error
+	store, err = open_bolt_store(filepath.Join(t.TempDir(), "plugmeter.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rollup_location = time.UTC
+	t.Cleanup(func() {
+		store.Close()
+		store, rollup_location = previous_store, previous_location
+	})
+
+	measures := make([]Measure, 0, 360)
+	for i := 0; i < 360; i++ {
+		measures = append(measures, Measure{
+			Id:        COST_TEST_PLUG,
+			Power:     600,
+			Energy:    uint32(i * 300),
+			Timestamp: uint64(start.Add(time.Duration(i) * 30 * time.Second).Unix()),
+		})
+	}
+	if err := store.PersistRecords(measures); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Prune(RetentionPolicy{MinuteDays: 1}, pruned.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	return 359 * 300
+}
+
+func slots_energy(t *testing.T, from time.Time, to time.Time) uint64 {
+	slots, err := plug_energy_slots(COST_TEST_PLUG, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	energy := uint64(0)
+	for _, slot := range slots {
+		energy += slot.Energy
+	}
+	return energy
+}
+
+// The minute rollups of the first hour and a half are pruned: the hours
+// whose minute rollups are incomplete are counted from their hour rollup.
+func TestEnergySlotsPrunedMinutes(t *testing.T) {
+	start := time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)
+	total := store_pruned_hours(t, start, start.Add(90*time.Minute))
+
+	if energy := slots_energy(t, start, start.Add(3*time.Hour)); energy != total {
+		t.Errorf("energy of the three hours: %d Wmin, want %d", energy, total)
+	}
+	// the second hour, half pruned
+	if energy := slots_energy(t, start.Add(time.Hour), start.Add(2*time.Hour)); energy != 120*300 {
+		t.Errorf("energy of the second hour: %d Wmin, want %d", energy, 120*300)
+	}
+	// the last hour is complete, its minute rollups are used
+	if energy := slots_energy(t, start.Add(150*time.Minute), start.Add(3*time.Hour)); energy != 60*300 {
+		t.Errorf("energy of the last half hour: %d Wmin, want %d", energy, 60*300)
+	}
+
+	// pruned hours at the edges are counted in the range they start in
+	for _, split := range []time.Duration{45 * time.Minute, 75 * time.Minute, 150 * time.Minute} {
+		first := slots_energy(t, start, start.Add(split))
+		second := slots_energy(t, start.Add(split), start.Add(3*time.Hour))
+		if first+second != total {
+			t.Errorf("energy split at %v: %d + %d Wmin, want %d", split, first, second, total)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron expressions with the five standard fields, "minute hour
+// day-of-month month day-of-week". Fields accept `*`, lists, ranges and
+// steps (`*/15`, `1-5`, `8-18/2`), months and days of the week also
+// accept their three letter names. Sunday is 0 or 7. As in cron, when both
+// the day of the month and the day of the week are restricted, either
+// of them matches.
+
+// Maximum number of years searched for the next run of an expression
+// that may never match, such as "0 0 31 2 *"
+const CRON_MAX_YEARS = 5
+
+var cron_macros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+var cron_month_names = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cron_day_names = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+type cronField struct {
+	min   int
+	max   int
+	names []string
+	// first value of `names`
+	names_start int
+}
+
+var cron_fields = []cronField{
+	{0, 59, nil, 0},
+	{0, 23, nil, 0},
+	{1, 31, nil, 0},
+	{1, 12, cron_month_names, 1},
+	{0, 7, cron_day_names, 0},
+}
+
+type CronExpr struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+	// whether the days of the month and of the week are restricted
+	any_day     bool
+	any_weekday bool
+}
+
+func parse_cron(expr string) (CronExpr, error) {
+	var cron CronExpr
+	if macro, ok := cron_macros[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != len(cron_fields) {
+		return cron, fmt.Errorf("cron expression '%s' must have %d fields", expr, len(cron_fields))
+	}
+	sets := make([]uint64, len(fields))
+	for i, field := range fields {
+		set, err := cron_fields[i].parse(strings.ToLower(field))
+		if err != nil {
+			return cron, fmt.Errorf("cron expression '%s': %s", expr, err)
+		}
+		sets[i] = set
+	}
+	// 7 is also sunday
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	cron = CronExpr{
+		minutes:     sets[0],
+		hours:       sets[1],
+		days:        sets[2],
+		months:      sets[3],
+		weekdays:    sets[4],
+		any_day:     fields[2] == "*",
+		any_weekday: fields[4] == "*",
+	}
+	return cron, nil
+}
+
+// Parse a field into the set of its values.
+func (f cronField) parse(field string) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in '%s'", item)
+			}
+			item = item[:i]
+		}
+		start, end := f.min, f.max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if start, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = f.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// "a/n" goes from a to the maximum
+				end = f.max
+			}
+			if end < start {
+				return 0, fmt.Errorf("invalid range '%s'", item)
+			}
+		}
+		for v := start; v <= end; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if s == name {
+			return f.names_start + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value '%s', expected %d-%d", s, f.min, f.max)
+	}
+	return v, nil
+}
+
+func (c CronExpr) day_matches(t time.Time) bool {
+	day := c.days&(1<<uint(t.Day())) != 0
+	weekday := c.weekdays&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.any_day && c.any_weekday:
+		return true
+	case c.any_day:
+		return weekday
+	case c.any_weekday:
+		return day
+	}
+	return day || weekday
+}
+
+// First time matching the expression strictly after `after`, in the
+// location of `after`. Returns a zero time if there is none within
+// CRON_MAX_YEARS.
+// Expressions match the wall clock: the times skipped when the clock
+// moves forward run when it does, the times repeated when it moves back
+// only run the first time.
+func (c CronExpr) next(after time.Time) time.Time {
+	loc := after.Location()
+	wall := wall_clock(after)
+	for {
+		if wall = c.next_wall(wall); wall.IsZero() {
+			return wall
+		}
+		if t := wall_time(wall, loc); t.After(after) {
+			return t
+		}
+	}
+}
+
+// First wall clock time, in UTC where every minute exists once, matching
+// the expression strictly after `after`.
+func (c CronExpr) next_wall(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(CRON_MAX_YEARS, 0, 0)
+	for t.Before(limit) {
+		if c.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.day_matches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if c.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+		if c.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Wall clock of `t` in its location, as a UTC time.
+func wall_clock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// Time at which the clock of `loc` shows `wall`: when the clock moves
+// forward for the times it skips, the first time for those it repeats.
+func wall_time(wall time.Time, loc *time.Location) time.Time {
+	t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), 0, 0, loc)
+	start, end := t.ZoneBounds()
+	if shown := wall_clock(t); shown.After(wall) {
+		return start
+	} else if shown.Before(wall) {
+		return end
+	}
+	if !start.IsZero() {
+		// the same wall clock before the last change of offset
+		_, offset := start.Add(-time.Second).Zone()
+		earlier := time.Unix(wall.Unix()-int64(offset), 0).In(loc)
+		if earlier.Before(start) && wall_clock(earlier).Equal(wall) {
+			return earlier
+		}
+	}
+	return t
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func must_load_location(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skip("timezone data not available: ", err)
+	}
+	return loc
+}
+
+// Next runs of an expression from a time, in its location.
+func cron_runs(t *testing.T, expr string, from time.Time, count int) []time.Time {
+	cron, err := parse_cron(expr)
+	if err != nil {
+		t.Fatalf("parse_cron(%q): %s", expr, err)
+	}
+	runs := make([]time.Time, 0, count)
+	for i := 0; i < count; i++ {
+		from = cron.next(from)
+		runs = append(runs, from)
+	}
+	return runs
+}
+
+func check_runs(t *testing.T, name string, runs []time.Time, expected []string) {
+	t.Helper()
+	for i, run := range runs {
+		if i >= len(expected) {
+			break
+		}
+		if got := run.Format("2006-01-02 15:04 MST"); got != expected[i] {
+			t.Errorf("%s: run %d is %s, want %s", name, i, got, expected[i])
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// a Wednesday
+	from := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expr     string
+		expected []string
+	}{
+		// README example, on weekdays
+		{"30 6 * * mon-fri", []string{"2024-05-16 06:30 UTC", "2024-05-17 06:30 UTC", "2024-05-20 06:30 UTC"}},
+		{"30 6 * * MON-FRI", []string{"2024-05-16 06:30 UTC", "2024-05-17 06:30 UTC", "2024-05-20 06:30 UTC"}},
+		{"30 6 * * 1-5", []string{"2024-05-16 06:30 UTC", "2024-05-17 06:30 UTC", "2024-05-20 06:30 UTC"}},
+		{"*/20 * * * *", []string{"2024-05-15 12:20 UTC", "2024-05-15 12:40 UTC", "2024-05-15 13:00 UTC"}},
+		{"10-20/5 12 * * *", []string{"2024-05-15 12:10 UTC", "2024-05-15 12:15 UTC", "2024-05-15 12:20 UTC", "2024-05-16 12:10 UTC"}},
+		{"50/5 * * * *", []string{"2024-05-15 12:50 UTC", "2024-05-15 12:55 UTC", "2024-05-15 13:50 UTC"}},
+		{"0 8-18/4 * * *", []string{"2024-05-15 16:00 UTC", "2024-05-16 08:00 UTC", "2024-05-16 12:00 UTC"}},
+		{"0 7,19 * * *", []string{"2024-05-15 19:00 UTC", "2024-05-16 07:00 UTC"}},
+		{"0 0 1 jan,jul *", []string{"2024-07-01 00:00 UTC", "2025-01-01 00:00 UTC"}},
+		{"0 9 * * sat,sun", []string{"2024-05-18 09:00 UTC", "2024-05-19 09:00 UTC", "2024-05-25 09:00 UTC"}},
+		// sunday is 0 or 7
+		{"0 9 * * 7", []string{"2024-05-19 09:00 UTC", "2024-05-26 09:00 UTC"}},
+		{"0 9 * * 0", []string{"2024-05-19 09:00 UTC", "2024-05-26 09:00 UTC"}},
+		// restricted day of the month and day of the week: either matches
+		{"0 12 1,15 * fri", []string{"2024-05-17 12:00 UTC", "2024-05-24 12:00 UTC", "2024-05-31 12:00 UTC", "2024-06-01 12:00 UTC", "2024-06-07 12:00 UTC"}},
+		{"0 12 20 * *", []string{"2024-05-20 12:00 UTC", "2024-06-20 12:00 UTC"}},
+		{"0 12 * * tue", []string{"2024-05-21 12:00 UTC", "2024-05-28 12:00 UTC"}},
+		{"0 12 31 * *", []string{"2024-05-31 12:00 UTC", "2024-07-31 12:00 UTC"}},
+		{"0 0 29 2 *", []string{"2028-02-29 00:00 UTC"}},
+		{"@daily", []string{"2024-05-16 00:00 UTC", "2024-05-17 00:00 UTC"}},
+		{"@weekly", []string{"2024-05-19 00:00 UTC"}},
+		{"@monthly", []string{"2024-06-01 00:00 UTC"}},
+	}
+	for _, test := range tests {
+		check_runs(t, test.expr, cron_runs(t, test.expr, from, len(test.expected)), test.expected)
+	}
+}
+
+// Runs are strictly after the given time, seconds are ignored.
+func TestCronNextStrictlyAfter(t *testing.T) {
+	cron, _ := parse_cron("30 6 * * *")
+	at := time.Date(2024, 5, 15, 6, 30, 0, 0, time.UTC)
+	if next := cron.next(at); !next.Equal(at.AddDate(0, 0, 1)) {
+		t.Errorf("next run after a run: %s", next)
+	}
+	if next := cron.next(at.Add(-time.Second)); !next.Equal(at) {
+		t.Errorf("next run a second before: %s", next)
+	}
+	if next := cron.next(at.Add(59 * time.Second)); !next.Equal(at.AddDate(0, 0, 1)) {
+		t.Errorf("next run during the minute of a run: %s", next)
+	}
+}
+
+func TestCronNextNever(t *testing.T) {
+	cron, _ := parse_cron("0 0 31 2 *")
+	if next := cron.next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); !next.IsZero() {
+		t.Errorf("next run of February 31st: %s", next)
+	}
+}
+
+func TestCronNextLocation(t *testing.T) {
+	paris := must_load_location(t, "Europe/Paris")
+	runs := cron_runs(t, "30 6 * * mon-fri", time.Date(2024, 5, 15, 12, 0, 0, 0, paris), 1)
+	check_runs(t, "Paris", runs, []string{"2024-05-16 06:30 CEST"})
+	if runs[0].Location() != paris {
+		t.Errorf("run in %s", runs[0].Location())
+	}
+}
+
+func TestCronNextDaylightSaving(t *testing.T) {
+	paris := must_load_location(t, "Europe/Paris")
+	tests := []struct {
+		name     string
+		expr     string
+		from     time.Time
+		expected []string
+	}{
+		// on March 31 2024, the clock moves from 02:00 to 03:00
+		{"skipped time", "30 2 * * *", time.Date(2024, 3, 30, 12, 0, 0, 0, paris),
+			[]string{"2024-03-31 03:00 CEST", "2024-04-01 02:30 CEST"}},
+		{"skipped times run once", "*/20 * * * *", time.Date(2024, 3, 31, 1, 30, 0, 0, paris),
+			[]string{"2024-03-31 01:40 CET", "2024-03-31 03:00 CEST", "2024-03-31 03:20 CEST"}},
+		{"time after the gap", "15 3 * * *", time.Date(2024, 3, 30, 12, 0, 0, 0, paris),
+			[]string{"2024-03-31 03:15 CEST", "2024-04-01 03:15 CEST"}},
+		// on October 27 2024, the clock moves from 03:00 back to 02:00
+		{"repeated time", "30 2 * * *", time.Date(2024, 10, 26, 12, 0, 0, 0, paris),
+			[]string{"2024-10-27 02:30 CEST", "2024-10-28 02:30 CET"}},
+		{"repeated hour", "0,30 * * * *", time.Date(2024, 10, 27, 1, 45, 0, 0, paris),
+			[]string{"2024-10-27 02:00 CEST", "2024-10-27 02:30 CEST", "2024-10-27 03:00 CET"}},
+		{"day of the change", "0 12 * * *", time.Date(2024, 10, 26, 12, 0, 0, 0, paris),
+			[]string{"2024-10-27 12:00 CET", "2024-10-28 12:00 CET"}},
+	}
+	for _, test := range tests {
+		check_runs(t, test.name, cron_runs(t, test.expr, test.from, len(test.expected)), test.expected)
+	}
+
+	// from within the repeated hour, the times already run are not run again
+	cron, _ := parse_cron("0,30 * * * *")
+	for _, from := range []time.Time{
+		time.Date(2024, 10, 27, 0, 40, 0, 0, time.UTC).In(paris), // 02:40 CEST
+		time.Date(2024, 10, 27, 1, 10, 0, 0, time.UTC).In(paris), // 02:10 CET
+	} {
+		if next := cron.next(from); next.Format("15:04 MST") != "03:00 CET" {
+			t.Errorf("next run from %s: %s", from, next)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"* * * * monday",
+		"* * * foo *",
+		"1,,2 * * * *",
+		"@reboot",
+	} {
+		if _, err := parse_cron(expr); err == nil {
+			t.Errorf("parse_cron(%q) did not fail", expr)
+		}
+	}
+}
@@ -1,18 +1,11 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	viper "github.com/spf13/viper"
-
-	bolt "go.etcd.io/bbolt"
-)
-
-const (
-	PLUG_BUCKET = "PLUGS"
 )
 
 type PlugDescription struct {
@@ -24,165 +17,146 @@ type PlugDescription struct {
 	AddrV4       string
 	Mac          string
 	Is_available bool
+	// Shelly API generation, 1 for the /settings, /status and /meter
+	// endpoints, 2 and above for the RPC API, 0 for other drivers
+	Generation int
+	// Name of the PlugDriver of the plug
+	Driver string
 }
 
-func db_file_path() string {
-	return viper.GetString("data.db_file")
+var ErrPlugNotFound = errors.New("plug not found")
+
+// Store persists plugs descriptions and their measurements.
+// A single Store is opened at startup and shared by the pollers
+// and the web handlers, implementations must be safe for concurrent use.
+// It is made of focused interfaces, features that keep their own
+// reference to the store only depend on the ones they use.
+type Store interface {
+	PlugStore
+	MeasureStore
+	PriceStore
+	ScheduleStore
+	RuleStore
+	MaintenanceStore
 }
 
-func persist_record(measure Measure) {
+type PlugStore interface {
+	// Save or update a plug information
+	PersistPlug(plug_desc PlugDescription) error
+	// Get all known plugs
+	GetPlugs() ([]PlugDescription, error)
+	// Returns ErrPlugNotFound if the plug is unknown
+	GetPlug(plugId string) (PlugDescription, error)
+	UpdatePlugAvailability(plugId string, is_available bool) error
+	// Forget a plug description, its measurements are kept.
+	// Returns ErrPlugNotFound if the plug is unknown
+	DeletePlug(plugId string) error
+}
 
-	db, err := bolt.Open(db_file_path(), 0666, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
-	err = db.Update(func(tx *bolt.Tx) error {
-		// create bucket for that plug if needed
-		b, err := tx.CreateBucketIfNotExists([]byte(measure.Id))
-		if err != nil {
-			return err
-		}
-
-		// now := time.Now()
-		// nowFormat := now.Format(time.RFC3339)
-		timeM := time.Unix(int64(measure.Timestamp), 0).Format(time.RFC3339)
-		encoded, err := json.Marshal(measure)
-		if err != nil {
-			return err
-		}
-
-		err = b.Put([]byte(timeM), []byte(encoded))
-		if err != nil {
-			return fmt.Errorf("insert Measure: %s %s", timeM, err)
-		}
-		return err
-
-	})
-	if err != nil {
-		log.Fatal("ERROR persist_record ", measure, err)
-	}
+// Measurements, their rollups and the energy counters of the plugs.
+type MeasureStore interface {
+	// Store a batch of measurements in a single write, with the energy
+	// counters after the last measurement of each plug
+	PersistRecords(measures []Measure) error
+	// Get the energy counters saved with the last measurements
+	GetEnergyCounters() ([]EnergyCounter, error)
+
+	// Get the measurements recorded for a plug between `from` and `to`
+	// (both inclusive), in chronological order.
+	// At most `limit` measurements are returned, `limit` <= 0 means no limit.
+	GetMeasurements(plugId string, from time.Time, to time.Time, limit int) ([]Measure, error)
+
+	// Get the rollups of a plug for a given resolution, whose period starts
+	// between `from` and `to` (both inclusive), in chronological order.
+	GetRollups(plugId string, resolution string, from time.Time, to time.Time, limit int) ([]Rollup, error)
+	// Drop all the rollups of a plug and compute them again from its
+	// raw measurements.
+	RebuildRollups(plugId string) error
 }
 
-// Save or update a plug information
-func persist_plug(plug_desc PlugDescription) {
+type PriceStore interface {
+	// Save hourly energy prices, replacing the prices already stored
+	// for the same hours.
+	PutPrices(prices []Price) error
+	// Get the prices of the hours starting between `from` and `to` (both
+	// inclusive), in chronological order.
+	GetPrices(from time.Time, to time.Time) ([]Price, error)
+}
 
-	db, err := bolt.Open(db_file_path(), 0666, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
-	err = db.Update(func(tx *bolt.Tx) error {
-		// create bucket for that plug if needed
-		b, err := tx.CreateBucketIfNotExists([]byte(PLUG_BUCKET))
-		if err != nil {
-			return err
-		}
-		encoded, err := json.Marshal(plug_desc)
-		if err != nil {
-			return err
-		}
-
-		err = b.Put([]byte(plug_desc.Mac), []byte(encoded))
-		if err != nil {
-			return fmt.Errorf("insert plug: %s %s", plug_desc.Hostname, err)
-		}
-		return err
-	})
-	if err != nil {
-		log.Fatal("ERROR persist_plug ", plug_desc, err)
-	}
+type ScheduleStore interface {
+	// Get all schedules, ordered by id
+	GetSchedules() ([]Schedule, error)
+	// Returns ErrScheduleNotFound if the schedule is unknown
+	GetSchedule(id uint64) (Schedule, error)
+	// Save a schedule, a new id is assigned to schedules whose id is 0.
+	// Returns the saved schedule
+	PutSchedule(schedule Schedule) (Schedule, error)
+	// Set when a schedule was last run, without changing it otherwise.
+	// Returns ErrScheduleNotFound if the schedule is unknown
+	SetScheduleLastRun(id uint64, last_run time.Time) error
+	// Returns ErrScheduleNotFound if the schedule is unknown
+	DeleteSchedule(id uint64) error
 }
 
-// Get all known plugs
-func get_plugs() (plugs []PlugDescription) {
-	db, err := bolt.Open(db_file_path(), 0666, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
-
-	plugs = make([]PlugDescription, 0, 10)
-	db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(PLUG_BUCKET))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			var p PlugDescription
-			err := json.Unmarshal(v, &p)
-			if err != nil {
-				return fmt.Errorf("Unmarshal json plug from db: %s %s", v, err)
-			}
-			plugs = append(plugs, p)
-		}
-
-		return nil
-	})
-	return plugs
+// Automation rules declared through the API and the firings of all rules.
+type RuleStore interface {
+	// Get the automation rules declared through the API, ordered by name
+	GetRules() ([]Rule, error)
+	// Save a rule, replacing the rule of the same name
+	PutRule(rule Rule) error
+	// Returns ErrRuleNotFound if the rule is unknown
+	DeleteRule(name string) error
+	// Record a firing of an automation rule, keeping only the `keep` most
+	// recent firings of all rules, `keep` <= 0 keeps them all
+	PutRuleFiring(firing RuleFiring, keep int) error
+	// Get the firings of a rule, or of all rules when `rule` is empty,
+	// most recent first.
+	// At most `limit` firings are returned, `limit` <= 0 means no limit.
+	GetRuleFirings(rule string, limit int) ([]RuleFiring, error)
 }
 
-func get_plug(plugId string) (plug PlugDescription) {
+// Retention, compaction, metadata and schema of the storage.
+type MaintenanceStore interface {
+	// Remove all data older than the retention policy.
+	Prune(policy RetentionPolicy, now time.Time) (PruneReport, error)
+	// Reclaim the space freed by deleted data, returns the size of the
+	// storage before and after compaction.
+	Compact() (before int64, after int64, err error)
 
-	db, err := bolt.Open(db_file_path(), 0666, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
-	db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(PLUG_BUCKET))
-		v := b.Get([]byte(plugId))
-		err := json.Unmarshal(v, &plug)
-		if err != nil {
-			return fmt.Errorf("Unmarshal json plug from db: %s %s", v, err)
-		}
-		return nil
-	})
-	return
+	// Get a metadata value of the storage, empty if it is not set
+	GetMeta(key string) (string, error)
+	PutMeta(key string, value string) error
+
+	// Upgrade the storage to the current schema version. With `dry_run`
+	// nothing is written, the reports describe what would change.
+	Migrate(dry_run bool) ([]MigrationReport, error)
+
+	Close() error
 }
 
-func updt_plug_availability(plugId string, is_available bool) {
-	log.Debug("updt_plug_availability ", plugId)
-	db, err := bolt.Open(db_file_path(), 0666, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
-
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(PLUG_BUCKET))
-		v := b.Get([]byte(plugId))
-		if v == nil {
-			return nil
-		}
-		var plug PlugDescription
-		errt := json.Unmarshal(v, &plug)
-		if errt != nil {
-			fmt.Println("ERROR", errt)
-			// FIXME : trigerred when the plug is not found in db but ignored ?
-			return fmt.Errorf("Unmarshal json plug from db: %s %s", v, errt)
-		}
-
-		plug.Is_available = is_available
-		if is_available {
-			plug.LastSeen = time.Now()
-		}
-
-		encoded, errt := json.Marshal(plug)
-		if err != nil {
-			return errt
-		}
-
-		errt = b.Put([]byte(plug.Mac), []byte(encoded))
-		if err != nil {
-			return fmt.Errorf("insert put plug: %s %s", plug.Hostname, err)
-		}
-
-		return nil
-
-	})
-	if err != nil {
-		// FIXME : this exits the progem but no message is displayed ??
-		log.Fatal("ERROR updating plug availability", plugId, err)
-	}
+// Summary of a schema migration from version `From` to version `To`.
+type MigrationReport struct {
+	From        int
+	To          int
+	Description string
+	Changes     string
+}
 
+// The store shared by the whole daemon, opened in main.
+var store Store
+
+func db_file_path() string {
+	return viper.GetString("data.db_file")
+}
+
+// Open the storage backend selected by `data.backend`.
+func open_store() (Store, error) {
+	switch backend := viper.GetString("data.backend"); backend {
+	case "bolt":
+		return open_bolt_store(db_file_path())
+	case "sqlite":
+		return open_sqlite_store(db_file_path())
+	default:
+		return nil, fmt.Errorf("unknown storage backend '%s'", backend)
+	}
 }
@@ -23,6 +23,8 @@ type PlugEntry struct {
 	Id          string
 	AddrV4      net.IP
 	AddrV6      net.IP
+	// Name of the PlugDriver, the default one if empty
+	Driver string
 }
 
 // https://github.com/grasparv/go-chromecast/blob/master/dns/dns.go
@@ -57,7 +59,7 @@ func detectPlugs() []PlugEntry {
 				AddrV4:      entry.AddrV4,
 				AddrV6:      entry.AddrV6,
 			}
-			log.Debugf("PLUG http service found: %s %s", plug, entry)
+			log.Debugf("PLUG http service found: %v %v", plug, entry)
 			plugs = append(plugs, plug)
 		}
 	}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// A PlugDriver talks to one brand or family of smart plugs. Drivers
+// register themselves, by name, from the init() of their file; static
+// plugs name the driver to use in the configuration, discovered plugs
+// use the default one.
+
+const DEFAULT_PLUG_DRIVER = "shelly"
+
+type PlugDriver interface {
+	// Name of the driver in the configuration
+	Name() string
+	// Describe the plug reachable at `plug_host`.
+	Describe(plug_host string) (PlugDescription, error)
+	// Read the meter of a plug described by this driver. `Total` is the
+	// energy counter of the plug in Wmin.
+	ReadMeter(plug_desc PlugDescription, plug_host string) (MeterInfo, error)
+}
+
+// Optionally implemented by drivers able to switch the relay of a plug.
+// Both methods return the state of the relay after the command.
+type RelayDriver interface {
+	// Turn the relay on or off, and back after `timer` seconds if
+	// `timer` is not 0.
+	SetRelay(plug_desc PlugDescription, plug_host string, on bool, timer int) (bool, error)
+	ToggleRelay(plug_desc PlugDescription, plug_host string) (bool, error)
+}
+
+var ErrTimerNotSupported = errors.New("timed switching is not supported by the plug driver")
+
+var plug_drivers = make(map[string]PlugDriver)
+
+func register_plug_driver(driver PlugDriver) {
+	if _, ok := plug_drivers[driver.Name()]; ok {
+		panic("plug driver registered twice: " + driver.Name())
+	}
+	plug_drivers[driver.Name()] = driver
+}
+
+// Get a driver by name, the default one for an empty name.
+func get_plug_driver(name string) (PlugDriver, error) {
+	if name == "" {
+		name = DEFAULT_PLUG_DRIVER
+	}
+	driver, ok := plug_drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown plug driver %q, available drivers: %v", name, plug_driver_names())
+	}
+	return driver, nil
+}
+
+func plug_driver_names() []string {
+	names := make([]string, 0, len(plug_drivers))
+	for name := range plug_drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A plug configured in `[[plugs.static]]`.
+type StaticPlug struct {
+	Address string
+	Driver  string
+}
+
+// Plugs monitored no matter the discovery settings: those of
+// `plugs.ips` with the default driver, then those of `plugs.static`.
+// Exits if a plug names an unknown driver.
+func static_plugs() []StaticPlug {
+	plugs := make([]StaticPlug, 0)
+	for _, ip := range viper.GetStringSlice("plugs.ips") {
+		plugs = append(plugs, StaticPlug{Address: ip, Driver: DEFAULT_PLUG_DRIVER})
+	}
+	var configured []StaticPlug
+	if err := viper.UnmarshalKey("plugs.static", &configured); err != nil {
+		log.Fatal("Could not read static plugs: ", err)
+	}
+	for _, plug := range configured {
+		if net.ParseIP(plug.Address) == nil {
+			log.Fatalf("Static plug address %q is not an IP address", plug.Address)
+		}
+		if plug.Driver == "" {
+			plug.Driver = DEFAULT_PLUG_DRIVER
+		}
+		if _, err := get_plug_driver(plug.Driver); err != nil {
+			log.Fatal("Static plug ", plug.Address, ": ", err)
+		}
+		plugs = append(plugs, plug)
+	}
+	return plugs
+}
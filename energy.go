@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The energy counter of a plug (`Measure.Energy`, in watt-minute) is reset
+// to zero when the plug reboots, and wraps around after 2^32 Wmin.
+// PlugMeter keeps, for each plug, the offset to add to the raw counter to
+// get a monotonic cumulative energy (`Measure.Cumulative`). The counters
+// are saved with the measurements, so the offsets survive restarts.
+
+// A wraparound is assumed, rather than a reset, when the counter goes
+// from less than this margin below the maximum to less than the margin.
+const ENERGY_WRAP_MARGIN = 1 << 24
+
+type EnergyCounter struct {
+	Id string
+	// Last raw reading of the plug
+	LastEnergy    uint32
+	LastTimestamp uint64
+	// Energy counted before the last reset, in Wmin
+	Offset uint64
+}
+
+// Energy consumed between two raw readings of a plug counter, in Wmin.
+func energy_delta(last uint32, current uint32) uint64 {
+	if current >= last {
+		return uint64(current - last)
+	}
+	if last >= math.MaxUint32-ENERGY_WRAP_MARGIN && current < ENERGY_WRAP_MARGIN {
+		// wraparound
+		return uint64(math.MaxUint32-last) + uint64(current) + 1
+	}
+	// reset, the counter restarted from 0
+	return uint64(current)
+}
+
+// Monotonic energy in Wmin of the last reading.
+func (c *EnergyCounter) Cumulative() uint64 {
+	return c.Offset + uint64(c.LastEnergy)
+}
+
+// Set the cumulative energy of a measurement, and advance the counter.
+// Readings older than the last one do not change the counter.
+func (c *EnergyCounter) advance(measure *Measure) {
+	if measure.Timestamp < c.LastTimestamp {
+		measure.Cumulative = c.Offset + uint64(measure.Energy)
+		if measure.Cumulative > c.Cumulative() {
+			measure.Cumulative = c.Cumulative()
+		}
+		return
+	}
+	cumulative := c.Cumulative() + energy_delta(c.LastEnergy, measure.Energy)
+	c.Offset = cumulative - uint64(measure.Energy)
+	c.LastEnergy = measure.Energy
+	c.LastTimestamp = measure.Timestamp
+	measure.Cumulative = cumulative
+}
+
+// Counters of all plugs, used by the goroutine storing measurements.
+type EnergyCounters map[string]*EnergyCounter
+
+func load_energy_counters() EnergyCounters {
+	counters := make(EnergyCounters)
+	saved, err := store.GetEnergyCounters()
+	if err != nil {
+		log.Error("Could not read energy counters, offsets are reset: ", err)
+	}
+	for i := range saved {
+		counters[saved[i].Id] = &saved[i]
+	}
+	return counters
+}
+
+// Set the cumulative energy of a measurement. The first reading of an
+// unknown plug starts its counter.
+func (counters EnergyCounters) advance(measure *Measure) {
+	c, ok := counters[measure.Id]
+	if !ok {
+		c = &EnergyCounter{Id: measure.Id, LastEnergy: measure.Energy, LastTimestamp: measure.Timestamp}
+		counters[measure.Id] = c
+	}
+	before := c.Offset
+	c.advance(measure)
+	if c.Offset > before {
+		log.Infof("Energy counter of %s was reset, offset is now %d Wmin", measure.Id, c.Offset)
+	}
+}
+
+// Counters after the last reading of each plug in `measures`, to be saved
+// with them. Every measure must have its cumulative energy set.
+func counters_of(measures []Measure) []EnergyCounter {
+	last := make(map[string]int)
+	for i, m := range measures {
+		if j, ok := last[m.Id]; !ok || m.Timestamp >= measures[j].Timestamp {
+			last[m.Id] = i
+		}
+	}
+	counters := make([]EnergyCounter, 0, len(last))
+	for _, i := range last {
+		m := measures[i]
+		counters = append(counters, EnergyCounter{
+			Id:            m.Id,
+			LastEnergy:    m.Energy,
+			LastTimestamp: m.Timestamp,
+			Offset:        m.Cumulative - uint64(m.Energy),
+		})
+	}
+	return counters
+}
+
+// Energy in kWh of a Wmin counter.
+func energy_kwh(wmin uint64) float64 {
+	return float64(wmin) / WMIN_PER_KWH
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEnergyDelta(t *testing.T) {
+	tests := []struct {
+		name    string
+		last    uint32
+		current uint32
+		delta   uint64
+	}{
+		{"no change", 1000, 1000, 0},
+		{"increase", 1000, 1250, 250},
+		{"reset to 0", 1000, 0, 0},
+		{"reset then increase", 1000, 30, 30},
+		{"reset near the maximum", math.MaxUint32 - 10, ENERGY_WRAP_MARGIN + 5, ENERGY_WRAP_MARGIN + 5},
+		{"wraparound", math.MaxUint32 - 10, 5, 16},
+		{"wraparound to 0", math.MaxUint32, 0, 1},
+		{"wraparound at the margins", math.MaxUint32 - ENERGY_WRAP_MARGIN, ENERGY_WRAP_MARGIN - 1, 2 * ENERGY_WRAP_MARGIN},
+	}
+	for _, test := range tests {
+		if delta := energy_delta(test.last, test.current); delta != test.delta {
+			t.Errorf("%s: energy_delta(%d, %d) = %d, want %d", test.name, test.last, test.current, delta, test.delta)
+		}
+	}
+}
+
+func TestEnergyCounterAdvance(t *testing.T) {
+	type reading struct {
+		energy     uint32
+		timestamp  uint64
+		cumulative uint64
+	}
+	tests := []struct {
+		name     string
+		readings []reading
+		offset   uint64
+	}{
+		{"first reading", []reading{{500, 10, 500}}, 0},
+		{"normal increase", []reading{{500, 10, 500}, {520, 11, 520}, {600, 12, 600}}, 0},
+		{"reset to 0", []reading{{500, 10, 500}, {0, 11, 500}, {40, 12, 540}}, 500},
+		{"two resets", []reading{{500, 10, 500}, {10, 11, 510}, {20, 12, 520}, {5, 13, 525}}, 520},
+		{"wraparound", []reading{{math.MaxUint32 - 9, 10, math.MaxUint32 - 9}, {20, 11, math.MaxUint32 + 21}}, math.MaxUint32 + 1},
+		// older readings do not move the counter
+		{"out of order", []reading{{500, 10, 500}, {600, 12, 600}, {550, 11, 550}, {610, 13, 610}}, 0},
+		{"out of order after a reset", []reading{{500, 10, 500}, {20, 12, 520}, {600, 11, 520}}, 500},
+	}
+	for _, test := range tests {
+		counters := make(EnergyCounters)
+		for i, r := range test.readings {
+			m := Measure{Id: "AABBCC001122", Energy: r.energy, Timestamp: r.timestamp}
+			counters.advance(&m)
+			if m.Cumulative != r.cumulative {
+				t.Errorf("%s: cumulative energy of reading %d is %d, want %d", test.name, i, m.Cumulative, r.cumulative)
+			}
+		}
+		if offset := counters["AABBCC001122"].Offset; offset != test.offset {
+			t.Errorf("%s: offset is %d, want %d", test.name, offset, test.offset)
+		}
+	}
+}
+
+// The counter of a plug restarts from its saved state.
+func TestEnergyCounterSaved(t *testing.T) {
+	measures := []Measure{
+		{Id: "A", Energy: 500, Timestamp: 10},
+		{Id: "A", Energy: 10, Timestamp: 11},
+		{Id: "B", Energy: 70, Timestamp: 11},
+	}
+	counters := make(EnergyCounters)
+	for i := range measures {
+		counters.advance(&measures[i])
+	}
+	restored := make(EnergyCounters)
+	for _, c := range counters_of(measures) {
+		c := c
+		restored[c.Id] = &c
+	}
+	m := Measure{Id: "A", Energy: 30, Timestamp: 12}
+	restored.advance(&m)
+	if m.Cumulative != 530 {
+		t.Errorf("cumulative energy after a restart is %d, want 530", m.Cumulative)
+	}
+}
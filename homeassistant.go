@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Home Assistant MQTT discovery: a sensor config is published, retained,
+// under `<discovery_prefix>/sensor/<node_id>/<object_id>/config` for the
+// power and energy of every described plug. Publishing an empty config
+// removes the sensor from Home Assistant.
+// See https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+
+type haDevice struct {
+	Identifiers      []string   `json:"identifiers"`
+	Connections      [][]string `json:"connections,omitempty"`
+	Name             string     `json:"name"`
+	Model            string     `json:"model,omitempty"`
+	Manufacturer     string     `json:"manufacturer"`
+	ConfigurationUrl string     `json:"configuration_url,omitempty"`
+}
+
+type haAvailability struct {
+	Topic string `json:"topic"`
+}
+
+type haSensorConfig struct {
+	Name              string           `json:"name"`
+	UniqueId          string           `json:"unique_id"`
+	ObjectId          string           `json:"object_id"`
+	StateTopic        string           `json:"state_topic"`
+	UnitOfMeasurement string           `json:"unit_of_measurement"`
+	DeviceClass       string           `json:"device_class"`
+	StateClass        string           `json:"state_class"`
+	Availability      []haAvailability `json:"availability"`
+	AvailabilityMode  string           `json:"availability_mode"`
+	Device            haDevice         `json:"device"`
+}
+
+// Sensors published for each plug, by object id
+var ha_sensors = []string{"power", "energy"}
+
+func ha_node_id(mac string) string {
+	return "plugmeter_" + strings.ToLower(mac)
+}
+
+func (p *MqttPublisher) ha_config_topic(mac string, object_id string) string {
+	return fmt.Sprintf("%s/sensor/%s/%s/config", p.ha_prefix, ha_node_id(mac), object_id)
+}
+
+// Format a mac address as expected by Home Assistant connections,
+// "AABBCC001122" -> "aa:bb:cc:00:11:22"
+func ha_mac_connection(mac string) string {
+	mac = strings.ToLower(mac)
+	if len(mac) != 12 {
+		return mac
+	}
+	parts := make([]string, 0, 6)
+	for i := 0; i < 12; i += 2 {
+		parts = append(parts, mac[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+func ha_manufacturer(plug_desc PlugDescription) string {
+	switch plug_desc.Driver {
+	case "tasmota":
+		return "Tasmota"
+	}
+	return "Shelly"
+}
+
+func (p *MqttPublisher) ha_sensor_config(plug_desc PlugDescription, object_id string) haSensorConfig {
+	name := plug_desc.Name
+	if name == "" {
+		name = plug_desc.Hostname
+	}
+	device := haDevice{
+		Identifiers:  []string{ha_node_id(plug_desc.Mac)},
+		Connections:  [][]string{{"mac", ha_mac_connection(plug_desc.Mac)}},
+		Name:         name,
+		Model:        plug_desc.Type,
+		Manufacturer: ha_manufacturer(plug_desc),
+	}
+	if plug_desc.AddrV4 != "" {
+		device.ConfigurationUrl = "http://" + plug_desc.AddrV4 + "/"
+	}
+
+	config := haSensorConfig{
+		UniqueId:   ha_node_id(plug_desc.Mac) + "_" + object_id,
+		ObjectId:   ha_node_id(plug_desc.Mac) + "_" + object_id,
+		StateTopic: p.plug_topic(plug_desc.Mac, object_id),
+		// the plug and PlugMeter itself must both be online
+		Availability: []haAvailability{
+			{Topic: p.plug_topic(plug_desc.Mac, "availability")},
+			{Topic: p.status_topic()},
+		},
+		AvailabilityMode: "all",
+		Device:           device,
+	}
+	switch object_id {
+	case "power":
+		config.Name = "Power"
+		config.UnitOfMeasurement = "W"
+		config.DeviceClass = "power"
+		config.StateClass = "measurement"
+	case "energy":
+		// the raw energy topic is reset with the plug
+		config.Name = "Energy"
+		config.StateTopic = p.plug_topic(plug_desc.Mac, "total_energy")
+		config.UnitOfMeasurement = "kWh"
+		config.DeviceClass = "energy"
+		config.StateClass = "total_increasing"
+	}
+	return config
+}
+
+// Publish the discovery configs of a plug.
+func (p *MqttPublisher) publish_ha_discovery(plug_desc PlugDescription) {
+	for _, object_id := range ha_sensors {
+		encoded, err := json.Marshal(p.ha_sensor_config(plug_desc, object_id))
+		if err != nil {
+			log.Error("Error marshalling Home Assistant config ", err)
+			continue
+		}
+		p.publish_retained(p.ha_config_topic(plug_desc.Mac, object_id), encoded)
+	}
+}
+
+// Remove the discovery configs of a plug.
+func (p *MqttPublisher) remove_ha_discovery(mac string) {
+	for _, object_id := range ha_sensors {
+		p.publish_retained(p.ha_config_topic(mac, object_id), "")
+	}
+}
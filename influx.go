@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	viper "github.com/spf13/viper"
+)
+
+// A MeasureSink receives every batch of measurements written by
+// `store_measurements`, in addition to the Store.
+type MeasureSink interface {
+	Push(measures []Measure)
+	// Flush pending data and release resources
+	Close() error
+}
+
+// InfluxSink writes measurements to an InfluxDB v2 write endpoint using
+// the line protocol.
+// Lines that cannot be written while the server is unreachable are
+// appended to a spool file on disk and sent again, in batches, every
+// `retry_interval`.
+type InfluxSink struct {
+	write_url      string
+	token          string
+	measurement    string
+	batch_size     int
+	retry_interval time.Duration
+	spool_file     string
+	// The spool file is written by the sink goroutine, and by Push when
+	// the queue is full
+	spool_lock sync.Mutex
+	client     *http.Client
+
+	batches chan []string
+	quit    chan bool
+	done    chan bool
+}
+
+// Error returned by the server for data it will never accept,
+// retrying it is pointless.
+type influxRejectedError struct {
+	status int
+	body   string
+}
+
+func (e influxRejectedError) Error() string {
+	return fmt.Sprintf("influx rejected write: %d %s", e.status, e.body)
+}
+
+func new_influx_sink() *InfluxSink {
+	params := url.Values{}
+	params.Set("org", viper.GetString("data.influx.org"))
+	params.Set("bucket", viper.GetString("data.influx.bucket"))
+	params.Set("precision", "s")
+
+	s := &InfluxSink{
+		write_url:      strings.TrimRight(viper.GetString("data.influx.url"), "/") + "/api/v2/write?" + params.Encode(),
+		token:          viper.GetString("data.influx.token"),
+		measurement:    viper.GetString("data.influx.measurement"),
+		batch_size:     viper.GetInt("data.influx.batch_size"),
+		retry_interval: time.Duration(viper.GetInt("data.influx.retry_interval")) * time.Second,
+		spool_file:     viper.GetString("data.influx.spool_file"),
+		client:         &http.Client{Timeout: time.Duration(viper.GetInt("data.influx.timeout")) * time.Second},
+		batches:        make(chan []string, 100),
+		quit:           make(chan bool),
+		done:           make(chan bool),
+	}
+	if s.batch_size < 1 {
+		s.batch_size = 1
+	}
+	if s.retry_interval <= 0 {
+		s.retry_interval = 30 * time.Second
+	}
+	go s.run()
+	return s
+}
+
+func (s *InfluxSink) Push(measures []Measure) {
+	lines := make([]string, 0, len(measures))
+	for _, m := range measures {
+		lines = append(lines, s.line(m))
+	}
+	select {
+	case s.batches <- lines:
+	default:
+		// never block the storage of measurements
+		log.Warn("Influx queue full, spooling measurements")
+		s.spool(lines)
+	}
+}
+
+func (s *InfluxSink) Close() error {
+	close(s.quit)
+	<-s.done
+	return nil
+}
+
+// Line protocol representation of a measurement.
+func (s *InfluxSink) line(m Measure) string {
+	return fmt.Sprintf("%s,mac=%s,plug=%s power=%s,energy=%di,total_energy=%s %d",
+		influx_escape(s.measurement), influx_escape(m.Id), influx_escape(m.Plug),
+		strconv.FormatFloat(m.Power, 'f', -1, 64), m.Energy,
+		strconv.FormatFloat(energy_kwh(m.Cumulative), 'f', -1, 64), m.Timestamp)
+}
+
+// Escape commas, spaces and equal signs in measurement, tag keys and values.
+func influx_escape(s string) string {
+	return strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`).Replace(s)
+}
+
+func (s *InfluxSink) run() {
+	ticker := time.NewTicker(s.retry_interval)
+	defer ticker.Stop()
+
+	// Try to send what is left from a previous run
+	s.drain_spool()
+	for {
+		select {
+		case lines := <-s.batches:
+			s.send(lines)
+		case <-ticker.C:
+			s.drain_spool()
+		case <-s.quit:
+			for len(s.batches) > 0 {
+				s.send(<-s.batches)
+			}
+			s.done <- true
+			return
+		}
+	}
+}
+
+// Send lines, or spool them if the server cannot be reached.
+// Lines are always spooled when the spool is not empty, to keep points
+// in order.
+func (s *InfluxSink) send(lines []string) {
+	if s.has_spool() {
+		s.spool(lines)
+		return
+	}
+	err := s.write(lines)
+	if _, rejected := err.(influxRejectedError); rejected {
+		log.Error("Dropping ", len(lines), " influx points: ", err)
+	} else if err != nil {
+		log.Warn("Could not write to influx, spooling: ", err)
+		s.spool(lines)
+	}
+}
+
+func (s *InfluxSink) write(lines []string) error {
+	req, err := http.NewRequest(http.MethodPost, s.write_url, strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return influxRejectedError{resp.StatusCode, string(body)}
+	}
+	return fmt.Errorf("influx write failed: %d %s", resp.StatusCode, body)
+}
+
+func (s *InfluxSink) has_spool() bool {
+	s.spool_lock.Lock()
+	defer s.spool_lock.Unlock()
+	fi, err := os.Stat(s.spool_file)
+	return err == nil && fi.Size() > 0
+}
+
+func (s *InfluxSink) spool(lines []string) {
+	s.spool_lock.Lock()
+	defer s.spool_lock.Unlock()
+	f, err := os.OpenFile(s.spool_file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Errorf("Could not open influx spool file '%s', dropping %d points: %s", s.spool_file, len(lines), err)
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, l := range lines {
+		w.WriteString(l)
+		w.WriteString("\n")
+	}
+	if err := w.Flush(); err != nil {
+		log.Errorf("Could not write influx spool file '%s': %s", s.spool_file, err)
+	}
+}
+
+// Send the spooled lines in batches of `batch_size`, stopping at the
+// first failure. Lines not sent are kept in the spool file.
+func (s *InfluxSink) drain_spool() {
+	s.spool_lock.Lock()
+	content, err := ioutil.ReadFile(s.spool_file)
+	s.spool_lock.Unlock()
+	if err != nil || len(content) == 0 {
+		return
+	}
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	sent := 0
+	for sent < len(lines) {
+		end := sent + s.batch_size
+		if end > len(lines) {
+			end = len(lines)
+		}
+		err := s.write(lines[sent:end])
+		if _, rejected := err.(influxRejectedError); rejected {
+			log.Error("Dropping ", end-sent, " spooled influx points: ", err)
+		} else if err != nil {
+			log.Debug("Influx still unreachable: ", err)
+			break
+		}
+		sent = end
+	}
+	if sent == 0 {
+		return
+	}
+	log.Infof("Sent %d spooled points to influx, %d left", sent, len(lines)-sent)
+
+	s.spool_lock.Lock()
+	defer s.spool_lock.Unlock()
+	var remaining bytes.Buffer
+	for _, l := range lines[sent:] {
+		remaining.WriteString(l)
+		remaining.WriteString("\n")
+	}
+	// keep lines spooled while sending
+	if current, err := ioutil.ReadFile(s.spool_file); err == nil && len(current) > len(content) {
+		remaining.Write(current[len(content):])
+	}
+	tmp := s.spool_file + ".tmp"
+	if err := ioutil.WriteFile(tmp, remaining.Bytes(), 0644); err != nil {
+		log.Errorf("Could not rewrite influx spool file '%s': %s", s.spool_file, err)
+		return
+	}
+	if err := os.Rename(tmp, s.spool_file); err != nil {
+		log.Errorf("Could not rewrite influx spool file '%s': %s", s.spool_file, err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Fake InfluxDB write endpoint answering `status`, which records the
+// bodies it receives.
+type fakeInflux struct {
+	mutex  sync.Mutex
+	status int
+	writes []string
+}
+
+func (f *fakeInflux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.status == http.StatusNoContent {
+		f.writes = append(f.writes, string(body))
+	}
+	w.WriteHeader(f.status)
+}
+
+func (f *fakeInflux) set_status(status int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.status = status
+}
+
+// Sink writing to a fake server, without its goroutine.
+func test_influx_sink(t *testing.T, status int) (*InfluxSink, *fakeInflux) {
+	fake := &fakeInflux{status: status}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	s := &InfluxSink{
+		write_url:   server.URL + "/api/v2/write?bucket=plugmeter&org=home&precision=s",
+		measurement: "power",
+		batch_size:  2,
+		spool_file:  filepath.Join(t.TempDir(), "influx.spool"),
+		client:      &http.Client{Timeout: time.Second},
+	}
+	return s, fake
+}
+
+func read_spool(t *testing.T, s *InfluxSink) string {
+	content, err := os.ReadFile(s.spool_file)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestInfluxLine(t *testing.T) {
+	s := &InfluxSink{measurement: "plug power"}
+	m := Measure{
+		Id:         "AABBCC001122",
+		Plug:       "Living room,TV=1",
+		Power:      42.5,
+		Energy:     1234,
+		Cumulative: 120000,
+		Timestamp:  1700000000,
+	}
+	expected := `plug\ power,mac=AABBCC001122,plug=Living\ room\,TV\=1 power=42.5,energy=1234i,total_energy=2 1700000000`
+	if line := s.line(m); line != expected {
+		t.Errorf("line:\n got %s\nwant %s", line, expected)
+	}
+}
+
+func TestInfluxEscape(t *testing.T) {
+	tests := map[string]string{
+		"plain":   "plain",
+		"a b":     `a\ b`,
+		"a,b":     `a\,b`,
+		"a=b":     `a\=b`,
+		" ,=":     `\ \,\=`,
+		"Küche 1": `Küche\ 1`,
+		"":        "",
+	}
+	for s, expected := range tests {
+		if escaped := influx_escape(s); escaped != expected {
+			t.Errorf("influx_escape(%q) = %q, want %q", s, escaped, expected)
+		}
+	}
+}
+
+func TestInfluxSendSpoolsOnServerError(t *testing.T) {
+	s, fake := test_influx_sink(t, http.StatusServiceUnavailable)
+	s.send([]string{"a 1", "b 2"})
+	if spool := read_spool(t, s); spool != "a 1\nb 2\n" {
+		t.Errorf("spool after a 503: %q", spool)
+	}
+
+	// lines are spooled behind the others while the spool is not empty
+	fake.set_status(http.StatusNoContent)
+	s.send([]string{"c 3"})
+	if spool := read_spool(t, s); spool != "a 1\nb 2\nc 3\n" {
+		t.Errorf("spool after a second batch: %q", spool)
+	}
+	if len(fake.writes) != 0 {
+		t.Errorf("lines written while the spool is not empty: %q", fake.writes)
+	}
+}
+
+func TestInfluxSendDropsRejectedLines(t *testing.T) {
+	s, _ := test_influx_sink(t, http.StatusBadRequest)
+	s.send([]string{"bad line"})
+	if spool := read_spool(t, s); spool != "" {
+		t.Errorf("lines rejected with a 400 were spooled: %q", spool)
+	}
+}
+
+func TestInfluxDrainSpool(t *testing.T) {
+	s, fake := test_influx_sink(t, http.StatusServiceUnavailable)
+	s.spool([]string{"a 1", "b 2", "c 3", "d 4", "e 5"})
+
+	// nothing is lost while the server fails
+	s.drain_spool()
+	if spool := read_spool(t, s); spool != "a 1\nb 2\nc 3\nd 4\ne 5\n" {
+		t.Errorf("spool after a failed drain: %q", spool)
+	}
+
+	fake.set_status(http.StatusNoContent)
+	s.drain_spool()
+	expected := []string{"a 1\nb 2", "c 3\nd 4", "e 5"}
+	if strings.Join(fake.writes, "|") != strings.Join(expected, "|") {
+		t.Errorf("writes: %q, want %q", fake.writes, expected)
+	}
+	if spool := read_spool(t, s); spool != "" {
+		t.Errorf("spool after a drain: %q", spool)
+	}
+	if s.has_spool() {
+		t.Error("has_spool after a drain")
+	}
+}
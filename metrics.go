@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics are built from the latest state of each plug,
+// kept in memory, rather than from the database.
+
+var plug_labels = []string{"mac", "hostname", "name"}
+
+var (
+	power_desc = prometheus.NewDesc("plugmeter_power_watts",
+		"Current power drawn by the plug, in watts.", plug_labels, nil)
+	energy_desc = prometheus.NewDesc("plugmeter_energy_watt_hours_total",
+		"Energy consumed by the plug, in watt-hours, corrected for counter resets.", plug_labels, nil)
+	available_desc = prometheus.NewDesc("plugmeter_plug_available",
+		"Whether the plug can currently be reached (1) or not (0).", plug_labels, nil)
+	last_seen_desc = prometheus.NewDesc("plugmeter_plug_last_seen_timestamp_seconds",
+		"Unix time of the last successful reading from the plug.", plug_labels, nil)
+	poll_errors_desc = prometheus.NewDesc("plugmeter_poll_errors_total",
+		"Number of failed polls of the plug.", plug_labels, nil)
+	poll_latency_desc = prometheus.NewDesc("plugmeter_poll_latency_seconds",
+		"Duration of the last poll of the plug.", plug_labels, nil)
+	voltage_desc = prometheus.NewDesc("plugmeter_voltage_volts",
+		"Voltage measured by the plug, Gen2 plugs only.", plug_labels, nil)
+	current_desc = prometheus.NewDesc("plugmeter_current_amperes",
+		"Current drawn through the plug, Gen2 plugs only.", plug_labels, nil)
+	temperature_desc = prometheus.NewDesc("plugmeter_temperature_celsius",
+		"Internal temperature of the plug, Gen2 plugs only.", plug_labels, nil)
+)
+
+type plugState struct {
+	Mac          string
+	Hostname     string
+	Name         string
+	Power        float64
+	Energy       float64
+	Voltage      float64
+	Current      float64
+	Temperature  float64
+	Has_reading  bool
+	Is_available bool
+	LastSeen     time.Time
+	PollErrors   uint64
+	PollLatency  time.Duration
+}
+
+// PlugCollector is a prometheus.Collector exporting the state of every
+// plug seen since startup.
+type PlugCollector struct {
+	lock  sync.Mutex
+	plugs map[string]*plugState
+}
+
+var plug_metrics = &PlugCollector{plugs: make(map[string]*plugState)}
+
+// Get the state of a plug, creating it if needed. Must be called with
+// the lock held.
+func (c *PlugCollector) plug(mac string) *plugState {
+	p, ok := c.plugs[mac]
+	if !ok {
+		p = &plugState{Mac: mac}
+		c.plugs[mac] = p
+	}
+	return p
+}
+
+// Update the labels of a plug from its description.
+func (c *PlugCollector) PlugDescribed(plug_desc PlugDescription) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	p := c.plug(plug_desc.Mac)
+	p.Hostname = plug_desc.Hostname
+	p.Name = plug_desc.Name
+	p.Is_available = plug_desc.Is_available
+}
+
+func (c *PlugCollector) observe_measure(m Measure) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	p := c.plug(m.Id)
+	p.Power = m.Power
+	p.Energy = float64(m.Cumulative) / 60
+	p.Voltage = m.Voltage
+	p.Current = m.Current
+	p.Temperature = m.Temperature
+	p.Has_reading = true
+	p.Is_available = true
+	p.LastSeen = time.Unix(int64(m.Timestamp), 0)
+}
+
+func (c *PlugCollector) observe_poll(mac string, latency time.Duration, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	p := c.plug(mac)
+	p.PollLatency = latency
+	if err != nil {
+		p.PollErrors++
+	}
+}
+
+func (c *PlugCollector) PlugAvailability(mac string, is_available bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.plug(mac).Is_available = is_available
+}
+
+// Stop exporting a forgotten plug.
+func (c *PlugCollector) PlugForgotten(mac string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.plugs, mac)
+}
+
+func (c *PlugCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- power_desc
+	ch <- energy_desc
+	ch <- available_desc
+	ch <- last_seen_desc
+	ch <- poll_errors_desc
+	ch <- poll_latency_desc
+	ch <- voltage_desc
+	ch <- current_desc
+	ch <- temperature_desc
+}
+
+func (c *PlugCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, p := range c.plugs {
+		labels := []string{p.Mac, p.Hostname, p.Name}
+		available := 0.0
+		if p.Is_available {
+			available = 1
+		}
+		ch <- prometheus.MustNewConstMetric(available_desc, prometheus.GaugeValue, available, labels...)
+		ch <- prometheus.MustNewConstMetric(poll_errors_desc, prometheus.CounterValue, float64(p.PollErrors), labels...)
+		ch <- prometheus.MustNewConstMetric(poll_latency_desc, prometheus.GaugeValue, p.PollLatency.Seconds(), labels...)
+		if p.Has_reading {
+			ch <- prometheus.MustNewConstMetric(power_desc, prometheus.GaugeValue, p.Power, labels...)
+			ch <- prometheus.MustNewConstMetric(energy_desc, prometheus.CounterValue, p.Energy, labels...)
+			ch <- prometheus.MustNewConstMetric(last_seen_desc, prometheus.GaugeValue, float64(p.LastSeen.Unix()), labels...)
+		}
+		// not reported by Gen1 plugs
+		if p.Voltage != 0 {
+			ch <- prometheus.MustNewConstMetric(voltage_desc, prometheus.GaugeValue, p.Voltage, labels...)
+			ch <- prometheus.MustNewConstMetric(current_desc, prometheus.GaugeValue, p.Current, labels...)
+		}
+		if p.Temperature != 0 {
+			ch <- prometheus.MustNewConstMetric(temperature_desc, prometheus.GaugeValue, p.Temperature, labels...)
+		}
+	}
+}
+
+// Handler for the `/metrics` endpoint.
+func metrics_handler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		plug_metrics,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
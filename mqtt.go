@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	viper "github.com/spf13/viper"
+)
+
+// MqttPublisher publishes measurements and plug availability to an MQTT
+// broker, under `<prefix>/<mac>/...` topics:
+//   - power: current power, in W
+//   - energy: raw energy counter of the plug, in Wmin
+//   - total_energy: energy corrected for counter resets, in kWh
+//   - measure: the full measurement, as json
+//   - availability: "online" or "offline"
+//
+// PlugMeter's own state is published on `<prefix>/status`, with a last
+// will setting it to "offline" if the connection is lost.
+//
+// With `mqtt.homeassistant.enabled`, Home Assistant discovery configs are
+// also published for every described plug.
+type MqttPublisher struct {
+	client    mqtt.Client
+	prefix    string
+	qos       byte
+	retain    bool
+	ha        bool
+	ha_prefix string
+
+	mutex sync.Mutex
+	// plugs forgotten since they were last described, by MAC
+	forgotten map[string]bool
+}
+
+const (
+	MQTT_ONLINE  = "online"
+	MQTT_OFFLINE = "offline"
+)
+
+func new_mqtt_publisher() (*MqttPublisher, error) {
+	p := &MqttPublisher{
+		prefix:    viper.GetString("mqtt.topic_prefix"),
+		qos:       byte(viper.GetInt("mqtt.qos")),
+		retain:    viper.GetBool("mqtt.retain"),
+		ha:        viper.GetBool("mqtt.homeassistant.enabled"),
+		ha_prefix: viper.GetString("mqtt.homeassistant.discovery_prefix"),
+		forgotten: make(map[string]bool),
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(viper.GetString("mqtt.broker"))
+	opts.SetClientID(viper.GetString("mqtt.client_id"))
+	opts.SetUsername(viper.GetString("mqtt.username"))
+	opts.SetPassword(viper.GetString("mqtt.password"))
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetWill(p.status_topic(), MQTT_OFFLINE, p.qos, true)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.Info("Connected to MQTT broker ", viper.GetString("mqtt.broker"))
+		c.Publish(p.status_topic(), p.qos, true, MQTT_ONLINE)
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.Warn("Lost connection to MQTT broker: ", err)
+	})
+
+	tls_config, err := mqtt_tls_config()
+	if err != nil {
+		return nil, err
+	}
+	if tls_config != nil {
+		opts.SetTLSConfig(tls_config)
+	}
+
+	p.client = mqtt.NewClient(opts)
+	// With connect retry, this only fails on invalid options, the
+	// connection is established in the background.
+	token := p.client.Connect()
+	if token.WaitTimeout(5*time.Second) && token.Error() != nil {
+		return nil, fmt.Errorf("connecting to MQTT broker: %s", token.Error())
+	}
+	return p, nil
+}
+
+// TLS configuration from the `mqtt.ca_file`, `mqtt.cert_file` and
+// `mqtt.key_file` settings, nil if none is set.
+func mqtt_tls_config() (*tls.Config, error) {
+	ca_file := viper.GetString("mqtt.ca_file")
+	cert_file := viper.GetString("mqtt.cert_file")
+	key_file := viper.GetString("mqtt.key_file")
+	insecure := viper.GetBool("mqtt.insecure")
+	if ca_file == "" && cert_file == "" && !insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if ca_file != "" {
+		ca, err := ioutil.ReadFile(ca_file)
+		if err != nil {
+			return nil, fmt.Errorf("reading MQTT CA file: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in MQTT CA file %s", ca_file)
+		}
+	}
+	if cert_file != "" {
+		cert, err := tls.LoadX509KeyPair(cert_file, key_file)
+		if err != nil {
+			return nil, fmt.Errorf("loading MQTT client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func (p *MqttPublisher) status_topic() string {
+	return p.prefix + "/status"
+}
+
+func (p *MqttPublisher) plug_topic(mac string, topic string) string {
+	return fmt.Sprintf("%s/%s/%s", p.prefix, mac, topic)
+}
+
+// Publish without waiting for the broker acknowledgement, messages are
+// queued by the client while disconnected.
+func (p *MqttPublisher) publish(topic string, payload interface{}) {
+	p.publish_with(topic, p.retain, payload)
+}
+
+// Publish a message that must be retained, whatever `mqtt.retain`.
+func (p *MqttPublisher) publish_retained(topic string, payload interface{}) {
+	p.publish_with(topic, true, payload)
+}
+
+func (p *MqttPublisher) publish_with(topic string, retain bool, payload interface{}) {
+	token := p.client.Publish(topic, p.qos, retain, payload)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			log.Warn("Could not publish to MQTT topic ", topic, ": ", token.Error())
+		}
+	}()
+}
+
+func (p *MqttPublisher) Push(measures []Measure) {
+	for _, m := range measures {
+		if p.is_forgotten(m.Id) {
+			// measured before the plug was forgotten, its topics are cleared
+			continue
+		}
+		p.publish(p.plug_topic(m.Id, "power"), strconv.FormatFloat(m.Power, 'f', -1, 64))
+		p.publish(p.plug_topic(m.Id, "energy"), strconv.FormatUint(uint64(m.Energy), 10))
+		p.publish(p.plug_topic(m.Id, "total_energy"), strconv.FormatFloat(energy_kwh(m.Cumulative), 'f', -1, 64))
+		encoded, err := json.Marshal(m)
+		if err != nil {
+			log.Error("Error marshalling measure ", err)
+			continue
+		}
+		p.publish(p.plug_topic(m.Id, "measure"), encoded)
+	}
+}
+
+func (p *MqttPublisher) is_forgotten(plugId string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.forgotten[plugId]
+}
+
+func (p *MqttPublisher) PlugDescribed(plug_desc PlugDescription) {
+	p.mutex.Lock()
+	delete(p.forgotten, plug_desc.Mac)
+	p.mutex.Unlock()
+	if p.ha {
+		p.publish_ha_discovery(plug_desc)
+	}
+	p.PlugAvailability(plug_desc.Mac, plug_desc.Is_available)
+}
+
+func (p *MqttPublisher) PlugAvailability(plugId string, is_available bool) {
+	state := MQTT_OFFLINE
+	if is_available {
+		state = MQTT_ONLINE
+	}
+	p.publish(p.plug_topic(plugId, "availability"), state)
+}
+
+// Remove the retained messages of a forgotten plug.
+func (p *MqttPublisher) PlugForgotten(plugId string) {
+	p.mutex.Lock()
+	p.forgotten[plugId] = true
+	p.mutex.Unlock()
+	if p.ha {
+		p.remove_ha_discovery(plugId)
+	}
+	for _, topic := range []string{"power", "energy", "total_energy", "measure", "availability"} {
+		p.publish_retained(p.plug_topic(plugId, topic), "")
+	}
+}
+
+// Set PlugMeter offline, the last will is not sent on a clean disconnect.
+func (p *MqttPublisher) Close() error {
+	p.client.Publish(p.status_topic(), p.qos, true, MQTT_OFFLINE).WaitTimeout(2 * time.Second)
+	p.client.Disconnect(500)
+	return nil
+}
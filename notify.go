@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Notifiers send the alerts when they fire and when they are resolved,
+// to webhooks and by email.
+
+const (
+	DEFAULT_EMAIL_SUBJECT = "[PlugMeter] {{.Status}}: {{.Message}}"
+)
+
+type Notifier interface {
+	Notify(alert Alert) error
+	String() string
+}
+
+// Webhooks and email of the configuration.
+func load_notifiers() ([]Notifier, error) {
+	notifiers := make([]Notifier, 0)
+	var webhooks []WebhookConfig
+	if err := viper.UnmarshalKey("alerts.webhooks", &webhooks); err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(viper.GetInt("alerts.webhook_timeout")) * time.Second
+	for _, config := range webhooks {
+		n, err := new_webhook_notifier(config, timeout)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	if viper.GetBool("alerts.email.enabled") {
+		n, err := new_email_notifier()
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
+
+// Template functions: `json` encodes a value as JSON, to insert strings
+// in JSON bodies.
+var notify_template_funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		encoded, err := json.Marshal(v)
+		return string(encoded), err
+	},
+}
+
+type WebhookConfig struct {
+	Url string
+	// POST by default
+	Method  string
+	Headers map[string]string
+	// Template of the JSON body, executed with the Alert, the Alert
+	// encoded as JSON when empty
+	Body string
+}
+
+type WebhookNotifier struct {
+	url     string
+	method  string
+	headers map[string]string
+	body    *template.Template
+	client  *http.Client
+}
+
+func new_webhook_notifier(config WebhookConfig, timeout time.Duration) (*WebhookNotifier, error) {
+	if config.Url == "" {
+		return nil, errors.New("webhooks need a url")
+	}
+	n := &WebhookNotifier{
+		url:     config.Url,
+		method:  strings.ToUpper(config.Method),
+		headers: config.Headers,
+		client:  &http.Client{Timeout: timeout},
+	}
+	if n.method == "" {
+		n.method = http.MethodPost
+	}
+	if config.Body != "" {
+		body, err := template.New("body").Funcs(notify_template_funcs).Parse(config.Body)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: invalid body template: %s", config.Url, err)
+		}
+		n.body = body
+	}
+	return n, nil
+}
+
+func (n *WebhookNotifier) String() string {
+	return "webhook " + n.url
+}
+
+func (n *WebhookNotifier) Notify(alert Alert) error {
+	var body []byte
+	if n.body == nil {
+		var err error
+		if body, err = json.Marshal(alert); err != nil {
+			return err
+		}
+	} else {
+		var buf bytes.Buffer
+		if err := n.body.Execute(&buf, alert); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+		if !json.Valid(body) {
+			return fmt.Errorf("body is not valid JSON: %s", body)
+		}
+	}
+
+	req, err := http.NewRequest(n.method, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range n.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+type EmailNotifier struct {
+	address  string
+	username string
+	password string
+	from     string
+	to       []string
+	subject  *template.Template
+}
+
+func new_email_notifier() (*EmailNotifier, error) {
+	n := &EmailNotifier{
+		address:  net.JoinHostPort(viper.GetString("alerts.email.host"), strconv.Itoa(viper.GetInt("alerts.email.port"))),
+		username: viper.GetString("alerts.email.username"),
+		password: viper.GetString("alerts.email.password"),
+		from:     viper.GetString("alerts.email.from"),
+		to:       viper.GetStringSlice("alerts.email.to"),
+	}
+	if viper.GetString("alerts.email.host") == "" || n.from == "" || len(n.to) == 0 {
+		return nil, errors.New("alert emails need a host, a sender and recipients")
+	}
+	subject := viper.GetString("alerts.email.subject")
+	if subject == "" {
+		subject = DEFAULT_EMAIL_SUBJECT
+	}
+	var err error
+	if n.subject, err = template.New("subject").Funcs(notify_template_funcs).Parse(subject); err != nil {
+		return nil, fmt.Errorf("invalid email subject template: %s", err)
+	}
+	return n, nil
+}
+
+func (n *EmailNotifier) String() string {
+	return "email to " + strings.Join(n.to, ", ")
+}
+
+// Subject header value: line breaks would end the header, they are
+// replaced by spaces, and non-ASCII subjects are encoded (RFC 2047).
+func email_subject(subject string) string {
+	subject = strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, subject)
+	return mime.QEncoding.Encode("utf-8", subject)
+}
+
+func (n *EmailNotifier) Notify(alert Alert) error {
+	var subject bytes.Buffer
+	if err := n.subject.Execute(&subject, alert); err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", email_subject(subject.String()))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\n", alert.Message)
+	fmt.Fprintf(&msg, "Alert: %s (%s)\r\n", alert.Name, alert.Kind)
+	fmt.Fprintf(&msg, "Status: %s\r\n", alert.Status)
+	fmt.Fprintf(&msg, "Since: %s\r\n", alert.Since.Format(time.RFC1123))
+	if alert.Resolved != nil {
+		fmt.Fprintf(&msg, "Resolved: %s\r\n", alert.Resolved.Format(time.RFC1123))
+	}
+
+	var auth smtp.Auth
+	if n.username != "" {
+		host, _, _ := net.SplitHostPort(n.address)
+		auth = smtp.PlainAuth("", n.username, n.password, host)
+	}
+	return smtp.SendMail(n.address, auth, n.from, n.to, msg.Bytes())
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"mime"
+	"testing"
+)
+
+func TestEmailSubject(t *testing.T) {
+	tests := []struct {
+		subject  string
+		expected string
+	}{
+		{"[PlugMeter] firing: fridge", "[PlugMeter] firing: fridge"},
+		{"firing\r\nBcc: someone@example.com", "firing  Bcc: someone@example.com"},
+		{"firing\rBcc: someone@example.com\n", "firing Bcc: someone@example.com "},
+		{"firing: réfrigérateur", "firing: réfrigérateur"},
+	}
+	for _, test := range tests {
+		subject := email_subject(test.subject)
+		for _, c := range subject {
+			if c == '\r' || c == '\n' || c > 127 {
+				t.Errorf("subject %q: header %q is not a single ASCII line", test.subject, subject)
+			}
+		}
+		var decoder mime.WordDecoder
+		if decoded, err := decoder.DecodeHeader(subject); err != nil || decoded != test.expected {
+			t.Errorf("subject %q: header %q decoded to %q, want %q (%v)", test.subject, subject, decoded, test.expected, err)
+		}
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -23,6 +26,70 @@ func main() {
 	configure_log()
 	print_configuration()
 
+	var err error
+	store, err = open_store()
+	if err != nil {
+		log.Fatal("Could not open storage: ", err)
+	}
+	defer store.Close()
+
+	if flag.Arg(0) == "migrate" {
+		dry_run, _ := flag.CommandLine.GetBool("dry-run")
+		if err := run_migrate(dry_run); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if _, err := store.Migrate(false); err != nil {
+		log.Fatal("Could not migrate storage: ", err)
+	}
+
+	tariffs, err = load_tariffs()
+	if err != nil {
+		log.Fatal("Invalid tariffs: ", err)
+	}
+	rollup_location = tariffs.Location()
+	if err := check_rollup_timezone(); err != nil {
+		log.Fatal("Could not rebuild rollups: ", err)
+	}
+	schedule_config, err = load_schedule_config()
+	if err != nil {
+		log.Fatal("Invalid scheduler configuration: ", err)
+	}
+	rule_engine, err = new_rule_engine(store, store, viper.GetBool("rules.dry_run"), viper.GetInt("rules.history_size"))
+	if err != nil {
+		log.Fatal("Invalid rules: ", err)
+	}
+	if flag.Arg(0) == "import-prices" {
+		if err := run_import_prices(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if tariffs.Spot.WatchDir != "" {
+		go continuous_price_import(tariffs.Spot.WatchDir, tariffs.Spot.WatchPeriod)
+	}
+
+	sinks := make([]MeasureSink, 0)
+	if viper.GetBool("data.influx.enabled") {
+		sinks = append(sinks, new_influx_sink())
+	}
+	if viper.GetBool("mqtt.enabled") {
+		publisher, err := new_mqtt_publisher()
+		if err != nil {
+			log.Fatal("Could not setup MQTT: ", err)
+		}
+		sinks = append(sinks, publisher)
+		plug_listeners = append(plug_listeners, publisher)
+	}
+	if viper.GetBool("alerts.enabled") {
+		alert_manager, err = new_alert_manager()
+		if err != nil {
+			log.Fatal("Invalid alerts: ", err)
+		}
+		plug_listeners = append(plug_listeners, alert_manager)
+	}
+
 	plug_events := make(chan PlugEvent)
 
 	if viper.GetBool("plugs.discovery") {
@@ -31,16 +98,32 @@ func main() {
 
 	measurements := make(chan Measure, 20)
 	go plug_monitor(plug_events, measurements)
+	go run_scheduler(schedule_config, store, store)
+
+	if viper.GetBool("plugs.coiot.enabled") {
+		coiot = new_coiot_listener(viper.GetInt("plugs.coiot.fallback_timeout"))
+		go coiot.listen(viper.GetString("plugs.coiot.address"), measurements)
+	}
+
+	if viper.GetBool("plugs.websocket.enabled") {
+		shelly_ws, err = new_shelly_ws_server(viper.GetString("plugs.websocket.token"),
+			viper.GetStringSlice("plugs.websocket.devices"), measurements)
+		if err != nil {
+			log.Fatal("Invalid WebSocket server settings: ", err)
+		}
+		go shelly_ws.listen(viper.GetString("plugs.websocket.address"), viper.GetInt("plugs.websocket.port"))
+	}
 
 	// manually inject PLUG_ARRIVAL events for plug with static conf
-	for index, ip := range viper.GetStringSlice("plugs.ips") {
-		log.Debug("Injecting static IP ", ip, index)
+	for index, static := range static_plugs() {
+		log.Debug("Injecting static IP ", static.Address, " with driver ", static.Driver)
 
 		plug := PlugEntry{
 			DetectionId: fmt.Sprintf("static_id_%d", index),
 			Id:          fmt.Sprintf("static_id_%d", index),
-			AddrV4:      net.ParseIP(ip),
+			AddrV4:      net.ParseIP(static.Address),
 			AddrV6:      nil,
+			Driver:      static.Driver,
 		}
 
 		plug_events <- PlugEvent{
@@ -49,14 +132,23 @@ func main() {
 		}
 	}
 
-	go store_measurements(measurements)
+	quit := make(chan bool)
+	stored := make(chan bool)
+	go store_measurements(measurements, sinks, viper.GetInt("data.batch_size"),
+		viper.GetInt("data.flush_interval"), quit, stored)
 
-	go start_webui(viper.GetInt("web_ui.port"))
+	go continuous_pruning(viper.GetInt("data.retention.prune_period"), viper.GetBool("data.retention.compact"))
 
-	// This will keep the goroutines running until
-	// the program is stopped
-	select {}
+	go start_webui(viper.GetInt("web_ui.port"))
 
+	// Keep the goroutines running until the program is stopped,
+	// then flush the measurements not stored yet.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	s := <-signals
+	log.Info("Received ", s, ", stopping")
+	close(quit)
+	<-stored
 }
 
 // Setup configuration mechanism and default values.
@@ -64,22 +156,101 @@ func main() {
 func init_configuration() {
 
 	viper.SetDefault("logs.level", "debug")
+	viper.SetDefault("web_ui.address", "127.0.0.1")
 	viper.SetDefault("web_ui.port", 3000)
 	viper.SetDefault("plugs.discovery", true)
 	viper.SetDefault("plugs.ips", []string{})
+	viper.SetDefault("plugs.static", []map[string]interface{}{})
 	viper.SetDefault("plugs.poll_period", 2)
 	viper.SetDefault("plugs.max_error", 2)
+	viper.SetDefault("plugs.coiot.enabled", false)
+	viper.SetDefault("plugs.coiot.address", "224.0.1.187:5683")
+	viper.SetDefault("plugs.coiot.fallback_timeout", 30)
+	viper.SetDefault("plugs.websocket.enabled", false)
+	viper.SetDefault("plugs.websocket.address", "0.0.0.0")
+	viper.SetDefault("plugs.websocket.port", 3001)
+	viper.SetDefault("plugs.websocket.devices", []string{})
+	viper.SetDefault("plugs.websocket.token", "")
 	viper.SetDefault("data.csv", true)
 	viper.SetDefault("data.csv_file", "plugmeter.csv")
-	viper.SetDefault("data.discovery", "plugmeter.db")
+	viper.SetDefault("data.backend", "bolt")
+	viper.SetDefault("data.db_file", "plugmeter.db")
+	viper.SetDefault("data.batch_size", 50)
+	viper.SetDefault("data.flush_interval", 5)
+	viper.SetDefault("data.influx.enabled", false)
+	viper.SetDefault("data.influx.url", "http://localhost:8086")
+	viper.SetDefault("data.influx.org", "")
+	viper.SetDefault("data.influx.bucket", "plugmeter")
+	viper.SetDefault("data.influx.token", "")
+	viper.SetDefault("data.influx.measurement", "plug")
+	viper.SetDefault("data.influx.batch_size", 500)
+	viper.SetDefault("data.influx.retry_interval", 30)
+	viper.SetDefault("data.influx.timeout", 10)
+	viper.SetDefault("data.influx.spool_file", "plugmeter_influx.spool")
+	viper.SetDefault("data.retention.raw_days", 0)
+	viper.SetDefault("mqtt.enabled", false)
+	viper.SetDefault("mqtt.broker", "tcp://localhost:1883")
+	viper.SetDefault("mqtt.client_id", "plugmeter")
+	viper.SetDefault("mqtt.username", "")
+	viper.SetDefault("mqtt.password", "")
+	viper.SetDefault("mqtt.topic_prefix", "plugmeter")
+	viper.SetDefault("mqtt.qos", 1)
+	viper.SetDefault("mqtt.retain", true)
+	viper.SetDefault("mqtt.ca_file", "")
+	viper.SetDefault("mqtt.cert_file", "")
+	viper.SetDefault("mqtt.key_file", "")
+	viper.SetDefault("mqtt.insecure", false)
+	viper.SetDefault("mqtt.homeassistant.enabled", false)
+	viper.SetDefault("mqtt.homeassistant.discovery_prefix", "homeassistant")
+	viper.SetDefault("tariffs.currency", "EUR")
+	viper.SetDefault("tariffs.timezone", "Local")
+	viper.SetDefault("tariffs.default_price", 0.0)
+	viper.SetDefault("tariffs.daily_charge", 0.0)
+	viper.SetDefault("tariffs.spot.enabled", false)
+	viper.SetDefault("tariffs.spot.unit", "kWh")
+	viper.SetDefault("tariffs.spot.markup", 0.0)
+	viper.SetDefault("tariffs.spot.watch_dir", "")
+	viper.SetDefault("tariffs.spot.watch_period", 60)
+	viper.SetDefault("scheduler.timezone", "Local")
+	viper.SetDefault("scheduler.latitude", 0.0)
+	viper.SetDefault("scheduler.longitude", 0.0)
+	viper.SetDefault("scheduler.missed_runs", MISSED_SKIP)
+	viper.SetDefault("scheduler.missed_max_delay", 60)
+	viper.SetDefault("rules.dry_run", false)
+	viper.SetDefault("rules.history_size", 200)
+	viper.SetDefault("rules.static", []map[string]interface{}{})
+	viper.SetDefault("alerts.enabled", false)
+	viper.SetDefault("alerts.offline.enabled", true)
+	viper.SetDefault("alerts.offline.delay", 60)
+	viper.SetDefault("alerts.power", []map[string]interface{}{})
+	viper.SetDefault("alerts.energy", []map[string]interface{}{})
+	viper.SetDefault("alerts.webhooks", []map[string]interface{}{})
+	viper.SetDefault("alerts.webhook_timeout", 10)
+	viper.SetDefault("alerts.email.enabled", false)
+	viper.SetDefault("alerts.email.host", "")
+	viper.SetDefault("alerts.email.port", 587)
+	viper.SetDefault("alerts.email.username", "")
+	viper.SetDefault("alerts.email.password", "")
+	viper.SetDefault("alerts.email.from", "")
+	viper.SetDefault("alerts.email.to", []string{})
+	viper.SetDefault("alerts.email.subject", DEFAULT_EMAIL_SUBJECT)
+	viper.SetDefault("data.retention.minute_days", 0)
+	viper.SetDefault("data.retention.hour_days", 0)
+	viper.SetDefault("data.retention.day_days", 0)
+	viper.SetDefault("data.retention.prune_period", 60)
+	viper.SetDefault("data.retention.compact", false)
 
 	// CLI flag configuration
 	var ui_port int
 	flag.IntVar(&ui_port, "port", 3000, "port fro Web UI (default: 3000)")
+	var ui_address string
+	flag.StringVar(&ui_address, "address", "127.0.0.1", "Address the Web UI listens on")
 	var plug_discovery bool
 	flag.BoolVar(&plug_discovery, "discovery", true, "use mDNS to discover plugs")
 	var plug_ips []string
-	flag.StringArrayVar(&plug_ips, "plug_ip", nil, "Plugs static IPs")
+	flag.StringSliceVar(&plug_ips, "plug_ip", nil, "Plugs static IPs, polled with the default driver")
+	var coiot_enabled bool
+	flag.BoolVar(&coiot_enabled, "coiot", false, "Listen for CoIoT status updates of Gen1 Shelly plugs")
 	var log_level string
 	flag.StringVar(&log_level, "log", "warning", "Log level")
 	var period int
@@ -92,6 +263,21 @@ func init_configuration() {
 	flag.StringVar(&out_csv_file, "csv_file", "plugmeter.csv", "Output csv file")
 	var out_db_file string
 	flag.StringVar(&out_db_file, "db_file", "plugmeter.db", "Output DB file")
+	var backend string
+	flag.StringVar(&backend, "backend", "bolt", "Storage backend, 'bolt' or 'sqlite'")
+	var batch_size int
+	flag.IntVar(&batch_size, "batch_size", 50, "Maximum number of measurements stored in a single write")
+	var flush_interval int
+	flag.IntVar(&flush_interval, "flush_interval", 5, "Maximum number of seconds measurements are buffered before being stored")
+	var retention_days int
+	flag.IntVar(&retention_days, "retention_days", 0, "Number of days raw measurements are kept for (0: forever)")
+	var prune_period int
+	flag.IntVar(&prune_period, "prune_period", 60, "Number of minutes between two prunings of old data")
+	var compact bool
+	flag.BoolVar(&compact, "compact", false, "Compact the database file after pruning")
+	var rules_dry_run bool
+	flag.BoolVar(&rules_dry_run, "rules_dry_run", false, "Log automation rules firings without switching relays")
+	flag.Bool("dry-run", false, "With the 'migrate' command, report the changes without writing them")
 	var conf_path string
 	flag.StringVar(&conf_path, "conf", "none", "configuration file path")
 
@@ -121,39 +307,135 @@ func init_configuration() {
 		log.Info("Config file found")
 	}
 
+	viper.BindPFlag("web_ui.address", flag.Lookup("address"))
 	viper.BindPFlag("web_ui.port", flag.Lookup("port"))
 	viper.BindPFlag("plugs.discovery", flag.Lookup("discovery"))
 	viper.BindPFlag("plugs.ips", flag.Lookup("plug_ip"))
 	viper.BindPFlag("plugs.poll_period", flag.Lookup("period"))
 	viper.BindPFlag("plugs.max_error", flag.Lookup("max_error"))
+	viper.BindPFlag("plugs.coiot.enabled", flag.Lookup("coiot"))
 	viper.BindPFlag("logs.level", flag.Lookup("log"))
 	viper.BindPFlag("data.csv", flag.Lookup("csv"))
 	viper.BindPFlag("data.csv_file", flag.Lookup("csv_file"))
 	viper.BindPFlag("data.db_file", flag.Lookup("db_file"))
+	viper.BindPFlag("data.backend", flag.Lookup("backend"))
+	viper.BindPFlag("data.batch_size", flag.Lookup("batch_size"))
+	viper.BindPFlag("data.flush_interval", flag.Lookup("flush_interval"))
+	viper.BindPFlag("data.retention.raw_days", flag.Lookup("retention_days"))
+	viper.BindPFlag("data.retention.prune_period", flag.Lookup("prune_period"))
+	viper.BindPFlag("data.retention.compact", flag.Lookup("compact"))
+	viper.BindPFlag("rules.dry_run", flag.Lookup("rules_dry_run"))
 
 	// configuration with ENV variables
 	viper.BindEnv("logs.level", "LOG_LEVEL")
+	viper.BindEnv("web_ui.address", "UI_ADDRESS")
 	viper.BindEnv("web_ui.port", "UI_PORT")
 	viper.BindEnv("plugs.discovery", "PLUG_DISCOVERY")
 	viper.BindEnv("plugs.ips", "PLUG_IPS")
 	viper.BindEnv("plugs.poll_period", "POLL_PERIOD")
 	viper.BindEnv("plugs.max_error", "MAX_ERROR")
+	viper.BindEnv("plugs.coiot.enabled", "COIOT_ENABLED")
+	viper.BindEnv("plugs.websocket.enabled", "WEBSOCKET_ENABLED")
+	viper.BindEnv("plugs.websocket.port", "WEBSOCKET_PORT")
+	viper.BindEnv("plugs.websocket.devices", "WEBSOCKET_DEVICES")
+	viper.BindEnv("plugs.websocket.token", "WEBSOCKET_TOKEN")
 	viper.BindEnv("data.csv", "CSV_OUT")
 	viper.BindEnv("data.csv_file", "CSV_FILE")
 	viper.BindEnv("data.db_file", "DB_FILE")
+	viper.BindEnv("data.backend", "DB_BACKEND")
+	viper.BindEnv("data.batch_size", "BATCH_SIZE")
+	viper.BindEnv("data.flush_interval", "FLUSH_INTERVAL")
+	viper.BindEnv("data.influx.enabled", "INFLUX_ENABLED")
+	viper.BindEnv("data.influx.url", "INFLUX_URL")
+	viper.BindEnv("data.influx.org", "INFLUX_ORG")
+	viper.BindEnv("data.influx.bucket", "INFLUX_BUCKET")
+	viper.BindEnv("data.influx.token", "INFLUX_TOKEN")
+	viper.BindEnv("data.retention.raw_days", "RETENTION_DAYS")
+	viper.BindEnv("mqtt.enabled", "MQTT_ENABLED")
+	viper.BindEnv("mqtt.broker", "MQTT_BROKER")
+	viper.BindEnv("mqtt.username", "MQTT_USERNAME")
+	viper.BindEnv("mqtt.password", "MQTT_PASSWORD")
+	viper.BindEnv("mqtt.homeassistant.enabled", "MQTT_HOMEASSISTANT")
+	viper.BindEnv("data.retention.prune_period", "PRUNE_PERIOD")
+	viper.BindEnv("data.retention.compact", "COMPACT")
+	viper.BindEnv("rules.dry_run", "RULES_DRY_RUN")
+	viper.BindEnv("alerts.enabled", "ALERTS_ENABLED")
+	viper.BindEnv("alerts.email.username", "ALERTS_EMAIL_USERNAME")
+	viper.BindEnv("alerts.email.password", "ALERTS_EMAIL_PASSWORD")
+}
+
+// `plugmeter migrate [--dry-run]` command: upgrade the storage to the
+// current schema version and report the changes.
+func run_migrate(dry_run bool) error {
+	reports, err := store.Migrate(dry_run)
+	for _, r := range reports {
+		fmt.Printf("%d -> %d: %s: %s\n", r.From, r.To, r.Description, r.Changes)
+	}
+	if err != nil {
+		return err
+	}
+	if len(reports) == 0 {
+		fmt.Println("Storage is up to date")
+	} else if dry_run {
+		fmt.Println("Dry run, no change was written")
+	}
+	return nil
 }
 
 func print_configuration() {
 	log.Debug("**** Using configuration ****")
 	log.Debug("*  Log_levels: ", viper.Get("logs.level"))
+	log.Debug("*  Web UI address: ", viper.Get("web_ui.address"))
 	log.Debug("*  Web UI port: ", viper.Get("web_ui.port"))
 	log.Debug("*  Plug Detection: ", viper.Get("plugs.discovery"))
 	log.Debug("*  Plug IPs: ", viper.Get("plugs.ips"))
+	log.Debug("*  Static plugs: ", viper.Get("plugs.static"))
+	log.Debug("*  Plug drivers: ", plug_driver_names())
 	log.Debug("*  Poll period: ", viper.Get("plugs.poll_period"))
 	log.Debug("*  Max error: ", viper.Get("plugs.max_error"))
+	log.Debug("*  CoIoT: ", viper.Get("plugs.coiot.enabled"), ", address: ", viper.Get("plugs.coiot.address"),
+		", fallback timeout: ", viper.Get("plugs.coiot.fallback_timeout"))
+	log.Debug("*  WebSocket server: ", viper.Get("plugs.websocket.enabled"), ", port: ", viper.Get("plugs.websocket.port"),
+		", devices: ", viper.Get("plugs.websocket.devices"))
 	log.Debug("*  CSV output: ", viper.Get("data.csv"))
 	log.Debug("*  CSV output file: ", viper.Get("data.csv_file"))
+	log.Debug("*  DB backend: ", viper.Get("data.backend"))
 	log.Debug("*  DB file: ", viper.Get("data.db_file"))
+	log.Debug("*  Batch size: ", viper.Get("data.batch_size"))
+	log.Debug("*  Flush interval: ", viper.Get("data.flush_interval"))
+	log.Debug("*  InfluxDB output: ", viper.Get("data.influx.enabled"))
+	if viper.GetBool("data.influx.enabled") {
+		log.Debug("*  InfluxDB url: ", viper.Get("data.influx.url"),
+			", org: ", viper.Get("data.influx.org"), ", bucket: ", viper.Get("data.influx.bucket"))
+		log.Debug("*  InfluxDB spool file: ", viper.Get("data.influx.spool_file"))
+	}
+	log.Debug("*  MQTT: ", viper.Get("mqtt.enabled"))
+	if viper.GetBool("mqtt.enabled") {
+		log.Debug("*  MQTT broker: ", viper.Get("mqtt.broker"), ", topic prefix: ", viper.Get("mqtt.topic_prefix"))
+		log.Debug("*  Home Assistant discovery: ", viper.Get("mqtt.homeassistant.enabled"))
+	}
+	log.Debug("*  Retention (days): raw ", viper.Get("data.retention.raw_days"),
+		", minute ", viper.Get("data.retention.minute_days"),
+		", hour ", viper.Get("data.retention.hour_days"),
+		", day ", viper.Get("data.retention.day_days"))
+	log.Debug("*  Prune period: ", viper.Get("data.retention.prune_period"))
+	log.Debug("*  Compact: ", viper.Get("data.retention.compact"))
+	log.Debug("*  Tariffs: default price ", viper.Get("tariffs.default_price"), " ", viper.Get("tariffs.currency"),
+		"/kWh, daily charge ", viper.Get("tariffs.daily_charge"), ", timezone ", viper.Get("tariffs.timezone"))
+	log.Debug("*  Spot prices: ", viper.Get("tariffs.spot.enabled"), ", watched directory: ", viper.Get("tariffs.spot.watch_dir"))
+	log.Debug("*  Scheduler: timezone ", viper.Get("scheduler.timezone"), ", coordinates ", viper.Get("scheduler.latitude"),
+		", ", viper.Get("scheduler.longitude"), ", missed runs: ", viper.Get("scheduler.missed_runs"),
+		" (max delay ", viper.Get("scheduler.missed_max_delay"), " min)")
+	log.Debug("*  Rules: dry run ", viper.Get("rules.dry_run"), ", history size ", viper.Get("rules.history_size"),
+		", static rules: ", viper.Get("rules.static"))
+	log.Debug("*  Alerts: ", viper.Get("alerts.enabled"))
+	if viper.GetBool("alerts.enabled") {
+		log.Debug("*  Offline alerts: ", viper.Get("alerts.offline.enabled"), ", delay ", viper.Get("alerts.offline.delay"), "s")
+		log.Debug("*  Power alerts: ", viper.Get("alerts.power"))
+		log.Debug("*  Energy alerts: ", viper.Get("alerts.energy"))
+		log.Debug("*  Alert email: ", viper.Get("alerts.email.enabled"), ", host: ", viper.Get("alerts.email.host"),
+			", to: ", viper.Get("alerts.email.to"))
+	}
 	log.Debug("*****************************")
 }
 
@@ -168,7 +450,7 @@ func configure_log() {
 	case "error":
 		log.SetLevel(log.ErrorLevel)
 	default:
-		log.Warn("Invalid log level %s, using 'info' instead", viper.GetString("logs.level"))
+		log.Warnf("Invalid log level %s, using 'info' instead", viper.GetString("logs.level"))
 		log.SetLevel(log.InfoLevel)
 	}
 }
@@ -187,66 +469,167 @@ func plug_monitor(plug_events chan PlugEvent, measurements chan Measure) {
 					plugs[e.Plug.DetectionId] = true
 				}
 			} else if e.EventType == PLUG_REMOVAL {
-				log.Info("REMOVE %s from available plugs", e.Plug.Id)
+				log.Infof("REMOVE %s from available plugs", e.Plug.Id)
 				// No need to stop polling: automatic
 				// simply remove from current list of plug,
 				// to be able to restart polling later
 				delete(plugs, e.Plug.DetectionId)
-				updt_plug_availability(e.Plug.Id, false)
+				if err := store.UpdatePlugAvailability(e.Plug.Id, false); err != nil {
+					log.Error(err)
+				}
+				notify_plug_availability(e.Plug.Id, false)
+			} else if e.EventType == PLUG_FORGOTTEN {
+				// its description and availability are already gone
+				delete(plugs, e.Plug.DetectionId)
 			}
 		}
 	}
 }
 
 // Listen for measurement on the `measurements` channel
-// and store them.
-func store_measurements(measurements chan Measure) {
-	// Read and store the measurements
-	for m := range measurements {
-		// fmt.Println("Measure : ", m)
-		persist_record(m)
-		log_measurements_csv(m)
+// and store them, then push them to all `sinks`.
+// Measurements are buffered and written in batches of `batch_size`,
+// or every `flush_interval` seconds if fewer measurements were received.
+// When `quit` is closed, buffered measurements are flushed, sinks are
+// closed and `done` is signaled.
+func store_measurements(measurements chan Measure, sinks []MeasureSink,
+	batch_size int, flush_interval int, quit chan bool, done chan bool) {
+
+	if batch_size < 1 {
+		batch_size = 1
+	}
+	if flush_interval < 1 {
+		flush_interval = 1
+	}
+	ticker := time.NewTicker(time.Duration(flush_interval) * time.Second)
+	defer ticker.Stop()
+
+	counters := load_energy_counters()
+	batch := make([]Measure, 0, batch_size)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		start := time.Now()
+		if err := store.PersistRecords(batch); err != nil {
+			// a single bad measurement must not lose the whole batch
+			log.Warnf("Could not store %d measurements at once, storing them one by one: %s", len(batch), err)
+			for _, m := range batch {
+				if err := store.PersistRecords([]Measure{m}); err != nil {
+					log.Errorf("Dropping measurement of %s at %d: %s", m.Id, m.Timestamp, err)
+				}
+			}
+		}
+		if viper.GetBool("data.csv") {
+			log_measurements_csv(batch)
+		}
+		for _, sink := range sinks {
+			sink.Push(append([]Measure{}, batch...))
+		}
+		log.Debugf("Stored %d measurements in %v", len(batch), time.Since(start))
+		batch = batch[:0]
+	}
+	add := func(m Measure) {
+		counters.advance(&m)
+		plug_metrics.observe_measure(m)
+		rule_engine.observe(m)
+		alert_manager.observe(m)
+		batch = append(batch, m)
+	}
+
+	for {
+		select {
+		case m := <-measurements:
+			add(m)
+			if len(batch) >= batch_size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-quit:
+			// also store measurements already sent on the channel
+			for len(measurements) > 0 {
+				add(<-measurements)
+			}
+			flush()
+			for _, sink := range sinks {
+				sink.Close()
+			}
+			done <- true
+			return
+		}
 	}
 }
 
-func log_measurements_csv(m Measure) {
+func log_measurements_csv(measures []Measure) {
 	// If the file doesn't exist, create it, or append to the file
 	f, err := os.OpenFile(viper.GetString("data.csv_file"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatalf("Could not open csv file file for writting '%s' ", viper.GetString("data.csv_file"), err)
+		log.Errorf("Could not open csv file file for writting '%s' %s", viper.GetString("data.csv_file"), err)
+		return
 	}
 	defer f.Close()
 
-	timeM := time.Unix(int64(m.Timestamp), 0).Format(time.RFC3339)
-	record := []string{m.Id, m.Plug, strconv.FormatUint(m.Timestamp, 10), timeM, strconv.FormatFloat(m.Power, 'f', 6, 64), strconv.FormatInt(int64(m.Energy), 10)}
 	writer := csv.NewWriter(f)
-	writer.Write(record)
+	for _, m := range measures {
+		timeM := time.Unix(int64(m.Timestamp), 0).Format(time.RFC3339)
+		record := []string{m.Id, m.Plug, strconv.FormatUint(m.Timestamp, 10), timeM, strconv.FormatFloat(m.Power, 'f', 6, 64), strconv.FormatInt(int64(m.Energy), 10)}
+		writer.Write(record)
+	}
 	writer.Flush()
 }
 
 type Measure struct {
-	Id        string
-	Power     float64
+	Id    string
+	Power float64
+	// Raw energy counter of the plug, in watt-minute
 	Energy    uint32
 	Plug      string
 	Timestamp uint64
+	// Monotonic energy of the plug, corrected for counter resets,
+	// in watt-minute (see energy.go)
+	Cumulative uint64
+	// Only reported by Gen2 plugs, in V, A and °C
+	Voltage     float64 `json:",omitempty"`
+	Current     float64 `json:",omitempty"`
+	Temperature float64 `json:",omitempty"`
 }
 
-// Polls a plug periodically to get energy consumption.
+// Polls a plug periodically to get energy consumption, through the
+// driver of the plug.
 // First get a full description of the plug
 // and then start polling every `PLUG_POLL_PERIOD` seconds,
 // sending measurements on the `measurement` channel.
+// Gen1 Shelly plugs pushing their status with CoIoT are not polled while
+// they keep doing so, nor Gen2 plugs while they are connected to the
+// WebSocket server.
 // If a plug cannot be reached `MAX_ERROR_COUNT` times consecutively,
 // it is considered as removed and a corresponding `PlugEvent` is sent on
 // the `plug_events` channel.
+// Polling stops when the plug is forgotten (see PlugPollers), it starts
+// again if the plug is detected again.
 func poll_plug(plugDetection PlugEntry, done chan bool,
 	measurements chan Measure, plug_events chan PlugEvent) {
 
-	plug_desc, err := get_plug_desc(plugDetection.AddrV4.String())
+	driver, err := get_plug_driver(plugDetection.Driver)
+	if err != nil {
+		log.Errorf("Could not poll plug at %v: %s", plugDetection, err)
+		plug_events <- PlugEvent{
+			EventType: PLUG_REMOVAL,
+			Plug: PlugEntry{
+				DetectionId: plugDetection.Id,
+				AddrV4:      plugDetection.AddrV4,
+			},
+		}
+		return
+	}
+
+	plug_desc, err := driver.Describe(plugDetection.AddrV4.String())
+	plug_desc.Driver = driver.Name()
 	if err == nil {
-		log.Debugf("Initial plug info: %s", plug_desc)
+		log.Debugf("Initial plug info: %v", plug_desc)
 	} else {
-		log.Warnf("Could not get plug info at %s ", plugDetection, err)
+		log.Warnf("Could not get plug info at %v %s", plugDetection, err)
 		plug_events <- PlugEvent{
 			EventType: PLUG_REMOVAL,
 			Plug: PlugEntry{
@@ -256,7 +639,14 @@ func poll_plug(plugDetection PlugEntry, done chan bool,
 		}
 		return
 	}
-	persist_plug(plug_desc)
+	if err := store.PersistPlug(plug_desc); err != nil {
+		log.Error(err)
+	}
+	notify_plug_described(plug_desc)
+	coiot.watch(plug_desc, plugDetection.AddrV4.String())
+	defer coiot.forget(plug_desc.Mac)
+	forgotten := plug_pollers.start(plug_desc.Mac)
+	defer plug_pollers.stop(plug_desc.Mac, forgotten)
 
 	ticker := time.NewTicker(time.Duration(viper.GetInt("plugs.poll_period")) * time.Second)
 	defer ticker.Stop()
@@ -267,22 +657,47 @@ func poll_plug(plugDetection PlugEntry, done chan bool,
 		case <-done:
 			log.Info("Stopping polling plugs")
 			return
+		case <-forgotten:
+			log.Infof("Stopping polling forgotten plug %s", plug_desc.Mac)
+			plug_events <- PlugEvent{
+				EventType: PLUG_FORGOTTEN,
+				Plug: PlugEntry{
+					Id:          plug_desc.Id,
+					DetectionId: plugDetection.DetectionId,
+					AddrV4:      plugDetection.AddrV4,
+				},
+			}
+			return
 		case t := <-ticker.C:
-			m, err := get_energy_data(plugDetection.AddrV4.String())
+			if coiot.is_pushing(plug_desc.Mac) || shelly_ws.is_connected(plug_desc.Mac) {
+				if err := store.UpdatePlugAvailability(plug_desc.Id, true); err != nil {
+					log.Error(err)
+				}
+				error_count = 0
+				continue
+			}
+			poll_start := time.Now()
+			m, err := driver.ReadMeter(plug_desc, plugDetection.AddrV4.String())
+			plug_metrics.observe_poll(plug_desc.Mac, time.Since(poll_start), err)
 			if err != nil {
 				log.Infof("- %s COULD not get power at %v %v %s\n", plugDetection, t, error_count, err)
 				error_count++
 			} else {
 				// fmt.Printf("- %s %f %s \n ", plug_host, m.Power, t)
 				var measure = Measure{
-					Id:        plug_desc.Mac,
-					Power:     m.Power,
-					Energy:    m.Total,
-					Plug:      plugDetection.AddrV4.String(),
-					Timestamp: m.Timestamp}
+					Id:          plug_desc.Mac,
+					Power:       m.Power,
+					Energy:      m.Total,
+					Plug:        plugDetection.AddrV4.String(),
+					Timestamp:   m.Timestamp,
+					Voltage:     m.Voltage,
+					Current:     m.Current,
+					Temperature: m.Temperature}
 				measurements <- measure
 
-				updt_plug_availability(plug_desc.Id, true)
+				if err := store.UpdatePlugAvailability(plug_desc.Id, true); err != nil {
+					log.Error(err)
+				}
 				error_count = 0
 			}
 		}
@@ -301,12 +716,56 @@ func poll_plug(plugDetection PlugEntry, done chan bool,
 	}
 }
 
+// PlugPollers stops polling the plugs forgotten through the API. They are
+// polled again when they are detected again, static plugs only when
+// PlugMeter restarts.
+type PlugPollers struct {
+	mutex sync.Mutex
+	// closed when the plug is forgotten, by MAC
+	forgotten map[string]chan bool
+}
+
+var plug_pollers = &PlugPollers{forgotten: make(map[string]chan bool)}
+
+// Register the poller of a plug, the returned channel is closed when the
+// plug is forgotten.
+func (p *PlugPollers) start(mac string) chan bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	forgotten := make(chan bool)
+	p.forgotten[mac] = forgotten
+	return forgotten
+}
+
+func (p *PlugPollers) stop(mac string, forgotten chan bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.forgotten[mac] == forgotten {
+		delete(p.forgotten, mac)
+	}
+}
+
+func (p *PlugPollers) PlugDescribed(plug_desc PlugDescription) {}
+
+func (p *PlugPollers) PlugAvailability(plugId string, is_available bool) {}
+
+func (p *PlugPollers) PlugForgotten(plugId string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if forgotten, ok := p.forgotten[plugId]; ok {
+		close(forgotten)
+		delete(p.forgotten, plugId)
+	}
+}
+
 // enum-like type for plug detection events:
 type PlugEventType uint
 
 const (
 	PLUG_ARRIVAL PlugEventType = iota
 	PLUG_REMOVAL
+	// polling stopped because the plug was forgotten through the API
+	PLUG_FORGOTTEN
 )
 
 type PlugEvent struct {
@@ -314,6 +773,40 @@ type PlugEvent struct {
 	Plug      PlugEntry
 }
 
+// A PlugListener is notified when a plug has been described, which
+// makes it available, when it becomes unavailable, and when it is
+// forgotten through the API.
+type PlugListener interface {
+	PlugDescribed(plug_desc PlugDescription)
+	PlugAvailability(plugId string, is_available bool)
+	PlugForgotten(plugId string)
+}
+
+// Listeners registered in main, before polling starts.
+var plug_listeners = []PlugListener{plug_pollers, plug_metrics}
+
+func notify_plug_described(plug_desc PlugDescription) {
+	for _, l := range plug_listeners {
+		l.PlugDescribed(plug_desc)
+	}
+}
+
+func notify_plug_availability(plugId string, is_available bool) {
+	if plugId == "" {
+		// plug that could not be described
+		return
+	}
+	for _, l := range plug_listeners {
+		l.PlugAvailability(plugId, is_available)
+	}
+}
+
+func notify_plug_forgotten(plugId string) {
+	for _, l := range plug_listeners {
+		l.PlugForgotten(plugId)
+	}
+}
+
 // Run mDns plug detection periodically every `period` seconds
 // and emit a PlugEvent on the `plug_detection` channel for
 // each detected plug.
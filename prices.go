@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Hourly energy prices, for contracts following the day-ahead spot
+// market. Prices are imported from CSV or JSON files, with
+// `plugmeter import-prices <file>...` or by watching a directory, and
+// stored per kWh. When spot prices are enabled, the energy of an hour
+// with an imported price is billed at this price plus `markup`, the
+// tariff rules are used for the other hours.
+
+// Price of a kWh consumed during the hour starting at `Start`
+// (unix timestamp).
+type Price struct {
+	Start uint64
+	Price float64
+}
+
+type SpotConfig struct {
+	Enabled bool
+	// Unit of the imported prices, "kWh" or "MWh"
+	Unit string
+	// Added to the spot price of each kWh
+	Markup float64
+	// Directory watched for new price files, every `watch_period` seconds
+	WatchDir    string
+	WatchPeriod int
+}
+
+// Layouts accepted for the time of a price, in the tariff timezone,
+// besides RFC3339 and unix timestamps.
+var price_time_layouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+}
+
+func parse_price_time(val string, loc *time.Location) (time.Time, error) {
+	val = strings.TrimSpace(val)
+	if ts, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, val); err == nil {
+		return t, nil
+	}
+	for _, layout := range price_time_layouts {
+		if t, err := time.ParseInLocation(layout, val, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s'", val)
+}
+
+// Divisor converting imported prices to prices per kWh.
+func price_unit_divisor(unit string) (float64, error) {
+	switch strings.ToLower(unit) {
+	case "", "kwh":
+		return 1, nil
+	case "mwh":
+		return 1000, nil
+	}
+	return 0, fmt.Errorf("unknown price unit '%s', expected kWh or MWh", unit)
+}
+
+func new_price(t time.Time, price float64, divisor float64) Price {
+	return Price{
+		Start: rollup_start(ROLLUP_HOUR, uint64(t.Unix())),
+		Price: price / divisor,
+	}
+}
+
+// Parse prices from a CSV file with `time,price` records. The separator
+// may also be ";", in which case prices may use a decimal comma and dots
+// to group thousands. A header line is skipped.
+func parse_prices_csv(content []byte, t *Tariffs) ([]Price, error) {
+	divisor, err := price_unit_divisor(t.Spot.Unit)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	semicolon := false
+	if first := bytes.SplitN(content, []byte("\n"), 2)[0]; bytes.Contains(first, []byte(";")) {
+		reader.Comma = ';'
+		semicolon = true
+	}
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	prices := make([]Price, 0, len(records))
+	for i, record := range records {
+		if len(record) < 2 {
+			return nil, fmt.Errorf("line %d: expected time and price", i+1)
+		}
+		price, err := parse_csv_price(record[1], semicolon)
+		if err != nil {
+			if i == 0 {
+				// header
+				continue
+			}
+			return nil, fmt.Errorf("line %d: invalid price '%s'", i+1, record[1])
+		}
+		ts, err := parse_price_time(record[0], t.Location())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		prices = append(prices, new_price(ts, price, divisor))
+	}
+	return prices, nil
+}
+
+// Parse a price of a CSV file. In files separated by ";", a price with a
+// comma uses a decimal comma and dots to group thousands, "1.234,56".
+// Otherwise commas group thousands, "1,234.56" once quoted.
+func parse_csv_price(value string, semicolon bool) (float64, error) {
+	value = strings.TrimSpace(value)
+	if semicolon && strings.Contains(value, ",") {
+		value = strings.ReplaceAll(value, ".", "")
+		value = strings.ReplaceAll(value, ",", ".")
+	} else {
+		value = strings.ReplaceAll(value, ",", "")
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// Parse prices from a JSON array of `{"time": ..., "price": ...}`
+// objects, "start" is accepted instead of "time". Times are strings or
+// unix timestamps.
+func parse_prices_json(content []byte, t *Tariffs) ([]Price, error) {
+	divisor, err := price_unit_divisor(t.Spot.Unit)
+	if err != nil {
+		return nil, err
+	}
+	var records []struct {
+		Time  interface{} `json:"time"`
+		Start interface{} `json:"start"`
+		Price *float64    `json:"price"`
+	}
+	if err := json.Unmarshal(content, &records); err != nil {
+		return nil, err
+	}
+	prices := make([]Price, 0, len(records))
+	for i, record := range records {
+		if record.Time == nil {
+			record.Time = record.Start
+		}
+		if record.Price == nil {
+			return nil, fmt.Errorf("record %d: missing price", i+1)
+		}
+		var ts time.Time
+		switch val := record.Time.(type) {
+		case float64:
+			ts = time.Unix(int64(val), 0)
+		case string:
+			ts, err = parse_price_time(val, t.Location())
+			if err != nil {
+				return nil, fmt.Errorf("record %d: %s", i+1, err)
+			}
+		default:
+			return nil, fmt.Errorf("record %d: missing time", i+1)
+		}
+		prices = append(prices, new_price(ts, *record.Price, divisor))
+	}
+	return prices, nil
+}
+
+func is_price_file(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".csv" || ext == ".json"
+}
+
+// Import a CSV or JSON price file into the store, depending on its
+// extension. Returns the number of prices imported.
+func import_price_file(path string, t *Tariffs) (int, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var prices []Price
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		prices, err = parse_prices_json(content, t)
+	} else {
+		prices, err = parse_prices_csv(content, t)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", path, err)
+	}
+	if err := store.PutPrices(prices); err != nil {
+		return 0, err
+	}
+	return len(prices), nil
+}
+
+// `plugmeter import-prices <file>...` command.
+func run_import_prices(paths []string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("no price file given")
+	}
+	for _, path := range paths {
+		count, err := import_price_file(path, tariffs)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: imported %d prices\n", path, count)
+	}
+	return nil
+}
+
+// Import the price files of `dir` every `period` seconds, when they are
+// new or have been modified since their last import.
+func continuous_price_import(dir string, period int) {
+	if period < 1 {
+		period = 60
+	}
+	log.Debug("Watching ", dir, " for price files")
+
+	imported := make(map[string]time.Time)
+	ticker := time.NewTicker(time.Duration(period) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			log.Error("Could not read price directory ", err)
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if entry.IsDir() || !is_price_file(path) || imported[path].Equal(entry.ModTime()) {
+				continue
+			}
+			count, err := import_price_file(path, tariffs)
+			if err != nil {
+				log.Error("Could not import prices: ", err)
+			} else {
+				log.Infof("Imported %d prices from %s", count, path)
+			}
+			// a broken file is retried once modified
+			imported[path] = entry.ModTime()
+		}
+		<-ticker.C
+	}
+}
+
+// Imported prices for the hours of [from, to), by hour start, nil when
+// spot prices are disabled.
+func spot_prices(t *Tariffs, from time.Time, to time.Time) (map[uint64]float64, error) {
+	if !t.Spot.Enabled {
+		return nil, nil
+	}
+	prices, err := store.GetPrices(time.Unix(int64(rollup_start(ROLLUP_HOUR, uint64(from.Unix()))), 0), to)
+	if err != nil {
+		return nil, err
+	}
+	spot := make(map[uint64]float64, len(prices))
+	for _, p := range prices {
+		spot[p.Start] = p.Price
+	}
+	return spot, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParsePricesCsv(t *testing.T) {
+	previous := rollup_location
+	rollup_location = time.UTC
+	defer func() { rollup_location = previous }()
+	tariffs, err := new_tariffs(TariffsConfig{Timezone: "UTC", Spot: SpotConfig{Unit: "MWh"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		content  string
+		expected []float64
+	}{
+		{"decimal point", "time,price\n2024-05-15T00:00:00Z,1234.56\n2024-05-15T01:00:00Z,-5.5\n",
+			[]float64{1.23456, -0.0055}},
+		{"grouping commas", "time,price\n2024-05-15T00:00:00Z,\"1,234.56\"\n2024-05-15T01:00:00Z,\"12,345\"\n",
+			[]float64{1.23456, 12.345}},
+		{"decimal comma", "time;price\n2024-05-15T00:00:00Z;1.234,56\n2024-05-15T01:00:00Z;1.234.567,8\n",
+			[]float64{1.23456, 1234.5678}},
+		{"decimal point with semicolons", "time;price\n2024-05-15T00:00:00Z;1234.56\n2024-05-15T01:00:00Z;-5,5\n",
+			[]float64{1.23456, -0.0055}},
+	}
+	for _, test := range tests {
+		prices, err := parse_prices_csv([]byte(test.content), tariffs)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(prices) != len(test.expected) {
+			t.Errorf("%s: %d prices, want %d", test.name, len(prices), len(test.expected))
+			continue
+		}
+		for i, price := range prices {
+			at := uint64(start.Add(time.Duration(i) * time.Hour).Unix())
+			if price.Start != at || math.Abs(price.Price-test.expected[i]) > 1e-9 {
+				t.Errorf("%s: price %d: %+v, want %v at %d", test.name, i, price, test.expected[i], at)
+			}
+		}
+	}
+}
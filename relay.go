@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Switching the relay of plugs, through their driver, or through their
+// WebSocket connection for plugs connected to the WebSocket server.
+
+const (
+	RELAY_ON     = "on"
+	RELAY_OFF    = "off"
+	RELAY_TOGGLE = "toggle"
+)
+
+var ErrRelayNotSupported = errors.New("the plug driver cannot switch the relay")
+
+type RelayCommand struct {
+	Action string
+	// Seconds after which the relay is switched back, only for "on" and
+	// "off", 0 to keep it switched
+	Timer int `json:",omitempty"`
+}
+
+func (c RelayCommand) validate() error {
+	switch c.Action {
+	case RELAY_ON, RELAY_OFF:
+	case RELAY_TOGGLE:
+		if c.Timer != 0 {
+			return errors.New("a timer can only be set with the on and off actions")
+		}
+	default:
+		return fmt.Errorf("unknown relay action '%s', expected on, off or toggle", c.Action)
+	}
+	if c.Timer < 0 {
+		return errors.New("timer must be positive")
+	}
+	return nil
+}
+
+// Run a relay command on a plug, return the state of the relay after it.
+// `origin` describes where the command comes from, for the logs.
+func switch_relay(plug_desc PlugDescription, command RelayCommand, origin string) (bool, error) {
+	ison, err := run_relay_command(plug_desc, command)
+	timer := ""
+	if command.Timer > 0 {
+		timer = fmt.Sprintf(" for %ds", command.Timer)
+	}
+	if err != nil {
+		log.Warnf("Relay command %s%s on %s (%s) from %s failed: %s",
+			command.Action, timer, plug_desc.Mac, plug_desc.Name, origin, err)
+		return false, err
+	}
+	log.Infof("Relay command %s%s on %s (%s) from %s, relay is now %s",
+		command.Action, timer, plug_desc.Mac, plug_desc.Name, origin, relay_state(ison))
+	return ison, nil
+}
+
+func relay_state(ison bool) string {
+	if ison {
+		return RELAY_ON
+	}
+	return RELAY_OFF
+}
+
+func run_relay_command(plug_desc PlugDescription, command RelayCommand) (bool, error) {
+	ison, err := ws_relay_command(plug_desc, command)
+	if err != ErrNotConnected {
+		return ison, err
+	}
+
+	driver, err := get_plug_driver(plug_desc.Driver)
+	if err != nil {
+		return false, err
+	}
+	relay, ok := driver.(RelayDriver)
+	if !ok {
+		return false, ErrRelayNotSupported
+	}
+	if command.Action == RELAY_TOGGLE {
+		return relay.ToggleRelay(plug_desc, plug_desc.AddrV4)
+	}
+	return relay.SetRelay(plug_desc, plug_desc.AddrV4, command.Action == RELAY_ON, command.Timer)
+}
+
+// Switch the relay of a plug connected to the WebSocket server,
+// ErrNotConnected otherwise.
+func ws_relay_command(plug_desc PlugDescription, command RelayCommand) (bool, error) {
+	var result RpcSwitchResult
+	if command.Action == RELAY_TOGGLE {
+		if err := shelly_ws.call(plug_desc.Mac, "Switch.Toggle", map[string]int{"id": 0}, &result); err != nil {
+			return false, err
+		}
+		return !result.Was_on, nil
+	}
+	params := map[string]interface{}{"id": 0, "on": command.Action == RELAY_ON}
+	if command.Timer > 0 {
+		params["toggle_after"] = command.Timer
+	}
+	if err := shelly_ws.call(plug_desc.Mac, "Switch.Set", params, &result); err != nil {
+		return false, err
+	}
+	return command.Action == RELAY_ON, nil
+}
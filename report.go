@@ -0,0 +1,234 @@
+package main
+
+import (
+	"time"
+)
+
+// Energy reports over a calendar period (day, week or month) in the
+// tariff timezone, compared to the previous period.
+// Energy and power come from the rollups, which aggregate the raw
+// measurements of each plug exactly (see `summarize_plug`), until the
+// minute rollups of the hours at the edges of a period are pruned.
+
+type PlugReport struct {
+	Id   string `json:",omitempty"`
+	Name string
+	// in kWh
+	Energy float64
+	// in W
+	AvgPower float64
+	// Highest power measured, not set for the total
+	PeakPower float64 `json:",omitempty"`
+	// Highest average power over an hour
+	PeakHourlyPower float64
+	// Only set when tariffs are configured
+	Cost *float64 `json:",omitempty"`
+
+	PreviousEnergy float64
+	PreviousCost   *float64 `json:",omitempty"`
+	// Change versus the previous period, in percent, not set when
+	// there is nothing to compare to
+	EnergyChange *float64 `json:",omitempty"`
+	CostChange   *float64 `json:",omitempty"`
+}
+
+type EnergyReport struct {
+	Period        string
+	Start         time.Time
+	End           time.Time
+	PreviousStart time.Time
+	Currency      string `json:",omitempty"`
+	// For the total, the average and peak hourly power are those of the
+	// power of all plugs combined, hour by hour
+	Total PlugReport
+	Plugs []PlugReport
+}
+
+// Energy and power of a plug over a period.
+type periodSummary struct {
+	energy    float64
+	power_sum float64
+	count     uint64
+	peak      float64
+	// power by hour start, for the peak hourly power and the combined
+	// power of the total
+	hourly map[uint64]*hourPower
+}
+
+type hourPower struct {
+	power_sum float64
+	count     uint64
+}
+
+// Whole hours of the period are summed from the hour rollups. The parts
+// of hours at the edges of the period, when it does not start or end on
+// the hour of the rollups, are summed from the minute rollups, or counted
+// whole in the period they start in once those were pruned (see
+// `energy_rollups`).
+func summarize_plug(plugId string, start time.Time, end time.Time) (periodSummary, error) {
+	summary := periodSummary{hourly: make(map[uint64]*hourPower)}
+	rollups, err := energy_rollups(plugId, start, end, true)
+	if err != nil {
+		return summary, err
+	}
+	for _, r := range rollups {
+		summary.energy += float64(r.EnergyDelta) / WMIN_PER_KWH
+		summary.power_sum += r.PowerSum
+		summary.count += r.Count
+		if r.MaxPower > summary.peak {
+			summary.peak = r.MaxPower
+		}
+		hour := rollup_start(ROLLUP_HOUR, r.Start)
+		if summary.hourly[hour] == nil {
+			summary.hourly[hour] = &hourPower{}
+		}
+		summary.hourly[hour].power_sum += r.PowerSum
+		summary.hourly[hour].count += r.Count
+	}
+	return summary, nil
+}
+
+func (s periodSummary) avg_power() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.power_sum / float64(s.count)
+}
+
+func (p hourPower) avg_power() float64 {
+	if p.count == 0 {
+		return 0
+	}
+	return p.power_sum / float64(p.count)
+}
+
+func (s periodSummary) peak_hourly_power() float64 {
+	peak := 0.0
+	for _, power := range s.hourly {
+		if avg := power.avg_power(); avg > peak {
+			peak = avg
+		}
+	}
+	return peak
+}
+
+// Relative change from `previous` to `current`, in percent.
+func percent_change(previous float64, current float64) *float64 {
+	if previous == 0 {
+		return nil
+	}
+	change := (current - previous) / previous * 100
+	return &change
+}
+
+// Cost by plug and in total, nil without tariffs.
+func period_costs(plugs []PlugDescription, start time.Time, end time.Time) (map[string]float64, *float64, error) {
+	if !tariffs.Configured() {
+		return nil, nil, nil
+	}
+	cost, err := compute_cost(tariffs, plugs, start, end, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	costs := make(map[string]float64, len(cost.Plugs))
+	for _, p := range cost.Plugs {
+		costs[p.Id] = p.Cost
+	}
+	return costs, &cost.Cost, nil
+}
+
+func cost_ptr(costs map[string]float64, plugId string) *float64 {
+	if costs == nil {
+		return nil
+	}
+	cost := costs[plugId]
+	return &cost
+}
+
+// Build the report of `plugs` for the period of kind `period`
+// containing `at`.
+func build_report(plugs []PlugDescription, period string, at time.Time) (EnergyReport, error) {
+	loc := tariffs.Location()
+	start := period_start(period, at, loc)
+	end := period_next(period, start)
+	previous_start := period_start(period, start.Add(-time.Second), loc)
+
+	report := EnergyReport{
+		Period:        period,
+		Start:         start,
+		End:           end,
+		PreviousStart: previous_start,
+		Total:         PlugReport{Name: "Total"},
+		Plugs:         make([]PlugReport, 0, len(plugs)),
+	}
+
+	// daily charges of the days to come are not counted yet
+	cost_end := end
+	if now := time.Now(); now.Before(end) {
+		cost_end = now
+	}
+	costs, total_cost, err := period_costs(plugs, start, cost_end)
+	if err != nil {
+		return report, err
+	}
+	previous_costs, previous_total_cost, err := period_costs(plugs, previous_start, start)
+	if err != nil {
+		return report, err
+	}
+	if costs != nil {
+		report.Currency = tariffs.Currency
+	}
+
+	total_hourly := make(map[uint64]float64)
+	for _, plug := range plugs {
+		current, err := summarize_plug(plug.Mac, start, end)
+		if err != nil {
+			return report, err
+		}
+		previous, err := summarize_plug(plug.Mac, previous_start, start)
+		if err != nil {
+			return report, err
+		}
+		plug_report := PlugReport{
+			Id:              plug.Mac,
+			Name:            plug.Name,
+			Energy:          current.energy,
+			AvgPower:        current.avg_power(),
+			PeakPower:       current.peak,
+			PeakHourlyPower: current.peak_hourly_power(),
+			Cost:            cost_ptr(costs, plug.Mac),
+			PreviousEnergy:  previous.energy,
+			PreviousCost:    cost_ptr(previous_costs, plug.Mac),
+			EnergyChange:    percent_change(previous.energy, current.energy),
+		}
+		if plug_report.Cost != nil {
+			plug_report.CostChange = percent_change(*plug_report.PreviousCost, *plug_report.Cost)
+		}
+		report.Plugs = append(report.Plugs, plug_report)
+
+		report.Total.Energy += current.energy
+		report.Total.PreviousEnergy += previous.energy
+		for hour, power := range current.hourly {
+			if power.count > 0 {
+				total_hourly[hour] += power.avg_power()
+			}
+		}
+	}
+
+	for _, power := range total_hourly {
+		report.Total.AvgPower += power
+		if power > report.Total.PeakHourlyPower {
+			report.Total.PeakHourlyPower = power
+		}
+	}
+	if len(total_hourly) > 0 {
+		report.Total.AvgPower /= float64(len(total_hourly))
+	}
+	report.Total.EnergyChange = percent_change(report.Total.PreviousEnergy, report.Total.Energy)
+	if total_cost != nil {
+		report.Total.Cost = total_cost
+		report.Total.PreviousCost = previous_total_cost
+		report.Total.CostChange = percent_change(*previous_total_cost, *total_cost)
+	}
+	return report, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Periods that do not start on the hour of the rollups are summed from
+// minute rollups at their edges, or from whole hours once those were
+// pruned, and consecutive periods add up either way.
+func TestSummarizePlugEdges(t *testing.T) {
+	start := time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)
+	total := store_pruned_hours(t, start, start.Add(90*time.Minute))
+
+	tests := []struct {
+		split time.Duration
+		// energy before the split, in Wmin
+		first uint64
+	}{
+		// the first hour is pruned, it is counted in the period it starts in
+		{30 * time.Minute, 119 * 300},
+		// the last hour is complete
+		{150 * time.Minute, 299 * 300},
+	}
+	for _, test := range tests {
+		first, err := summarize_plug(COST_TEST_PLUG, start, start.Add(test.split))
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := summarize_plug(COST_TEST_PLUG, start.Add(test.split), start.Add(3*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		first_wmin, second_wmin := math.Round(first.energy*WMIN_PER_KWH), math.Round(second.energy*WMIN_PER_KWH)
+		if first_wmin != float64(test.first) {
+			t.Errorf("split at %v: %v Wmin before, want %d", test.split, first_wmin, test.first)
+		}
+		if first_wmin+second_wmin != float64(total) {
+			t.Errorf("split at %v: %v + %v Wmin, want %d", test.split, first_wmin, second_wmin, total)
+		}
+		if first.avg_power() != 600 || second.peak_hourly_power() != 600 {
+			t.Errorf("split at %v: average power %v, peak hourly power %v", test.split, first.avg_power(),
+				second.peak_hourly_power())
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	viper "github.com/spf13/viper"
+)
+
+// Number of days each kind of data is kept for, 0 means forever.
+type RetentionPolicy struct {
+	RawDays    int
+	MinuteDays int
+	HourDays   int
+	DayDays    int
+}
+
+// Number of keys removed by a pruning, by kind of data.
+type PruneReport struct {
+	Raw     int
+	Minute  int
+	Hour    int
+	Day     int
+	Total   int
+	Elapsed time.Duration
+	// File size before and after compaction, only set when the database
+	// was compacted after pruning
+	SizeBefore int64 `json:",omitempty"`
+	SizeAfter  int64 `json:",omitempty"`
+}
+
+func (policy RetentionPolicy) rollup_days(resolution string) int {
+	switch resolution {
+	case ROLLUP_MINUTE:
+		return policy.MinuteDays
+	case ROLLUP_HOUR:
+		return policy.HourDays
+	case ROLLUP_DAY:
+		return policy.DayDays
+	}
+	return 0
+}
+
+func (report *PruneReport) add_rollups(resolution string, count int) {
+	switch resolution {
+	case ROLLUP_MINUTE:
+		report.Minute += count
+	case ROLLUP_HOUR:
+		report.Hour += count
+	case ROLLUP_DAY:
+		report.Day += count
+	}
+}
+
+func retention_policy() RetentionPolicy {
+	return RetentionPolicy{
+		RawDays:    viper.GetInt("data.retention.raw_days"),
+		MinuteDays: viper.GetInt("data.retention.minute_days"),
+		HourDays:   viper.GetInt("data.retention.hour_days"),
+		DayDays:    viper.GetInt("data.retention.day_days"),
+	}
+}
+
+// Cutoff time for a retention of `days` days, zero time if data must be
+// kept forever.
+func retention_cutoff(days int, now time.Time) time.Time {
+	if days <= 0 {
+		return time.Time{}
+	}
+	return now.AddDate(0, 0, -days)
+}
+
+// Run the pruning periodically every `period` minutes, optionally
+// compacting the database file afterwards.
+func continuous_pruning(period int, compact bool) {
+	if period <= 0 {
+		log.Info("Periodic pruning disabled")
+		return
+	}
+	log.Debug("Starting periodic pruning")
+
+	ticker := time.NewTicker(time.Duration(period) * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		if _, err := prune(retention_policy(), compact); err != nil {
+			log.Error("Could not prune database ", err)
+		}
+		<-ticker.C
+	}
+}
+
+// Remove all data older than the retention policy and optionally
+// compact the storage.
+func prune(policy RetentionPolicy, compact bool) (PruneReport, error) {
+	start := time.Now()
+	report, err := store.Prune(policy, start)
+	if err != nil {
+		return report, err
+	}
+	if compact && report.Total > 0 {
+		report.SizeBefore, report.SizeAfter, err = store.Compact()
+		if err != nil {
+			return report, err
+		}
+	}
+	report.Elapsed = time.Since(start)
+	log.Infof("Pruned %d keys (raw: %d, minute: %d, hour: %d, day: %d) in %v",
+		report.Total, report.Raw, report.Minute, report.Hour, report.Day, report.Elapsed)
+	return report, nil
+}
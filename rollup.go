@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Rollups are aggregates of the raw measurements of a plug over a
+// fixed period (minute, hour or day).
+const (
+	ROLLUP_MINUTE = "minute"
+	ROLLUP_HOUR   = "hour"
+	ROLLUP_DAY    = "day"
+)
+
+var ROLLUP_RESOLUTIONS = []string{ROLLUP_MINUTE, ROLLUP_HOUR, ROLLUP_DAY}
+
+var rollup_periods = map[string]time.Duration{
+	ROLLUP_MINUTE: time.Minute,
+	ROLLUP_HOUR:   time.Hour,
+	ROLLUP_DAY:    24 * time.Hour,
+}
+
+type Rollup struct {
+	Id         string
+	Resolution string
+	// Start of the period, as a unix timestamp
+	Start    uint64
+	Count    uint64
+	PowerSum float64
+	AvgPower float64
+	MinPower float64
+	MaxPower float64
+	// Energy consumed during the period, in watt-minute
+	EnergyDelta uint64
+	// Last raw reading aggregated in this rollup, used to compute
+	// the energy delta with the next reading
+	LastEnergy    uint32
+	LastTimestamp uint64
+}
+
+func is_rollup_resolution(resolution string) bool {
+	_, ok := rollup_periods[resolution]
+	return ok
+}
+
+// Location whose local minutes, hours and days the rollups cover, the
+// tariff timezone, set in main.
+var rollup_location = time.Local
+
+// Start of the period of the given resolution containing `ts`, in
+// `rollup_location`.
+func rollup_start(resolution string, ts uint64) uint64 {
+	t := time.Unix(int64(ts), 0).In(rollup_location)
+	if resolution == ROLLUP_DAY {
+		// days last 23 or 25 hours on DST changes
+		return uint64(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, rollup_location).Unix())
+	}
+	// minutes and hours follow the offset of the location at `ts`, which
+	// is not always a whole number of hours
+	_, offset := t.Zone()
+	period := int64(rollup_periods[resolution].Seconds())
+	local := int64(ts) + int64(offset)
+	return uint64(int64(ts) - (local%period+period)%period)
+}
+
+func new_rollup(resolution string, measure Measure) Rollup {
+	return Rollup{
+		Id:         measure.Id,
+		Resolution: resolution,
+		Start:      rollup_start(resolution, measure.Timestamp),
+		MinPower:   measure.Power,
+		MaxPower:   measure.Power,
+	}
+}
+
+// Add a measurement to a rollup, given the last energy reading
+// known before it.
+func aggregate_measure(rollup *Rollup, measure Measure, last_energy uint32, last_ts uint64) {
+	rollup.Count++
+	rollup.PowerSum += measure.Power
+	rollup.AvgPower = rollup.PowerSum / float64(rollup.Count)
+	if measure.Power < rollup.MinPower {
+		rollup.MinPower = measure.Power
+	}
+	if measure.Power > rollup.MaxPower {
+		rollup.MaxPower = measure.Power
+	}
+
+	// Readings received out of order do not contribute to the energy delta
+	if measure.Timestamp < last_ts {
+		return
+	}
+	// counter resets and wraparounds are accounted for
+	rollup.EnergyDelta += energy_delta(last_energy, measure.Energy)
+	rollup.LastEnergy = measure.Energy
+	rollup.LastTimestamp = measure.Timestamp
+}
+
+// Rollups summing the energy of a plug in [from, to), in chronological
+// order: the minute rollups of each hour, or its hour rollup once some of
+// its minute rollups were pruned. An hour at an edge of the range whose
+// minute rollups were pruned is counted whole in the range it starts in,
+// so that consecutive ranges add up.
+// With `whole_hours`, the hours entirely within the range are counted from
+// their hour rollup, minute rollups are only read for the hours at the
+// edges.
+func energy_rollups(plugId string, from time.Time, to time.Time, whole_hours bool) ([]Rollup, error) {
+	if !from.Before(to) {
+		return nil, nil
+	}
+	first_hour := time.Unix(int64(rollup_start(ROLLUP_HOUR, uint64(from.Unix()))), 0)
+	last_hour := time.Unix(int64(rollup_start(ROLLUP_HOUR, uint64(to.Add(-time.Second).Unix()))), 0)
+	hours, err := store.GetRollups(plugId, ROLLUP_HOUR, first_hour, last_hour, 0)
+	if err != nil {
+		return nil, err
+	}
+	// all the minutes of the hours at the edges, to know if they were pruned
+	minute_ranges := [][2]time.Time{{first_hour, last_hour.Add(time.Hour - time.Second)}}
+	if whole_hours {
+		// only the hours at the edges are counted from minute rollups
+		minute_ranges = nil
+		if first_hour.Before(from) {
+			minute_ranges = append(minute_ranges, [2]time.Time{first_hour, first_hour.Add(time.Hour - time.Second)})
+		}
+		if last_hour.Add(time.Hour).After(to) && !(first_hour.Before(from) && last_hour.Equal(first_hour)) {
+			minute_ranges = append(minute_ranges, [2]time.Time{last_hour, last_hour.Add(time.Hour - time.Second)})
+		}
+	}
+	minutes := make([]Rollup, 0)
+	for _, r := range minute_ranges {
+		rollups, err := store.GetRollups(plugId, ROLLUP_MINUTE, r[0], r[1], 0)
+		if err != nil {
+			return nil, err
+		}
+		minutes = append(minutes, rollups...)
+	}
+
+	// measurements aggregated in the minute rollups of each hour
+	minute_counts := make(map[uint64]uint64)
+	for _, r := range minutes {
+		minute_counts[rollup_start(ROLLUP_HOUR, r.Start)] += r.Count
+	}
+	// hours counted from their hour rollup
+	whole := make(map[uint64]bool)
+	rollups := make([]Rollup, 0, len(hours)+len(minutes))
+	for _, r := range hours {
+		start := time.Unix(int64(r.Start), 0)
+		within := !start.Before(from) && !start.Add(time.Hour).After(to)
+		if !(whole_hours && within) && minute_counts[r.Start] >= r.Count {
+			continue
+		}
+		whole[r.Start] = true
+		if !start.Before(from) {
+			rollups = append(rollups, r)
+		}
+	}
+	for _, r := range minutes {
+		start := time.Unix(int64(r.Start), 0)
+		if !whole[rollup_start(ROLLUP_HOUR, r.Start)] && !start.Before(from) && start.Before(to) {
+			rollups = append(rollups, r)
+		}
+	}
+	sort.SliceStable(rollups, func(i, j int) bool { return rollups[i].Start < rollups[j].Start })
+	return rollups, nil
+}
+
+// META key of the timezone the stored rollups were computed in
+const ROLLUP_TIMEZONE_KEY = "rollup_timezone"
+
+// Rebuild all rollups when they were computed in another timezone than
+// `rollup_location`, such as rollups stored before they followed the
+// tariff timezone.
+func check_rollup_timezone() error {
+	stored, err := store.GetMeta(ROLLUP_TIMEZONE_KEY)
+	if err != nil {
+		return err
+	}
+	current := location_id(rollup_location)
+	if stored == current {
+		return nil
+	}
+	log.Infof("Rollups were computed in timezone '%s', rebuilding them in '%s'", stored, current)
+	if err := rebuild_all_rollups(); err != nil {
+		return err
+	}
+	return store.PutMeta(ROLLUP_TIMEZONE_KEY, current)
+}
+
+// Name of a location, with its winter and summer offsets for the "Local"
+// location, which depends on the system.
+func location_id(loc *time.Location) string {
+	if loc.String() != "Local" {
+		return loc.String()
+	}
+	winter := time.Date(2020, time.January, 1, 0, 0, 0, 0, loc)
+	summer := time.Date(2020, time.July, 1, 0, 0, 0, 0, loc)
+	return fmt.Sprintf("Local %s/%s", winter.Format("-0700"), summer.Format("-0700"))
+}
+
+// Rebuild the rollups of every known plug.
+func rebuild_all_rollups() error {
+	plugs, err := store.GetPlugs()
+	if err != nil {
+		return err
+	}
+	for _, plug := range plugs {
+		log.Info("Rebuilding rollups for ", plug.Mac)
+		if err := store.RebuildRollups(plug.Mac); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Automation rules switch the relay of a plug when the power drawn by a
+// plug stays above or below a threshold for some time, such as "switch
+// plug X off when it draws under 5 W for 10 minutes", or "switch plug B
+// off when plug A draws over 1500 W".
+// They are evaluated on every measurement stored, and declared either in
+// the configuration (`[[rules.static]]`), or through the API, which
+// stores them. Rules are identified by their name.
+
+const (
+	RULE_ABOVE = "above"
+	RULE_BELOW = "below"
+
+	RULE_SOURCE_CONFIG = "config"
+	RULE_SOURCE_API    = "api"
+)
+
+var ErrRuleNotFound = errors.New("rule not found")
+
+type Rule struct {
+	Name    string
+	Enabled bool
+
+	// The rule is active while the power of `Plug` is above or below
+	// `Threshold` watts. Once active, it only becomes inactive when the
+	// power goes back past the threshold by `Hysteresis` watts
+	Plug       string
+	Condition  string
+	Threshold  float64
+	Hysteresis float64 `json:",omitempty"`
+	// Seconds the rule must stay active before firing
+	Duration int `json:",omitempty"`
+
+	// Relay command run on `Target` when the rule fires, the watched plug
+	// by default. A rule fires once each time it becomes active, and at
+	// most once every `Cooldown` seconds
+	Target   string `json:",omitempty"`
+	Action   string
+	Timer    int `json:",omitempty"`
+	Cooldown int `json:",omitempty"`
+	// Only log and record the firings, without switching the relay
+	DryRun bool `json:",omitempty" mapstructure:"dry_run"`
+
+	// Where the rule is declared, "config" or "api", not stored
+	Source string `json:",omitempty" mapstructure:"-"`
+}
+
+// Check a rule, and normalize its fields.
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return errors.New("a name is required")
+	}
+	if strings.Contains(r.Name, "/") {
+		return errors.New("the name cannot contain '/'")
+	}
+	if r.Plug == "" {
+		return errors.New("a plug is required")
+	}
+	r.Condition = strings.ToLower(r.Condition)
+	if r.Condition != RULE_ABOVE && r.Condition != RULE_BELOW {
+		return fmt.Errorf("unknown condition '%s', expected '%s' or '%s'", r.Condition, RULE_ABOVE, RULE_BELOW)
+	}
+	if r.Threshold < 0 || r.Hysteresis < 0 {
+		return errors.New("threshold and hysteresis must be positive")
+	}
+	if r.Duration < 0 || r.Cooldown < 0 {
+		return errors.New("duration and cooldown must be positive")
+	}
+	if r.Target == "" {
+		r.Target = r.Plug
+	}
+	return (RelayCommand{r.Action, r.Timer}).validate()
+}
+
+// Whether `power` satisfies the condition of the rule, given whether the
+// rule is already active.
+func (r Rule) holds(power float64, active bool) bool {
+	return threshold_holds(r.Condition, r.Threshold, r.Hysteresis, power, active)
+}
+
+// Whether `power` is above or below `threshold`. Once active, the
+// condition holds until the power goes back past the threshold by
+// `hysteresis`.
+func threshold_holds(condition string, threshold float64, hysteresis float64, power float64, active bool) bool {
+	margin := 0.0
+	if active {
+		margin = hysteresis
+	}
+	if condition == RULE_ABOVE {
+		return power > threshold-margin
+	}
+	return power < threshold+margin
+}
+
+type ruleState struct {
+	active bool
+	// when the rule last became active
+	since time.Time
+	// whether the rule fired since it became active
+	fired      bool
+	last_fired time.Time
+	power      float64
+}
+
+// Advance the state of a rule with a new measurement of its plug,
+// returns whether the rule fires.
+func (s *ruleState) advance(rule Rule, power float64, now time.Time) bool {
+	s.power = power
+	if !rule.holds(power, s.active) {
+		s.active = false
+		s.fired = false
+		return false
+	}
+	if !s.active {
+		s.active = true
+		s.since = now
+	}
+	if s.fired || now.Sub(s.since) < time.Duration(rule.Duration)*time.Second {
+		return false
+	}
+	if !s.last_fired.IsZero() && now.Sub(s.last_fired) < time.Duration(rule.Cooldown)*time.Second {
+		// fires when the cooldown ends, if still active
+		return false
+	}
+	s.fired = true
+	s.last_fired = now
+	return true
+}
+
+type RuleFiring struct {
+	Rule   string
+	Time   time.Time
+	Plug   string
+	Power  float64
+	Target string
+	Action string
+	Timer  int `json:",omitempty"`
+	DryRun bool
+	// State of the target relay after the command, not set for dry runs
+	// and failed commands
+	State string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+type RuleStateResponse struct {
+	Active    bool
+	Since     *time.Time `json:",omitempty"`
+	LastFired *time.Time `json:",omitempty"`
+	// Last power measured on the watched plug
+	Power *float64 `json:",omitempty"`
+}
+
+type RuleResponse struct {
+	Rule
+	State RuleStateResponse
+}
+
+type RuleEngine struct {
+	mutex sync.Mutex
+	// rules of the API and firings, and the targets of the rules
+	store   RuleStore
+	plugs   PlugStore
+	dry_run bool
+	// number of firings kept in the store
+	history_size int
+	config_rules []Rule
+	// rules of the configuration, then those of the store
+	rules  []Rule
+	states map[string]*ruleState
+}
+
+var rule_engine *RuleEngine
+
+// Create the rule engine with the rules of the configuration and those
+// of the store. With `dry_run`, no rule switches a relay.
+func new_rule_engine(rules RuleStore, plugs PlugStore, dry_run bool, history_size int) (*RuleEngine, error) {
+	e := &RuleEngine{
+		store:        rules,
+		plugs:        plugs,
+		dry_run:      dry_run,
+		history_size: history_size,
+		states:       make(map[string]*ruleState),
+	}
+	if err := viper.UnmarshalKey("rules.static", &e.config_rules); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i := range e.config_rules {
+		rule := &e.config_rules[i]
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("rule '%s': %s", rule.Name, err)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate rule '%s'", rule.Name)
+		}
+		names[rule.Name] = true
+		rule.Source = RULE_SOURCE_CONFIG
+	}
+	return e, e.reload()
+}
+
+// Read the rules of the store again, after they were changed. The state
+// of the rules that did not change is kept.
+func (e *RuleEngine) reload() error {
+	stored, err := e.store.GetRules()
+	if err != nil {
+		return err
+	}
+	rules := append([]Rule{}, e.config_rules...)
+	for _, rule := range stored {
+		rule.Source = RULE_SOURCE_API
+		if _, found := e.find(rule.Name); found {
+			log.Warnf("Ignoring stored rule '%s', a rule of the configuration has the same name", rule.Name)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	previous := make(map[string]Rule)
+	for _, rule := range e.rules {
+		previous[rule.Name] = rule
+	}
+	states := make(map[string]*ruleState)
+	for _, rule := range rules {
+		if state, ok := e.states[rule.Name]; ok && previous[rule.Name] == rule {
+			states[rule.Name] = state
+		}
+	}
+	e.rules = rules
+	e.states = states
+	return nil
+}
+
+// Find a rule of the configuration.
+func (e *RuleEngine) find(name string) (Rule, bool) {
+	for _, rule := range e.config_rules {
+		if rule.Name == name {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// Whether a rule is declared in the configuration, and cannot be changed
+// through the API.
+func (e *RuleEngine) is_config_rule(name string) bool {
+	_, found := e.find(name)
+	return found
+}
+
+func (e *RuleEngine) Rules() []RuleResponse {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	responses := make([]RuleResponse, 0, len(e.rules))
+	for _, rule := range e.rules {
+		responses = append(responses, e.response(rule))
+	}
+	return responses
+}
+
+// Returns ErrRuleNotFound if the rule is unknown.
+func (e *RuleEngine) Rule(name string) (RuleResponse, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, rule := range e.rules {
+		if rule.Name == name {
+			return e.response(rule), nil
+		}
+	}
+	return RuleResponse{}, ErrRuleNotFound
+}
+
+// Must be called with the mutex held.
+func (e *RuleEngine) response(rule Rule) RuleResponse {
+	response := RuleResponse{Rule: rule}
+	if state, ok := e.states[rule.Name]; ok {
+		power := state.power
+		response.State.Power = &power
+		response.State.Active = state.active
+		if state.active {
+			since := state.since
+			response.State.Since = &since
+		}
+		if !state.last_fired.IsZero() {
+			last_fired := state.last_fired
+			response.State.LastFired = &last_fired
+		}
+	}
+	return response
+}
+
+// Firings of a rule, or of all rules, most recent first.
+func (e *RuleEngine) History(name string, limit int) ([]RuleFiring, error) {
+	return e.store.GetRuleFirings(name, limit)
+}
+
+// Evaluate the rules watching the plug of a measurement.
+func (e *RuleEngine) observe(m Measure) {
+	if e == nil {
+		return
+	}
+	now := time.Now()
+	fired := make([]Rule, 0)
+	e.mutex.Lock()
+	for _, rule := range e.rules {
+		if !rule.Enabled || rule.Plug != m.Id {
+			continue
+		}
+		state, ok := e.states[rule.Name]
+		if !ok {
+			state = &ruleState{}
+			e.states[rule.Name] = state
+		}
+		if state.advance(rule, m.Power, now) {
+			fired = append(fired, rule)
+		}
+	}
+	e.mutex.Unlock()
+
+	for _, rule := range fired {
+		firing := RuleFiring{
+			Rule:   rule.Name,
+			Time:   now,
+			Plug:   rule.Plug,
+			Power:  m.Power,
+			Target: rule.Target,
+			Action: rule.Action,
+			Timer:  rule.Timer,
+			DryRun: e.dry_run || rule.DryRun,
+		}
+		// do not hold the measurements while the relay is switched
+		go e.fire(firing)
+	}
+}
+
+func (e *RuleEngine) fire(firing RuleFiring) {
+	command := RelayCommand{firing.Action, firing.Timer}
+	if firing.DryRun {
+		log.Infof("Rule '%s' fired on %.1f W of %s, dry run: would run %s on %s",
+			firing.Rule, firing.Power, firing.Plug, firing.Action, firing.Target)
+	} else if target, err := e.plugs.GetPlug(firing.Target); err != nil {
+		log.Warnf("Rule '%s' could not run on %s: %s", firing.Rule, firing.Target, err)
+		firing.Error = err.Error()
+	} else {
+		log.Infof("Rule '%s' fired on %.1f W of %s", firing.Rule, firing.Power, firing.Plug)
+		ison, err := switch_relay(target, command, fmt.Sprintf("rule '%s'", firing.Rule))
+		if err != nil {
+			firing.Error = err.Error()
+		} else {
+			firing.State = relay_state(ison)
+		}
+	}
+
+	if err := e.store.PutRuleFiring(firing, e.history_size); err != nil {
+		log.Error("Could not record the firing of rule '", firing.Rule, "': ", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRuleHolds(t *testing.T) {
+	tests := []struct {
+		condition  string
+		threshold  float64
+		hysteresis float64
+		power      float64
+		active     bool
+		holds      bool
+	}{
+		{RULE_ABOVE, 1500, 0, 1600, false, true},
+		{RULE_ABOVE, 1500, 0, 1500, false, false},
+		{RULE_ABOVE, 1500, 0, 1400, false, false},
+		{RULE_ABOVE, 1500, 100, 1450, false, false},
+		// once active, holds until the power goes under 1400 W
+		{RULE_ABOVE, 1500, 100, 1450, true, true},
+		{RULE_ABOVE, 1500, 100, 1400, true, false},
+		{RULE_ABOVE, 1500, 0, 1450, true, false},
+		{RULE_BELOW, 5, 0, 3, false, true},
+		{RULE_BELOW, 5, 0, 5, false, false},
+		{RULE_BELOW, 5, 2, 6, false, false},
+		// once active, holds until the power goes over 7 W
+		{RULE_BELOW, 5, 2, 6, true, true},
+		{RULE_BELOW, 5, 2, 7, true, false},
+		{RULE_BELOW, 0, 0, 0, false, false},
+	}
+	for _, test := range tests {
+		rule := Rule{Condition: test.condition, Threshold: test.threshold, Hysteresis: test.hysteresis}
+		if holds := rule.holds(test.power, test.active); holds != test.holds {
+			t.Errorf("holds(%s %v ±%v, %v W, active %v) = %v, want %v", test.condition, test.threshold,
+				test.hysteresis, test.power, test.active, holds, test.holds)
+		}
+	}
+}
+
+func TestRuleStateAdvance(t *testing.T) {
+	type step struct {
+		// seconds since the first measurement
+		at    int
+		power float64
+		fires bool
+	}
+	tests := []struct {
+		name  string
+		rule  Rule
+		steps []step
+	}{
+		{"fires once while active", Rule{Condition: RULE_ABOVE, Threshold: 100},
+			[]step{{0, 50, false}, {10, 150, true}, {20, 160, false}, {30, 170, false}}},
+		{"fires again once inactive", Rule{Condition: RULE_ABOVE, Threshold: 100},
+			[]step{{0, 150, true}, {10, 50, false}, {20, 150, true}}},
+		{"duration", Rule{Condition: RULE_BELOW, Threshold: 5, Duration: 600},
+			[]step{{0, 2, false}, {300, 2, false}, {599, 3, false}, {600, 3, true}, {900, 3, false}}},
+		{"duration restarts when inactive", Rule{Condition: RULE_BELOW, Threshold: 5, Duration: 600},
+			[]step{{0, 2, false}, {500, 20, false}, {510, 2, false}, {1000, 2, false}, {1110, 2, true}}},
+		{"hysteresis", Rule{Condition: RULE_ABOVE, Threshold: 1500, Hysteresis: 100},
+			[]step{{0, 1600, true}, {10, 1450, false}, {20, 1550, false}, {30, 1350, false}, {40, 1550, true}}},
+		{"hysteresis keeps the duration running", Rule{Condition: RULE_ABOVE, Threshold: 1500, Hysteresis: 100, Duration: 60},
+			[]step{{0, 1600, false}, {30, 1450, false}, {60, 1450, true}}},
+		{"cooldown", Rule{Condition: RULE_ABOVE, Threshold: 100, Cooldown: 300},
+			[]step{{0, 150, true}, {10, 50, false}, {20, 150, false}, {100, 150, false}, {300, 150, true}, {400, 150, false}}},
+		{"cooldown ended", Rule{Condition: RULE_ABOVE, Threshold: 100, Cooldown: 300},
+			[]step{{0, 150, true}, {10, 50, false}, {400, 150, true}}},
+		{"cooldown ends while inactive", Rule{Condition: RULE_ABOVE, Threshold: 100, Cooldown: 300},
+			[]step{{0, 150, true}, {10, 50, false}, {20, 150, false}, {200, 50, false}, {400, 50, false}, {410, 150, true}}},
+	}
+	start := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		var state ruleState
+		for _, s := range test.steps {
+			if fires := state.advance(test.rule, s.power, start.Add(time.Duration(s.at)*time.Second)); fires != s.fires {
+				t.Errorf("%s: %v W at %ds fires: %v, want %v", test.name, s.power, s.at, fires, s.fires)
+			}
+		}
+	}
+}
+
+// Firings are stored most recent first, only the most recent ones are kept.
+func TestRuleFirings(t *testing.T) {
+	dir := t.TempDir()
+	bolt_store, err := open_bolt_store(filepath.Join(dir, "plugmeter.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { bolt_store.Close() }()
+	sqlite_store, err := open_sqlite_store(filepath.Join(dir, "plugmeter.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite_store.Close()
+	if _, err := sqlite_store.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+	for name, s := range map[string]Store{"bolt": bolt_store, "sqlite": sqlite_store} {
+		for i, rule := range []string{"heater", "fridge", "heater", "heater", "fridge"} {
+			firing := RuleFiring{Rule: rule, Time: start.Add(time.Duration(i) * time.Second), Plug: "AABBCC001122",
+				Power: float64(i), Target: "AABBCC001122", Action: RELAY_OFF, State: "off"}
+			if err := s.PutRuleFiring(firing, 4); err != nil {
+				t.Fatal(name, err)
+			}
+		}
+
+		check := func(rule string, limit int, expected []float64) {
+			firings, err := s.GetRuleFirings(rule, limit)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			powers := make([]float64, 0, len(firings))
+			for _, f := range firings {
+				powers = append(powers, f.Power)
+			}
+			if len(powers) != len(expected) {
+				t.Errorf("%s: firings of '%s', limit %d: %v, want %v", name, rule, limit, powers, expected)
+				return
+			}
+			for i := range powers {
+				if powers[i] != expected[i] {
+					t.Errorf("%s: firings of '%s', limit %d: %v, want %v", name, rule, limit, powers, expected)
+					return
+				}
+			}
+		}
+		check("", 0, []float64{4, 3, 2, 1})
+		check("", 2, []float64{4, 3})
+		check("heater", 0, []float64{3, 2})
+		check("fridge", 1, []float64{4})
+		check("boiler", 0, []float64{})
+
+		firings, _ := s.GetRuleFirings("", 1)
+		if len(firings) == 1 && (!firings[0].Time.Equal(start.Add(4*time.Second)) || firings[0].State != "off") {
+			t.Errorf("%s: stored firing %+v", name, firings[0])
+		}
+	}
+
+	// the firings already stored are counted once reopened
+	bolt_store.Close()
+	bolt_store, err = open_bolt_store(filepath.Join(dir, "plugmeter.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	firing := RuleFiring{Rule: "fridge", Time: start.Add(5 * time.Second), Power: 5, Action: RELAY_OFF}
+	if err := bolt_store.PutRuleFiring(firing, 4); err != nil {
+		t.Fatal(err)
+	}
+	firings, _ := bolt_store.GetRuleFirings("", 0)
+	heater, _ := bolt_store.GetRuleFirings("heater", 0)
+	if len(firings) != 4 || firings[3].Power != 2 || len(heater) != 2 {
+		t.Errorf("reopened: %d firings, heater %+v", len(firings), heater)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Schedules switch the relay of a plug at given times, set either by a
+// cron expression, or by days of the week and a time of day, which can
+// be relative to sunrise or sunset. They are run by the scheduler
+// goroutine, in the scheduler timezone.
+
+const (
+	SUNRISE = "sunrise"
+	SUNSET  = "sunset"
+
+	// What to do with the runs missed while PlugMeter was stopped:
+	// skip them, or run the last one
+	MISSED_SKIP = "skip"
+	MISSED_LAST = "last"
+
+	// A run is late, and handled with the missed runs policy, when it is
+	// handled more than this after its time
+	SCHEDULE_GRACE = 2 * time.Minute
+	// Sun rules look that many days ahead for a day with a sunrise or a
+	// sunset, for polar regions
+	SUN_MAX_DAYS = 190
+	// Missed runs are not searched further back
+	MISSED_MAX_DAYS = 366
+)
+
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+type Schedule struct {
+	Id      uint64
+	Plug    string
+	Name    string `json:",omitempty"`
+	Enabled bool
+	// Relay command run by the schedule
+	Action string
+	Timer  int `json:",omitempty"`
+
+	// Either a cron expression
+	Cron string `json:",omitempty"`
+	// or days of the week ("mon" ... "sun", every day if empty) and a
+	// time of day, "HH:MM", "sunrise" or "sunset", shifted by `Offset`
+	// minutes
+	Weekdays []string `json:",omitempty"`
+	Time     string   `json:",omitempty"`
+	Offset   int      `json:",omitempty"`
+
+	// Runs up to this time have been handled, reset when the schedule is
+	// created or updated
+	LastRun time.Time
+}
+
+type ScheduleConfig struct {
+	location       *time.Location
+	Latitude       float64
+	Longitude      float64
+	MissedRuns     string
+	MissedMaxDelay time.Duration
+}
+
+var schedule_config ScheduleConfig
+
+func load_schedule_config() (ScheduleConfig, error) {
+	config := ScheduleConfig{
+		Latitude:   viper.GetFloat64("scheduler.latitude"),
+		Longitude:  viper.GetFloat64("scheduler.longitude"),
+		MissedRuns: viper.GetString("scheduler.missed_runs"),
+		// 0 means no limit
+		MissedMaxDelay: time.Duration(viper.GetInt("scheduler.missed_max_delay")) * time.Minute,
+	}
+	loc, err := time.LoadLocation(viper.GetString("scheduler.timezone"))
+	if err != nil {
+		return config, fmt.Errorf("invalid scheduler timezone: %s", err)
+	}
+	config.location = loc
+	if config.MissedRuns != MISSED_SKIP && config.MissedRuns != MISSED_LAST {
+		return config, fmt.Errorf("invalid scheduler.missed_runs '%s', expected '%s' or '%s'",
+			config.MissedRuns, MISSED_SKIP, MISSED_LAST)
+	}
+	return config, nil
+}
+
+// Whether coordinates are set, and sunrise and sunset can be computed.
+func (c ScheduleConfig) has_coordinates() bool {
+	return c.Latitude != 0 || c.Longitude != 0
+}
+
+func parse_weekday(name string) (time.Weekday, error) {
+	for i, day := range cron_day_names {
+		if strings.ToLower(name) == day {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday '%s', expected one of %v", name, cron_day_names)
+}
+
+// Check a schedule, and normalize its fields.
+func (s *Schedule) validate(config ScheduleConfig) error {
+	if s.Plug == "" {
+		return errors.New("a plug is required")
+	}
+	if err := (RelayCommand{s.Action, s.Timer}).validate(); err != nil {
+		return err
+	}
+	if (s.Cron == "") == (s.Time == "") {
+		return errors.New("either a cron expression or a time is required")
+	}
+	if s.Cron != "" {
+		if len(s.Weekdays) > 0 || s.Offset != 0 {
+			return errors.New("weekdays and offset cannot be used with a cron expression")
+		}
+		_, err := parse_cron(s.Cron)
+		return err
+	}
+
+	for i, day := range s.Weekdays {
+		if _, err := parse_weekday(day); err != nil {
+			return err
+		}
+		s.Weekdays[i] = strings.ToLower(day)
+	}
+	s.Time = strings.ToLower(s.Time)
+	if s.Time == SUNRISE || s.Time == SUNSET {
+		if !config.has_coordinates() {
+			return errors.New("scheduler.latitude and scheduler.longitude must be set for sunrise and sunset")
+		}
+		return nil
+	}
+	if _, err := parse_time_of_day(s.Time); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Time of the run of a weekday rule on `day`, false if there is none.
+func (s Schedule) run_on(day time.Time, config ScheduleConfig) (time.Time, bool) {
+	if len(s.Weekdays) > 0 {
+		found := false
+		for _, name := range s.Weekdays {
+			if weekday, err := parse_weekday(name); err == nil && weekday == day.Weekday() {
+				found = true
+			}
+		}
+		if !found {
+			return time.Time{}, false
+		}
+	}
+	var at time.Time
+	switch s.Time {
+	case SUNRISE, SUNSET:
+		sunrise, sunset, ok := sun_times(day, config.Latitude, config.Longitude)
+		if !ok {
+			return time.Time{}, false
+		}
+		at = sunrise
+		if s.Time == SUNSET {
+			at = sunset
+		}
+		at = at.Truncate(time.Minute)
+	default:
+		minutes, err := parse_time_of_day(s.Time)
+		if err != nil {
+			return time.Time{}, false
+		}
+		at = time.Date(day.Year(), day.Month(), day.Day(), 0, minutes, 0, 0, day.Location())
+	}
+	return at.Add(time.Duration(s.Offset) * time.Minute), true
+}
+
+// First run of the schedule strictly after `after`, a zero time if there
+// is none.
+func (s Schedule) next(after time.Time, config ScheduleConfig) time.Time {
+	after = after.In(config.location)
+	if s.Cron != "" {
+		cron, err := parse_cron(s.Cron)
+		if err != nil {
+			return time.Time{}
+		}
+		return cron.next(after)
+	}
+	// the offset can move a run to the day before or after
+	day := time.Date(after.Year(), after.Month(), after.Day()-1, 0, 0, 0, 0, config.location)
+	for i := 0; i < SUN_MAX_DAYS; i++ {
+		if at, ok := s.run_on(day.AddDate(0, 0, i), config); ok && at.After(after) {
+			return at
+		}
+	}
+	return time.Time{}
+}
+
+// Last run of the schedule after `after` and up to `now`, a zero time if
+// there is none. The run is searched backwards from `now`, in windows
+// doubling in size, so that only the runs of the last window are
+// iterated however long ago `after` is.
+func (s Schedule) last_run(after time.Time, now time.Time, config ScheduleConfig) time.Time {
+	if oldest := now.AddDate(0, 0, -MISSED_MAX_DAYS); after.Before(oldest) {
+		after = oldest
+	}
+	if first := s.next(after, config); first.IsZero() || first.After(now) {
+		return time.Time{}
+	}
+	from := after
+	for window := time.Minute; now.Add(-window).After(after); window *= 2 {
+		if at := s.next(now.Add(-window), config); !at.IsZero() && !at.After(now) {
+			from = now.Add(-window)
+			break
+		}
+	}
+	var last time.Time
+	for at := s.next(from, config); !at.IsZero() && !at.After(now); at = s.next(at, config) {
+		last = at
+	}
+	return last
+}
+
+type ScheduleResponse struct {
+	Schedule
+	// Not set when the schedule is disabled or never runs again
+	NextRun *time.Time `json:",omitempty"`
+}
+
+func schedule_response(s Schedule) ScheduleResponse {
+	response := ScheduleResponse{Schedule: s}
+	if s.Enabled {
+		if next := s.next(time.Now(), schedule_config); !next.IsZero() {
+			response.NextRun = &next
+		}
+	}
+	return response
+}
+
+// Run the schedules every minute, next to the plug monitor.
+func run_scheduler(config ScheduleConfig, schedules ScheduleStore, plugs PlugStore) {
+	log.Info("Starting scheduler")
+	for {
+		now := time.Now()
+		// wake up at the start of the next minute
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		run_schedules(config, schedules, plugs, time.Now())
+	}
+}
+
+func run_schedules(config ScheduleConfig, schedules ScheduleStore, plugs PlugStore, now time.Time) {
+	stored, err := schedules.GetSchedules()
+	if err != nil {
+		log.Error("Could not read schedules: ", err)
+		return
+	}
+	for _, s := range stored {
+		if !s.Enabled {
+			continue
+		}
+		last := s.last_run(s.LastRun, now, config)
+		if last.IsZero() {
+			continue
+		}
+		if err := schedules.SetScheduleLastRun(s.Id, now); err != nil {
+			log.Error("Could not save schedule run: ", err)
+			continue
+		}
+
+		if late := now.Sub(last); late > SCHEDULE_GRACE {
+			if config.MissedRuns == MISSED_SKIP {
+				log.Warnf("Skipping run of schedule %d (%s) missed at %v", s.Id, s.Name, last)
+				continue
+			}
+			if config.MissedMaxDelay > 0 && late > config.MissedMaxDelay {
+				log.Warnf("Skipping run of schedule %d (%s) missed at %v, too late to catch up", s.Id, s.Name, last)
+				continue
+			}
+			log.Infof("Catching up run of schedule %d (%s) missed at %v", s.Id, s.Name, last)
+		}
+		go run_schedule(s, plugs)
+	}
+}
+
+func run_schedule(s Schedule, plugs PlugStore) {
+	plug, err := plugs.GetPlug(s.Plug)
+	if err != nil {
+		log.Warnf("Schedule %d (%s) could not run on %s: %s", s.Id, s.Name, s.Plug, err)
+		return
+	}
+	switch_relay(plug, RelayCommand{s.Action, s.Timer}, fmt.Sprintf("schedule %d (%s)", s.Id, s.Name))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleLastRun(t *testing.T) {
+	paris := must_load_location(t, "Europe/Paris")
+	config := ScheduleConfig{location: paris, MissedRuns: MISSED_LAST}
+	now := time.Date(2024, 5, 15, 12, 34, 20, 0, paris)
+	tests := []struct {
+		name     string
+		schedule Schedule
+		after    time.Time
+		now      time.Time
+		expected time.Time
+	}{
+		{"every minute, a minute ago", Schedule{Cron: "* * * * *"}, now.Add(-time.Minute), now,
+			time.Date(2024, 5, 15, 12, 34, 0, 0, paris)},
+		{"every minute, a year ago", Schedule{Cron: "* * * * *"}, now.AddDate(-1, 0, 0), now,
+			time.Date(2024, 5, 15, 12, 34, 0, 0, paris)},
+		{"every minute of 6h, a year ago", Schedule{Cron: "* 6 * * *"}, now.AddDate(-1, 0, 0), now,
+			time.Date(2024, 5, 15, 6, 59, 0, 0, paris)},
+		{"daily, a week ago", Schedule{Cron: "30 6 * * *"}, now.AddDate(0, 0, -7), now,
+			time.Date(2024, 5, 15, 6, 30, 0, 0, paris)},
+		{"weekly, a month ago", Schedule{Time: "07:15", Weekdays: []string{"mon"}}, now.AddDate(0, -1, 0), now,
+			time.Date(2024, 5, 13, 7, 15, 0, 0, paris)},
+		{"yearly, two years ago", Schedule{Cron: "0 0 1 jan *"}, now.AddDate(-2, 0, 0), now,
+			time.Date(2024, 1, 1, 0, 0, 0, 0, paris)},
+		{"no run since", Schedule{Cron: "0 13 * * *"}, time.Date(2024, 5, 14, 13, 0, 0, 0, paris), now,
+			time.Time{}},
+		{"not yet", Schedule{Cron: "0 0 1 jan *"}, now.Add(-time.Hour), now, time.Time{}},
+		// on March 31 2024, the clock moves from 02:00 to 03:00
+		{"skipped by the clock", Schedule{Cron: "30 2 * * *"}, time.Date(2024, 3, 31, 1, 0, 0, 0, paris),
+			time.Date(2024, 3, 31, 3, 5, 0, 0, paris), time.Date(2024, 3, 31, 3, 0, 0, 0, paris)},
+	}
+	for _, test := range tests {
+		if last := test.schedule.last_run(test.after, test.now, config); !last.Equal(test.expected) {
+			t.Errorf("%s: last run %v, want %v", test.name, last, test.expected)
+		}
+	}
+}
@@ -10,10 +10,61 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// get plug description from /settings and /status
+// Driver for Shelly plugs, of all generations.
+type ShellyDriver struct{}
+
+func init() {
+	register_plug_driver(ShellyDriver{})
+}
+
+func (ShellyDriver) Name() string {
+	return "shelly"
+}
+
+func (ShellyDriver) Describe(plug_host string) (PlugDescription, error) {
+	return get_plug_desc(plug_host)
+}
+
+func (ShellyDriver) ReadMeter(plug_desc PlugDescription, plug_host string) (MeterInfo, error) {
+	return get_plug_energy_data(plug_desc, plug_host)
+}
+
+func (ShellyDriver) SetRelay(plug_desc PlugDescription, plug_host string, on bool, timer int) (bool, error) {
+	if plug_desc.Generation >= SHELLY_GEN2 {
+		return set_rpc_relay(plug_host, on, timer)
+	}
+	turn := "off"
+	if on {
+		turn = "on"
+	}
+	params := "turn=" + turn
+	if timer > 0 {
+		params += fmt.Sprintf("&timer=%d", timer)
+	}
+	return set_relay(plug_host, params)
+}
+
+func (ShellyDriver) ToggleRelay(plug_desc PlugDescription, plug_host string) (bool, error) {
+	if plug_desc.Generation >= SHELLY_GEN2 {
+		return toggle_rpc_relay(plug_host)
+	}
+	return set_relay(plug_host, "turn=toggle")
+}
+
+// get plug description from /settings and /status, or from the RPC API
+// for Gen2 plugs
 func get_plug_desc(plug_host string) (PlugDescription, error) {
 	var plug_desc PlugDescription
 
+	generation, err := get_plug_generation(plug_host)
+	if err != nil {
+		log.Println("Error getting plug generation: ", err)
+		return plug_desc, err
+	}
+	if generation >= SHELLY_GEN2 {
+		return get_rpc_plug_desc(plug_host)
+	}
+
 	status, err := get_plug_status(plug_host)
 	if err != nil {
 		log.Println("Error getting response: ", err)
@@ -35,6 +86,7 @@ func get_plug_desc(plug_host string) (PlugDescription, error) {
 		AddrV4:       status.Wifi_sta.Ip,
 		Mac:          status.Mac,
 		Is_available: true,
+		Generation:   SHELLY_GEN1,
 	}
 
 	// log.Println("   POWER: ", m.Power)
@@ -120,6 +172,18 @@ type MeterInfo struct {
 	Timestamp uint64
 	Total     uint32
 	Counters  [3]float64
+	// Only reported by Gen2 plugs
+	Voltage     float64
+	Current     float64
+	Temperature float64
+}
+
+// Get energy data with the API of the plug generation.
+func get_plug_energy_data(plug_desc PlugDescription, plug_host string) (MeterInfo, error) {
+	if plug_desc.Generation >= SHELLY_GEN2 {
+		return get_rpc_energy_data(plug_host)
+	}
+	return get_energy_data(plug_host)
 }
 
 func get_energy_data(plug_host string) (MeterInfo, error) {
@@ -151,3 +215,35 @@ func get_energy_data(plug_host string) (MeterInfo, error) {
 	log.Debug()
 	return m, nil
 }
+
+// type for GET requests <plug>/relay/0
+type RelayInfo struct {
+	Ison bool
+}
+
+// Switch the relay with `http://<plug>/relay/0?<params>`, return its state.
+func set_relay(plug_host string, params string) (bool, error) {
+	var relay RelayInfo
+	url := fmt.Sprintf("http://%v/relay/0?%s", plug_host, params)
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Println("Error getting response for /relay: ", plug_host, err)
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("Error reading relay response: ", err)
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("relay command failed: %d %s", resp.StatusCode, body)
+	}
+	err = json.Unmarshal(body, &relay)
+	if err != nil {
+		log.Println("ERROR parsing relay response: ", err)
+		return false, err
+	}
+	return relay.Ison, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Client for the JSON-RPC API of Shelly Gen2 and Gen3 devices
+// (Plus Plug S, Plug S Gen3...), available over HTTP on
+// `http://<plug>/rpc/<method>`.
+// See https://shelly-api-docs.shelly.cloud/gen2/
+
+const (
+	SHELLY_GEN1 = 1
+	SHELLY_GEN2 = 2
+)
+
+// Call a RPC method of a Gen2 device with GET and decode its result.
+func shelly_rpc(plug_host string, method string, params string, result interface{}) error {
+	url := fmt.Sprintf("http://%v/rpc/%s", plug_host, method)
+	if params != "" {
+		url += "?" + params
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Println("Error getting response for ", method, ": ", plug_host, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("Error reading ", method, " response: ", err)
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed: %d %s", method, resp.StatusCode, body)
+	}
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		log.Println("ERROR parsing ", method, " response: ", err)
+		return err
+	}
+	return nil
+}
+
+// type for GET <plug>/shelly, served by all generations, `Gen` is only
+// set from Gen2 on.
+type ShellyInfo struct {
+	Gen  int
+	Mac  string
+	Type string
+}
+
+// Detect the generation of a plug from `http://<plug>/shelly`.
+func get_plug_generation(plug_host string) (int, error) {
+	var info ShellyInfo
+	url := fmt.Sprintf("http://%v/shelly", plug_host)
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Println("Error getting response for /shelly: ", plug_host, err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("Error reading shelly response: ", err)
+		return 0, err
+	}
+	err = json.Unmarshal(body, &info)
+	if err != nil {
+		log.Println("ERROR parsing shelly response: ", err)
+		return 0, err
+	}
+	if info.Gen >= SHELLY_GEN2 {
+		return info.Gen, nil
+	}
+	return SHELLY_GEN1, nil
+}
+
+// type for Shelly.GetDeviceInfo
+type RpcDeviceInfo struct {
+	Name  string
+	Id    string
+	Mac   string
+	Model string
+	Gen   int
+	App   string
+}
+
+// type for Switch.GetConfig
+type RpcSwitchConfig struct {
+	Name string
+}
+
+// type for Switch.GetStatus
+type RpcSwitchStatus struct {
+	Id      int
+	Output  bool
+	Apower  float64
+	Voltage float64
+	Current float64
+	Aenergy struct {
+		// in Wh
+		Total float64
+	}
+	Temperature struct {
+		TC *float64
+	}
+}
+
+// get plug description from Shelly.GetDeviceInfo and Switch.GetConfig
+func get_rpc_plug_desc(plug_host string) (PlugDescription, error) {
+	var plug_desc PlugDescription
+
+	var info RpcDeviceInfo
+	if err := shelly_rpc(plug_host, "Shelly.GetDeviceInfo", "", &info); err != nil {
+		return plug_desc, err
+	}
+	// the switch name is more specific, the device name is used if unset
+	name := info.Name
+	var config RpcSwitchConfig
+	if err := shelly_rpc(plug_host, "Switch.GetConfig", "id=0", &config); err == nil && config.Name != "" {
+		name = config.Name
+	}
+
+	plug_desc = PlugDescription{
+		Id:           info.Mac,
+		Hostname:     info.Id,
+		Name:         name,
+		Type:         info.Model,
+		LastSeen:     time.Now(),
+		AddrV4:       plug_host,
+		Mac:          info.Mac,
+		Is_available: true,
+		Generation:   info.Gen,
+	}
+	return plug_desc, nil
+}
+
+// get energy data from Switch.GetStatus, mapped to a Gen1 MeterInfo
+func get_rpc_energy_data(plug_host string) (MeterInfo, error) {
+	var m MeterInfo
+	var status RpcSwitchStatus
+	if err := shelly_rpc(plug_host, "Switch.GetStatus", "id=0", &status); err != nil {
+		return m, err
+	}
+
+	m = MeterInfo{
+		Power:   status.Apower,
+		Voltage: status.Voltage,
+		Current: status.Current,
+		// Wh to Wmin
+		Total:     uint32(status.Aenergy.Total * 60),
+		Is_valid:  true,
+		Timestamp: uint64(time.Now().Unix()),
+	}
+	if status.Temperature.TC != nil {
+		m.Temperature = *status.Temperature.TC
+	}
+	return m, nil
+}
+
+// type for Switch.Set and Switch.Toggle
+type RpcSwitchResult struct {
+	Was_on bool
+}
+
+// Switch the relay with Switch.Set, `timer` is its toggle_after.
+// Switch.Set only returns the previous state, the state of the relay is
+// read back with Switch.GetStatus as the device may not apply the request.
+func set_rpc_relay(plug_host string, on bool, timer int) (bool, error) {
+	var result RpcSwitchResult
+	params := fmt.Sprintf("id=0&on=%t", on)
+	if timer > 0 {
+		params += fmt.Sprintf("&toggle_after=%d", timer)
+	}
+	if err := shelly_rpc(plug_host, "Switch.Set", params, &result); err != nil {
+		return false, err
+	}
+	var status RpcSwitchStatus
+	if err := shelly_rpc(plug_host, "Switch.GetStatus", "id=0", &status); err != nil {
+		return false, err
+	}
+	return status.Output, nil
+}
+
+func toggle_rpc_relay(plug_host string) (bool, error) {
+	var result RpcSwitchResult
+	if err := shelly_rpc(plug_host, "Switch.Toggle", "id=0", &result); err != nil {
+		return false, err
+	}
+	return !result.Was_on, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Fake Gen2 plug whose relay only switches on when `switches` is set,
+// returns its host.
+func fake_rpc_plug(t *testing.T, switches bool) string {
+	output := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rpc/Switch.Set":
+			fmt.Fprintf(w, `{"was_on": %t}`, output)
+			output = switches && r.URL.Query().Get("on") == "true"
+		case "/rpc/Switch.GetStatus":
+			fmt.Fprintf(w, `{"id": 0, "output": %t, "apower": 0}`, output)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// The state returned is the one of the relay, not the one requested.
+func TestRpcSetRelay(t *testing.T) {
+	plug := PlugDescription{Generation: SHELLY_GEN2}
+	for _, switches := range []bool{true, false} {
+		host := fake_rpc_plug(t, switches)
+		on, err := ShellyDriver{}.SetRelay(plug, host, true, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if on != switches {
+			t.Errorf("relay switching %v: state %v after switching on", switches, on)
+		}
+	}
+}
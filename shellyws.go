@@ -0,0 +1,502 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Shelly Gen2 devices can connect out to a WebSocket server ("Outbound
+// WebSocket" in their settings, `ws://<plugmeter>:<port>/shelly?token=<token>`)
+// and send their status as JSON-RPC notifications: NotifyFullStatus once
+// connected, then NotifyStatus with the changed values only.
+// Connections must carry the shared token, devices are then accepted by
+// their id (the `src` of their frames, such as
+// "shellyplugsg3-ddeeff001122"). They are described with RPC requests
+// sent over the same connection, and are available as long as they stay
+// connected.
+// See https://shelly-api-docs.shelly.cloud/gen2/General/RPCChannels#outbound-websocket
+
+const (
+	WS_PATH = "/shelly"
+	// a connection is closed when nothing, pongs included, was received
+	// for this long
+	WS_READ_TIMEOUT  = 90 * time.Second
+	WS_PING_PERIOD   = 30 * time.Second
+	WS_WRITE_TIMEOUT = 10 * time.Second
+
+	// ids of the RPC requests sent to devices
+	WS_REQUEST_DEVICE_INFO   = 1
+	WS_REQUEST_SWITCH_CONFIG = 2
+	// first id of the calls made through the API
+	WS_FIRST_CALL_ID = 100
+	WS_CALL_TIMEOUT  = 10 * time.Second
+)
+
+var ErrNotConnected = errors.New("device is not connected")
+
+// A JSON-RPC frame, either a notification, a request or a response.
+type wsFrame struct {
+	Id     int             `json:"id,omitempty"`
+	Src    string          `json:"src"`
+	Dst    string          `json:"dst,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *struct {
+		Code    int
+		Message string
+	} `json:"error,omitempty"`
+}
+
+// Values of the switch in a status notification, only the changed ones
+// are set in NotifyStatus.
+type wsSwitchStatus struct {
+	Apower  *float64
+	Voltage *float64
+	Current *float64
+	Aenergy *struct {
+		// in Wh
+		Total float64
+	}
+	Temperature *struct {
+		TC *float64
+	}
+}
+
+type wsStatus struct {
+	// in seconds
+	Ts     float64
+	Switch *wsSwitchStatus `json:"switch:0"`
+	Wifi   *struct {
+		Sta_ip string
+	}
+}
+
+// Connection state of an allowed device, served on the API.
+type WsDeviceState struct {
+	Id             string
+	Mac            string `json:",omitempty"`
+	Connected      bool
+	RemoteAddr     string     `json:",omitempty"`
+	ConnectedSince *time.Time `json:",omitempty"`
+	LastMessage    *time.Time `json:",omitempty"`
+}
+
+type ShellyWsServer struct {
+	// shared secret of the devices, the `token` parameter of their URL
+	token   string
+	mutex   sync.Mutex
+	devices map[string]*WsDeviceState
+	// current connection of each device
+	conns        map[string]*wsConnection
+	measurements chan Measure
+	upgrader     websocket.Upgrader
+}
+
+// nil when the WebSocket server is disabled
+var shelly_ws *ShellyWsServer
+
+func new_shelly_ws_server(token string, allowed_devices []string, measurements chan Measure) (*ShellyWsServer, error) {
+	if token == "" {
+		// the id of a device is not a secret, it is part of its hostname
+		return nil, errors.New("a token is required, see plugs.websocket.token")
+	}
+	s := &ShellyWsServer{
+		token:        token,
+		devices:      make(map[string]*WsDeviceState),
+		conns:        make(map[string]*wsConnection),
+		measurements: measurements,
+		// devices do not send an Origin header
+		upgrader: websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }},
+	}
+	for _, id := range allowed_devices {
+		id = strings.ToLower(id)
+		s.devices[id] = &WsDeviceState{Id: id}
+	}
+	if len(s.devices) == 0 {
+		log.Warn("No device is allowed to connect to the WebSocket server, see plugs.websocket.devices")
+	}
+	return s, nil
+}
+
+// Serve the WebSocket endpoint on its own address.
+func (s *ShellyWsServer) listen(address string, port int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(WS_PATH, s.handle)
+	addr := fmt.Sprintf("%s:%d", address, port)
+	log.Infof("Listening for Shelly WebSocket connections on ws://%s%s", addr, WS_PATH)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error("Shelly WebSocket server stopped: ", err)
+	}
+}
+
+// Connection states of the allowed devices, sorted by id.
+func (s *ShellyWsServer) States() []WsDeviceState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	states := make([]WsDeviceState, 0, len(s.devices))
+	for _, state := range s.devices {
+		states = append(states, *state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Id < states[j].Id })
+	return states
+}
+
+// A device connection, with the state built from its frames.
+type wsConnection struct {
+	server      *ShellyWsServer
+	conn        *websocket.Conn
+	write_mutex sync.Mutex
+	device_id   string
+	remote_host string
+	// address of the device on its own network
+	sta_ip string
+
+	// calls waiting for their response, by request id
+	calls_mutex sync.Mutex
+	next_call   int
+	calls       map[int]chan wsFrame
+
+	info      *RpcDeviceInfo
+	plug_desc *PlugDescription
+	// last known values, merged from the notifications
+	power       *float64
+	energy      *float64
+	voltage     float64
+	current     float64
+	temperature float64
+}
+
+func (s *ShellyWsServer) handle(w http.ResponseWriter, r *http.Request) {
+	remote_host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(s.token)) != 1 {
+		log.Warnf("Rejecting WebSocket connection from %s, invalid token", remote_host)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warn("WebSocket upgrade failed: ", err)
+		return
+	}
+	c := &wsConnection{server: s, conn: conn, next_call: WS_FIRST_CALL_ID, calls: make(map[int]chan wsFrame)}
+	c.remote_host = remote_host
+	c.run()
+}
+
+func (c *wsConnection) write(frame interface{}) error {
+	c.write_mutex.Lock()
+	defer c.write_mutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+	return c.conn.WriteJSON(frame)
+}
+
+func (c *wsConnection) ping(stop chan bool) {
+	ticker := time.NewTicker(WS_PING_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.write_mutex.Lock()
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WS_WRITE_TIMEOUT))
+			c.write_mutex.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Read frames until the connection is closed.
+func (c *wsConnection) run() {
+	defer c.conn.Close()
+	c.conn.SetReadDeadline(time.Now().Add(WS_READ_TIMEOUT))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(WS_READ_TIMEOUT))
+	})
+	stop := make(chan bool)
+	defer close(stop)
+	go c.ping(stop)
+
+	for {
+		var frame wsFrame
+		if err := c.conn.ReadJSON(&frame); err != nil {
+			if c.device_id != "" {
+				log.Infof("Shelly %s disconnected: %s", c.device_id, err)
+				c.server.disconnected(c)
+			}
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(WS_READ_TIMEOUT))
+
+		if c.device_id == "" {
+			if !c.server.connected(c, strings.ToLower(frame.Src)) {
+				log.Warnf("Rejecting WebSocket connection of %q from %s, not an allowed device", frame.Src, c.remote_host)
+				return
+			}
+			log.Infof("Shelly %s connected from %s", c.device_id, c.remote_host)
+			c.request(WS_REQUEST_DEVICE_INFO, "Shelly.GetDeviceInfo", nil)
+		} else if strings.ToLower(frame.Src) != c.device_id {
+			log.Warnf("Ignoring frame of %q on the connection of %s", frame.Src, c.device_id)
+			continue
+		}
+		c.server.received(c)
+
+		switch {
+		case frame.Id != 0 && frame.Method == "":
+			c.handle_response(frame)
+		case frame.Method == "NotifyStatus" || frame.Method == "NotifyFullStatus":
+			c.handle_status(frame.Params)
+		}
+	}
+}
+
+func (c *wsConnection) request(id int, method string, params interface{}) {
+	request := map[string]interface{}{"id": id, "src": "plugmeter", "method": method}
+	if params != nil {
+		request["params"] = params
+	}
+	if err := c.write(request); err != nil {
+		log.Warnf("Could not send %s to %s: %s", method, c.device_id, err)
+	}
+}
+
+func (c *wsConnection) handle_response(frame wsFrame) {
+	if frame.Id >= WS_FIRST_CALL_ID {
+		c.calls_mutex.Lock()
+		call, ok := c.calls[frame.Id]
+		delete(c.calls, frame.Id)
+		c.calls_mutex.Unlock()
+		if ok {
+			call <- frame
+		}
+		return
+	}
+	if frame.Error != nil {
+		log.Warnf("Request %d to %s failed: %s", frame.Id, c.device_id, frame.Error.Message)
+	}
+	switch frame.Id {
+	case WS_REQUEST_DEVICE_INFO:
+		var info RpcDeviceInfo
+		if frame.Error != nil || json.Unmarshal(frame.Result, &info) != nil || info.Mac == "" {
+			log.Warnf("Could not describe %s", c.device_id)
+			return
+		}
+		c.info = &info
+		c.request(WS_REQUEST_SWITCH_CONFIG, "Switch.GetConfig", map[string]int{"id": 0})
+	case WS_REQUEST_SWITCH_CONFIG:
+		if c.info == nil {
+			return
+		}
+		// the switch name is more specific, the device name is used if unset
+		name := c.info.Name
+		var config RpcSwitchConfig
+		if frame.Error == nil && json.Unmarshal(frame.Result, &config) == nil && config.Name != "" {
+			name = config.Name
+		}
+		addr := c.remote_host
+		if c.sta_ip != "" {
+			addr = c.sta_ip
+		}
+		c.plug_desc = &PlugDescription{
+			Id:           c.info.Mac,
+			Hostname:     c.info.Id,
+			Name:         name,
+			Type:         c.info.Model,
+			LastSeen:     time.Now(),
+			AddrV4:       addr,
+			Mac:          c.info.Mac,
+			Is_available: true,
+			Generation:   c.info.Gen,
+			Driver:       "shelly",
+		}
+		log.Debugf("Plug info from WebSocket: %v", *c.plug_desc)
+		if err := store.PersistPlug(*c.plug_desc); err != nil {
+			log.Error(err)
+		}
+		notify_plug_described(*c.plug_desc)
+		c.server.described(c)
+	}
+}
+
+// Merge the values of a notification, and send a measurement once the
+// plug is described.
+func (c *wsConnection) handle_status(params json.RawMessage) {
+	var status wsStatus
+	if err := json.Unmarshal(params, &status); err != nil {
+		log.Warnf("Could not parse status of %s: %s", c.device_id, err)
+		return
+	}
+	if status.Wifi != nil && status.Wifi.Sta_ip != "" {
+		c.sta_ip = status.Wifi.Sta_ip
+	}
+	sw := status.Switch
+	if sw == nil {
+		return
+	}
+	if sw.Apower != nil {
+		c.power = sw.Apower
+	}
+	if sw.Aenergy != nil {
+		c.energy = &sw.Aenergy.Total
+	}
+	if sw.Voltage != nil {
+		c.voltage = *sw.Voltage
+	}
+	if sw.Current != nil {
+		c.current = *sw.Current
+	}
+	if sw.Temperature != nil && sw.Temperature.TC != nil {
+		c.temperature = *sw.Temperature.TC
+	}
+	if c.plug_desc == nil || c.power == nil || c.energy == nil {
+		return
+	}
+
+	timestamp := uint64(status.Ts)
+	if timestamp == 0 {
+		timestamp = uint64(time.Now().Unix())
+	}
+	c.server.measurements <- Measure{
+		Id:          c.plug_desc.Mac,
+		Power:       *c.power,
+		Energy:      uint32(*c.energy * 60),
+		Plug:        c.plug_desc.AddrV4,
+		Timestamp:   timestamp,
+		Voltage:     c.voltage,
+		Current:     c.current,
+		Temperature: c.temperature,
+	}
+}
+
+// Register the connection of an allowed device, closing its previous
+// connection if any.
+func (s *ShellyWsServer) connected(c *wsConnection, device_id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, ok := s.devices[device_id]
+	if !ok {
+		return false
+	}
+	if previous, ok := s.conns[device_id]; ok {
+		previous.conn.Close()
+	}
+	c.device_id = device_id
+	s.conns[device_id] = c
+	now := time.Now()
+	state.Connected = true
+	state.RemoteAddr = c.remote_host
+	state.ConnectedSince = &now
+	return true
+}
+
+func (s *ShellyWsServer) received(c *wsConnection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	s.devices[c.device_id].LastMessage = &now
+}
+
+func (s *ShellyWsServer) described(c *wsConnection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.devices[c.device_id].Mac = c.plug_desc.Mac
+}
+
+// Mark the plug unavailable, unless the device already reconnected.
+func (s *ShellyWsServer) disconnected(c *wsConnection) {
+	s.mutex.Lock()
+	if s.conns[c.device_id] != c {
+		s.mutex.Unlock()
+		return
+	}
+	delete(s.conns, c.device_id)
+	state := s.devices[c.device_id]
+	state.Connected = false
+	state.ConnectedSince = nil
+	s.mutex.Unlock()
+
+	if c.plug_desc != nil {
+		if err := store.UpdatePlugAvailability(c.plug_desc.Id, false); err != nil {
+			log.Error(err)
+		}
+		notify_plug_availability(c.plug_desc.Id, false)
+	}
+}
+
+// Whether a plug is connected and described, so that it does not need to
+// be polled.
+func (s *ShellyWsServer) is_connected(mac string) bool {
+	if s == nil {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, state := range s.devices {
+		if state.Connected && state.Mac == mac {
+			return true
+		}
+	}
+	return false
+}
+
+// Call a RPC method of a connected plug, by mac address, and decode its
+// result.
+func (s *ShellyWsServer) call(mac string, method string, params interface{}, result interface{}) error {
+	if s == nil {
+		return ErrNotConnected
+	}
+	var c *wsConnection
+	s.mutex.Lock()
+	for id, state := range s.devices {
+		if state.Connected && state.Mac == mac {
+			c = s.conns[id]
+		}
+	}
+	s.mutex.Unlock()
+	if c == nil {
+		return ErrNotConnected
+	}
+
+	response := make(chan wsFrame, 1)
+	c.calls_mutex.Lock()
+	id := c.next_call
+	c.next_call++
+	c.calls[id] = response
+	c.calls_mutex.Unlock()
+	defer func() {
+		c.calls_mutex.Lock()
+		delete(c.calls, id)
+		c.calls_mutex.Unlock()
+	}()
+
+	request := map[string]interface{}{"id": id, "src": "plugmeter", "method": method}
+	if params != nil {
+		request["params"] = params
+	}
+	if err := c.write(request); err != nil {
+		return err
+	}
+	select {
+	case frame := <-response:
+		if frame.Error != nil {
+			return fmt.Errorf("%s failed: %d %s", method, frame.Error.Code, frame.Error.Message)
+		}
+		return json.Unmarshal(frame.Result, result)
+	case <-time.After(WS_CALL_TIMEOUT):
+		return fmt.Errorf("%s timed out", method)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	viper "github.com/spf13/viper"
+)
+
+const WS_TEST_DEVICE = "shellyplugsg3-ddeeff001122"
+
+// WebSocket server allowing WS_TEST_DEVICE with the token "secret",
+// returns its URL without the token.
+func test_ws_server(t *testing.T) string {
+	s, err := new_shelly_ws_server("secret", []string{WS_TEST_DEVICE}, make(chan Measure, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http") + WS_PATH
+}
+
+func TestShellyWsRequiresToken(t *testing.T) {
+	if _, err := new_shelly_ws_server("", []string{WS_TEST_DEVICE}, nil); err == nil {
+		t.Error("server created without a token")
+	}
+}
+
+func TestShellyWsRejectsInvalidTokens(t *testing.T) {
+	url := test_ws_server(t)
+	for _, suffix := range []string{"", "?token=", "?token=wrong", "?token=secret2", "?secret"} {
+		conn, resp, err := websocket.DefaultDialer.Dial(url+suffix, nil)
+		if err == nil {
+			conn.Close()
+			t.Errorf("connection to %s was accepted", suffix)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("connection to %s: %v, want 401", suffix, err)
+		}
+	}
+}
+
+func TestShellyWsAcceptsAllowedDevices(t *testing.T) {
+	url := test_ws_server(t)
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?token=secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON(wsFrame{Src: WS_TEST_DEVICE, Method: "NotifyFullStatus"}); err != nil {
+		t.Fatal(err)
+	}
+	// the device is described once connected
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var request wsFrame
+	if err := conn.ReadJSON(&request); err != nil {
+		t.Fatal(err)
+	}
+	if request.Method != "Shelly.GetDeviceInfo" {
+		t.Errorf("request: %+v", request)
+	}
+}
+
+func TestShellyWsRejectsUnknownDevices(t *testing.T) {
+	url := test_ws_server(t)
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?token=secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON(wsFrame{Src: "shellyplugsg3-000000000000", Method: "NotifyFullStatus"}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var frame wsFrame
+	if err := conn.ReadJSON(&frame); err == nil {
+		t.Errorf("unknown device got %+v", frame)
+	}
+}
+
+// Plug answering to polls with a fixed power, counting them.
+type countingDriver struct {
+	mac   string
+	polls *int32
+}
+
+func (d countingDriver) Name() string { return "counting" }
+
+func (d countingDriver) Describe(plug_host string) (PlugDescription, error) {
+	return PlugDescription{Id: d.mac, Mac: d.mac, Name: "Desk", Is_available: true}, nil
+}
+
+func (d countingDriver) ReadMeter(plug_desc PlugDescription, plug_host string) (MeterInfo, error) {
+	atomic.AddInt32(d.polls, 1)
+	return MeterInfo{Power: 1, Timestamp: uint64(time.Now().Unix()), Is_valid: true}, nil
+}
+
+// Connect WS_TEST_DEVICE and answer the requests describing it.
+func connect_ws_device(t *testing.T, url string, mac string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?token=secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.WriteJSON(wsFrame{Src: WS_TEST_DEVICE, Method: "NotifyFullStatus"}); err != nil {
+		t.Fatal(err)
+	}
+	results := map[int]string{
+		WS_REQUEST_DEVICE_INFO:   `{"id": "` + WS_TEST_DEVICE + `", "mac": "` + mac + `", "model": "S3PL-00112EU", "gen": 3}`,
+		WS_REQUEST_SWITCH_CONFIG: `{"name": "Desk"}`,
+	}
+	for range results {
+		var request wsFrame
+		if err := conn.ReadJSON(&request); err != nil {
+			t.Fatal(err)
+		}
+		response := wsFrame{Id: request.Id, Src: WS_TEST_DEVICE, Result: json.RawMessage(results[request.Id])}
+		if err := conn.WriteJSON(response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conn
+}
+
+// A plug connected to the WebSocket server is not polled, each status
+// update is a single measurement. Polling resumes once it disconnects.
+func TestShellyWsSuspendsPolling(t *testing.T) {
+	const mac = "DDEEFF001122"
+	var err error
+	previous_store, previous_ws := store, shelly_ws
+	store, err = open_bolt_store(filepath.Join(t.TempDir(), "plugmeter.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	measurements := make(chan Measure, 100)
+	shelly_ws, err = new_shelly_ws_server("secret", []string{WS_TEST_DEVICE}, measurements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var polls int32
+	plug_drivers["counting"] = countingDriver{mac: mac, polls: &polls}
+	viper.Set("plugs.poll_period", 1)
+	defer func() {
+		store.Close()
+		store, shelly_ws = previous_store, previous_ws
+		delete(plug_drivers, "counting")
+		viper.Set("plugs.poll_period", PLUG_POLL_PERIOD)
+	}()
+	server := httptest.NewServer(http.HandlerFunc(shelly_ws.handle))
+	defer server.Close()
+
+	conn := connect_ws_device(t, "ws"+strings.TrimPrefix(server.URL, "http")+WS_PATH, mac)
+	for !shelly_ws.is_connected(mac) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	done := make(chan bool)
+	defer close(done)
+	go poll_plug(PlugEntry{Id: "test", DetectionId: "test", AddrV4: net.IPv4(127, 0, 0, 1), Driver: "counting"},
+		done, measurements, make(chan PlugEvent, 1))
+
+	for i := 0; i < 5; i++ {
+		status := fmt.Sprintf(`{"ts": %d, "switch:0": {"apower": %d, "aenergy": {"total": %d}}}`, 1700000000+i, 10+i, 100+i)
+		if err := conn.WriteJSON(wsFrame{Src: WS_TEST_DEVICE, Method: "NotifyStatus", Params: json.RawMessage(status)}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if count := len(measurements); count != 5 {
+		t.Errorf("%d measurements for 5 status updates", count)
+	}
+	if count := atomic.LoadInt32(&polls); count != 0 {
+		t.Errorf("connected plug was polled %d times", count)
+	}
+
+	conn.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for atomic.LoadInt32(&polls) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&polls) == 0 {
+		t.Error("polling did not resume once the plug disconnected")
+	}
+}
@@ -0,0 +1,834 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	_ "modernc.org/sqlite"
+)
+
+// Store implementation backed by a SQLite database file, for users who
+// want to run SQL queries over their data.
+// Times are stored as unix timestamps (in seconds).
+type SqliteStore struct {
+	path string
+	db   *sql.DB
+}
+
+func open_sqlite_store(path string) (*SqliteStore, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening sqlite db %s: %s", path, err)
+	}
+	// SQLite only supports a single writer, serialize all accesses
+	// instead of retrying on busy errors.
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening sqlite db %s: %s", path, err)
+	}
+	return &SqliteStore{path: path, db: db}, nil
+}
+
+func (s *SqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// Run `fn` in a transaction, committed if it returns no error.
+func (s *SqliteStore) update(fn func(*sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SqliteStore) PersistRecords(measures []Measure) error {
+	err := s.update(func(tx *sql.Tx) error {
+		for _, measure := range measures {
+			_, err := tx.Exec(`INSERT INTO measurements (`+sqlite_measure_columns+`)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				measure.Id, measure.Timestamp, measure.Power, measure.Energy, measure.Plug, measure.Cumulative,
+				measure.Voltage, measure.Current, measure.Temperature)
+			if err != nil {
+				return fmt.Errorf("insert Measure: %d %s", measure.Timestamp, err)
+			}
+			if err := sqlite_update_rollups(tx, measure); err != nil {
+				return err
+			}
+		}
+		return sqlite_put_energy_counters(tx, counters_of(measures))
+	})
+	if err != nil {
+		return fmt.Errorf("persist %d records: %s", len(measures), err)
+	}
+	return nil
+}
+
+func (s *SqliteStore) PersistPlug(plug_desc PlugDescription) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO plugs (`+sqlite_plug_columns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		plug_desc.Mac, plug_desc.Id, plug_desc.Hostname, plug_desc.Name, plug_desc.Type,
+		plug_desc.LastSeen.Unix(), plug_desc.AddrV4, plug_desc.Is_available, plug_desc.Generation,
+		plug_desc.Driver)
+	if err != nil {
+		return fmt.Errorf("persist plug %v: %s", plug_desc, err)
+	}
+	return nil
+}
+
+const sqlite_plug_columns = `mac, id, hostname, name, type, last_seen, addr_v4, is_available, generation, driver`
+
+func scan_plug(row interface{ Scan(...interface{}) error }) (plug PlugDescription, err error) {
+	var last_seen int64
+	err = row.Scan(&plug.Mac, &plug.Id, &plug.Hostname, &plug.Name, &plug.Type,
+		&last_seen, &plug.AddrV4, &plug.Is_available, &plug.Generation, &plug.Driver)
+	plug.LastSeen = time.Unix(last_seen, 0)
+	return plug, err
+}
+
+func (s *SqliteStore) GetPlugs() (plugs []PlugDescription, err error) {
+	plugs = make([]PlugDescription, 0, 10)
+	rows, err := s.db.Query(`SELECT ` + sqlite_plug_columns + ` FROM plugs ORDER BY mac`)
+	if err != nil {
+		return plugs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		plug, err := scan_plug(rows)
+		if err != nil {
+			return plugs, err
+		}
+		plugs = append(plugs, plug)
+	}
+	return plugs, rows.Err()
+}
+
+func (s *SqliteStore) GetPlug(plugId string) (PlugDescription, error) {
+	row := s.db.QueryRow(`SELECT `+sqlite_plug_columns+` FROM plugs WHERE mac = ?`, plugId)
+	plug, err := scan_plug(row)
+	if err == sql.ErrNoRows {
+		return plug, ErrPlugNotFound
+	}
+	return plug, err
+}
+
+func (s *SqliteStore) UpdatePlugAvailability(plugId string, is_available bool) error {
+	log.Debug("updt_plug_availability ", plugId)
+	var err error
+	if is_available {
+		_, err = s.db.Exec(`UPDATE plugs SET is_available = 1, last_seen = ? WHERE mac = ?`,
+			time.Now().Unix(), plugId)
+	} else {
+		_, err = s.db.Exec(`UPDATE plugs SET is_available = 0 WHERE mac = ?`, plugId)
+	}
+	if err != nil {
+		return fmt.Errorf("updating plug availability %s: %s", plugId, err)
+	}
+	return nil
+}
+
+func (s *SqliteStore) DeletePlug(plugId string) error {
+	res, err := s.db.Exec(`DELETE FROM plugs WHERE mac = ?`, plugId)
+	if err != nil {
+		return fmt.Errorf("deleting plug %s: %s", plugId, err)
+	}
+	if count, err := res.RowsAffected(); err == nil && count == 0 {
+		return ErrPlugNotFound
+	}
+	return nil
+}
+
+func (s *SqliteStore) GetMeasurements(plugId string, from time.Time, to time.Time, limit int) (measures []Measure, err error) {
+	measures = make([]Measure, 0)
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(`SELECT `+sqlite_measure_columns+` FROM measurements
+		WHERE plug = ? AND time >= ? AND time <= ? ORDER BY time, id LIMIT ?`,
+		plugId, from.Unix(), to.Unix(), limit)
+	if err != nil {
+		return measures, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m, err := scan_measure(rows)
+		if err != nil {
+			return measures, err
+		}
+		measures = append(measures, m)
+	}
+	return measures, rows.Err()
+}
+
+const sqlite_measure_columns = `plug, time, power, energy, addr, cumulative, voltage, current, temperature`
+
+func scan_measure(row interface{ Scan(...interface{}) error }) (m Measure, err error) {
+	err = row.Scan(&m.Id, &m.Timestamp, &m.Power, &m.Energy, &m.Plug, &m.Cumulative,
+		&m.Voltage, &m.Current, &m.Temperature)
+	return m, err
+}
+
+const sqlite_rollup_columns = `plug, resolution, start, count, power_sum, avg_power, min_power, max_power,
+	energy_delta, last_energy, last_timestamp`
+
+func scan_rollup(row interface{ Scan(...interface{}) error }) (r Rollup, err error) {
+	err = row.Scan(&r.Id, &r.Resolution, &r.Start, &r.Count, &r.PowerSum, &r.AvgPower,
+		&r.MinPower, &r.MaxPower, &r.EnergyDelta, &r.LastEnergy, &r.LastTimestamp)
+	return r, err
+}
+
+// Aggregate a measurement into the rollups of its plug, for every
+// resolution. See `update_rollups` for the bbolt equivalent.
+func sqlite_update_rollups(tx *sql.Tx, measure Measure) error {
+	for _, resolution := range ROLLUP_RESOLUTIONS {
+		start := rollup_start(resolution, measure.Timestamp)
+
+		row := tx.QueryRow(`SELECT `+sqlite_rollup_columns+` FROM rollups
+			WHERE plug = ? AND resolution = ? AND start = ?`, measure.Id, resolution, start)
+		rollup, err := scan_rollup(row)
+		if err == nil {
+			aggregate_measure(&rollup, measure, rollup.LastEnergy, rollup.LastTimestamp)
+		} else if err == sql.ErrNoRows {
+			rollup = new_rollup(resolution, measure)
+			// Energy consumed since the last reading of the previous period
+			// is accounted for in this period.
+			row := tx.QueryRow(`SELECT `+sqlite_rollup_columns+` FROM rollups
+				WHERE plug = ? AND resolution = ? ORDER BY start DESC LIMIT 1`, measure.Id, resolution)
+			previous, err := scan_rollup(row)
+			if err == nil {
+				aggregate_measure(&rollup, measure, previous.LastEnergy, previous.LastTimestamp)
+			} else if err == sql.ErrNoRows {
+				aggregate_measure(&rollup, measure, measure.Energy, 0)
+			} else {
+				return err
+			}
+		} else {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT OR REPLACE INTO rollups (`+sqlite_rollup_columns+`)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			rollup.Id, rollup.Resolution, rollup.Start, rollup.Count, rollup.PowerSum, rollup.AvgPower,
+			rollup.MinPower, rollup.MaxPower, rollup.EnergyDelta, rollup.LastEnergy, rollup.LastTimestamp)
+		if err != nil {
+			return fmt.Errorf("insert rollup: %d %s", start, err)
+		}
+	}
+	return nil
+}
+
+func (s *SqliteStore) GetRollups(plugId string, resolution string, from time.Time, to time.Time, limit int) (rollups []Rollup, err error) {
+	if !is_rollup_resolution(resolution) {
+		return nil, fmt.Errorf("invalid rollup resolution: %s", resolution)
+	}
+	rollups = make([]Rollup, 0)
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(`SELECT `+sqlite_rollup_columns+` FROM rollups
+		WHERE plug = ? AND resolution = ? AND start >= ? AND start <= ? ORDER BY start LIMIT ?`,
+		plugId, resolution, from.Unix(), to.Unix(), limit)
+	if err != nil {
+		return rollups, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rollup, err := scan_rollup(rows)
+		if err != nil {
+			return rollups, err
+		}
+		rollups = append(rollups, rollup)
+	}
+	return rollups, rows.Err()
+}
+
+func (s *SqliteStore) PutPrices(prices []Price) error {
+	err := s.update(func(tx *sql.Tx) error {
+		for _, price := range prices {
+			_, err := tx.Exec(`INSERT OR REPLACE INTO prices (start, price) VALUES (?, ?)`,
+				price.Start, price.Price)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("persist %d prices: %s", len(prices), err)
+	}
+	return nil
+}
+
+func (s *SqliteStore) GetPrices(from time.Time, to time.Time) (prices []Price, err error) {
+	prices = make([]Price, 0)
+	rows, err := s.db.Query(`SELECT start, price FROM prices WHERE start >= ? AND start <= ? ORDER BY start`,
+		from.Unix(), to.Unix())
+	if err != nil {
+		return prices, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var price Price
+		if err := rows.Scan(&price.Start, &price.Price); err != nil {
+			return prices, err
+		}
+		prices = append(prices, price)
+	}
+	return prices, rows.Err()
+}
+
+const sqlite_schedule_columns = `id, plug, name, enabled, action, timer, cron, weekdays, time, time_offset, last_run`
+
+func scan_schedule(row interface{ Scan(...interface{}) error }) (schedule Schedule, err error) {
+	var weekdays string
+	var last_run int64
+	err = row.Scan(&schedule.Id, &schedule.Plug, &schedule.Name, &schedule.Enabled, &schedule.Action,
+		&schedule.Timer, &schedule.Cron, &weekdays, &schedule.Time, &schedule.Offset, &last_run)
+	if weekdays != "" {
+		schedule.Weekdays = strings.Split(weekdays, ",")
+	}
+	schedule.LastRun = time.Unix(last_run, 0)
+	return schedule, err
+}
+
+func (s *SqliteStore) GetSchedules() (schedules []Schedule, err error) {
+	schedules = make([]Schedule, 0)
+	rows, err := s.db.Query(`SELECT ` + sqlite_schedule_columns + ` FROM schedules ORDER BY id`)
+	if err != nil {
+		return schedules, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		schedule, err := scan_schedule(rows)
+		if err != nil {
+			return schedules, err
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, rows.Err()
+}
+
+func (s *SqliteStore) GetSchedule(id uint64) (Schedule, error) {
+	row := s.db.QueryRow(`SELECT `+sqlite_schedule_columns+` FROM schedules WHERE id = ?`, id)
+	schedule, err := scan_schedule(row)
+	if err == sql.ErrNoRows {
+		return schedule, ErrScheduleNotFound
+	}
+	return schedule, err
+}
+
+func (s *SqliteStore) PutSchedule(schedule Schedule) (Schedule, error) {
+	values := []interface{}{schedule.Plug, schedule.Name, schedule.Enabled, schedule.Action, schedule.Timer,
+		schedule.Cron, strings.Join(schedule.Weekdays, ","), schedule.Time, schedule.Offset, schedule.LastRun.Unix()}
+	if schedule.Id == 0 {
+		res, err := s.db.Exec(`INSERT INTO schedules (plug, name, enabled, action, timer, cron, weekdays, time, time_offset, last_run)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, values...)
+		if err != nil {
+			return schedule, fmt.Errorf("inserting schedule: %s", err)
+		}
+		id, err := res.LastInsertId()
+		schedule.Id = uint64(id)
+		return schedule, err
+	}
+	res, err := s.db.Exec(`UPDATE schedules SET plug = ?, name = ?, enabled = ?, action = ?, timer = ?, cron = ?,
+		weekdays = ?, time = ?, time_offset = ?, last_run = ? WHERE id = ?`, append(values, schedule.Id)...)
+	if err != nil {
+		return schedule, fmt.Errorf("updating schedule %d: %s", schedule.Id, err)
+	}
+	if count, err := res.RowsAffected(); err == nil && count == 0 {
+		return schedule, ErrScheduleNotFound
+	}
+	return schedule, nil
+}
+
+func (s *SqliteStore) SetScheduleLastRun(id uint64, last_run time.Time) error {
+	res, err := s.db.Exec(`UPDATE schedules SET last_run = ? WHERE id = ?`, last_run.Unix(), id)
+	if err != nil {
+		return fmt.Errorf("updating schedule %d: %s", id, err)
+	}
+	if count, err := res.RowsAffected(); err == nil && count == 0 {
+		return ErrScheduleNotFound
+	}
+	return nil
+}
+
+func (s *SqliteStore) DeleteSchedule(id uint64) error {
+	res, err := s.db.Exec(`DELETE FROM schedules WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("deleting schedule %d: %s", id, err)
+	}
+	if count, err := res.RowsAffected(); err == nil && count == 0 {
+		return ErrScheduleNotFound
+	}
+	return nil
+}
+
+func (s *SqliteStore) GetRules() (rules []Rule, err error) {
+	rules = make([]Rule, 0)
+	rows, err := s.db.Query(`SELECT name, enabled, plug, condition, threshold, hysteresis, duration,
+		target, action, timer, cooldown, dry_run FROM rules ORDER BY name`)
+	if err != nil {
+		return rules, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rule Rule
+		if err := rows.Scan(&rule.Name, &rule.Enabled, &rule.Plug, &rule.Condition, &rule.Threshold,
+			&rule.Hysteresis, &rule.Duration, &rule.Target, &rule.Action, &rule.Timer, &rule.Cooldown,
+			&rule.DryRun); err != nil {
+			return rules, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func (s *SqliteStore) PutRule(rule Rule) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO rules (name, enabled, plug, condition, threshold, hysteresis,
+		duration, target, action, timer, cooldown, dry_run) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rule.Name, rule.Enabled, rule.Plug, rule.Condition, rule.Threshold, rule.Hysteresis,
+		rule.Duration, rule.Target, rule.Action, rule.Timer, rule.Cooldown, rule.DryRun)
+	if err != nil {
+		return fmt.Errorf("saving rule '%s': %s", rule.Name, err)
+	}
+	return nil
+}
+
+func (s *SqliteStore) DeleteRule(name string) error {
+	res, err := s.db.Exec(`DELETE FROM rules WHERE name = ?`, name)
+	if err != nil {
+		return fmt.Errorf("deleting rule '%s': %s", name, err)
+	}
+	if count, err := res.RowsAffected(); err == nil && count == 0 {
+		return ErrRuleNotFound
+	}
+	return nil
+}
+
+func (s *SqliteStore) PutRuleFiring(firing RuleFiring, keep int) error {
+	_, err := s.db.Exec(`INSERT INTO rule_firings (rule, time, plug, power, target, action, timer, dry_run,
+		state, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		firing.Rule, firing.Time.UnixNano(), firing.Plug, firing.Power, firing.Target, firing.Action,
+		firing.Timer, firing.DryRun, firing.State, firing.Error)
+	if err != nil {
+		return fmt.Errorf("saving firing of rule '%s': %s", firing.Rule, err)
+	}
+	if keep <= 0 {
+		return nil
+	}
+	_, err = s.db.Exec(`DELETE FROM rule_firings WHERE id <=
+		(SELECT id FROM rule_firings ORDER BY id DESC LIMIT 1 OFFSET ?)`, keep)
+	return err
+}
+
+func (s *SqliteStore) GetRuleFirings(rule string, limit int) (firings []RuleFiring, err error) {
+	firings = make([]RuleFiring, 0)
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(`SELECT rule, time, plug, power, target, action, timer, dry_run, state, error
+		FROM rule_firings WHERE ? = '' OR rule = ? ORDER BY id DESC LIMIT ?`, rule, rule, limit)
+	if err != nil {
+		return firings, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var firing RuleFiring
+		var ts int64
+		if err := rows.Scan(&firing.Rule, &ts, &firing.Plug, &firing.Power, &firing.Target, &firing.Action,
+			&firing.Timer, &firing.DryRun, &firing.State, &firing.Error); err != nil {
+			return firings, err
+		}
+		firing.Time = time.Unix(0, ts)
+		firings = append(firings, firing)
+	}
+	return firings, rows.Err()
+}
+
+func (s *SqliteStore) GetMeta(key string) (string, error) {
+	var value string
+	err := s.db.QueryRow(`SELECT value FROM meta WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func (s *SqliteStore) PutMeta(key string, value string) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)`, key, value)
+	return err
+}
+
+func (s *SqliteStore) GetEnergyCounters() (counters []EnergyCounter, err error) {
+	counters = make([]EnergyCounter, 0)
+	rows, err := s.db.Query(`SELECT plug, last_energy, last_timestamp, energy_offset FROM energy_counters`)
+	if err != nil {
+		return counters, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c EnergyCounter
+		if err := rows.Scan(&c.Id, &c.LastEnergy, &c.LastTimestamp, &c.Offset); err != nil {
+			return counters, err
+		}
+		counters = append(counters, c)
+	}
+	return counters, rows.Err()
+}
+
+// Save energy counters, unless a more recent state is already saved.
+func sqlite_put_energy_counters(tx *sql.Tx, counters []EnergyCounter) error {
+	for _, c := range counters {
+		_, err := tx.Exec(`INSERT INTO energy_counters (plug, last_energy, last_timestamp, energy_offset)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT (plug) DO UPDATE SET last_energy = excluded.last_energy,
+				last_timestamp = excluded.last_timestamp, energy_offset = excluded.energy_offset
+			WHERE excluded.last_timestamp >= energy_counters.last_timestamp`,
+			c.Id, c.LastEnergy, c.LastTimestamp, c.Offset)
+		if err != nil {
+			return fmt.Errorf("save energy counter %s: %s", c.Id, err)
+		}
+	}
+	return nil
+}
+
+func (s *SqliteStore) RebuildRollups(plugId string) error {
+	return s.update(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM rollups WHERE plug = ?`, plugId); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(`SELECT `+sqlite_measure_columns+` FROM measurements
+			WHERE plug = ? ORDER BY time, id`, plugId)
+		if err != nil {
+			return err
+		}
+		var measures []Measure
+		for rows.Next() {
+			m, err := scan_measure(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			measures = append(measures, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, m := range measures {
+			if err := sqlite_update_rollups(tx, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SqliteStore) Prune(policy RetentionPolicy, now time.Time) (report PruneReport, err error) {
+	if cutoff := retention_cutoff(policy.RawDays, now); !cutoff.IsZero() {
+		res, err := s.db.Exec(`DELETE FROM measurements WHERE time < ?`, cutoff.Unix())
+		if err != nil {
+			return report, err
+		}
+		count, _ := res.RowsAffected()
+		report.Raw = int(count)
+	}
+	for _, resolution := range ROLLUP_RESOLUTIONS {
+		cutoff := retention_cutoff(policy.rollup_days(resolution), now)
+		if cutoff.IsZero() {
+			continue
+		}
+		res, err := s.db.Exec(`DELETE FROM rollups WHERE resolution = ? AND start < ?`,
+			resolution, cutoff.Unix())
+		if err != nil {
+			return report, err
+		}
+		count, _ := res.RowsAffected()
+		report.add_rollups(resolution, int(count))
+	}
+	report.Total = report.Raw + report.Minute + report.Hour + report.Day
+	return report, nil
+}
+
+func (s *SqliteStore) file_size() int64 {
+	// make sure the WAL content is written back to the database file
+	s.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)
+	if fi, err := os.Stat(s.path); err == nil {
+		return fi.Size()
+	}
+	return 0
+}
+
+func (s *SqliteStore) Compact() (before int64, after int64, err error) {
+	before = s.file_size()
+	if _, err := s.db.Exec(`VACUUM`); err != nil {
+		return before, before, fmt.Errorf("compacting %s: %s", s.path, err)
+	}
+	after = s.file_size()
+	log.Infof("Compacted %s from %d to %d bytes", s.path, before, after)
+	return before, after, nil
+}
+
+// A SqliteMigration upgrades the database from version `Version - 1`
+// to `Version`, within a single transaction.
+// The schema version is stored in the `user_version` pragma.
+type SqliteMigration struct {
+	Version     int
+	Description string
+	Apply       func(tx *sql.Tx) (string, error)
+}
+
+func sqlite_statements(statements ...string) func(tx *sql.Tx) (string, error) {
+	return func(tx *sql.Tx) (string, error) {
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("%d statements executed", len(statements)), nil
+	}
+}
+
+// Ordered list of all migrations, the last one gives the current version.
+var sqlite_migrations = []SqliteMigration{
+	{1, "create plugs, measurements and rollups tables", sqlite_statements(
+		`CREATE TABLE plugs (
+			mac TEXT PRIMARY KEY,
+			id TEXT NOT NULL,
+			hostname TEXT NOT NULL,
+			name TEXT NOT NULL,
+			type TEXT NOT NULL,
+			last_seen INTEGER NOT NULL,
+			addr_v4 TEXT NOT NULL,
+			is_available INTEGER NOT NULL
+		)`,
+		`CREATE TABLE measurements (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			plug TEXT NOT NULL,
+			time INTEGER NOT NULL,
+			power REAL NOT NULL,
+			energy INTEGER NOT NULL,
+			addr TEXT NOT NULL
+		)`,
+		`CREATE INDEX measurements_plug_time ON measurements (plug, time)`,
+		`CREATE INDEX measurements_time ON measurements (time)`,
+		`CREATE TABLE rollups (
+			plug TEXT NOT NULL,
+			resolution TEXT NOT NULL,
+			start INTEGER NOT NULL,
+			count INTEGER NOT NULL,
+			power_sum REAL NOT NULL,
+			avg_power REAL NOT NULL,
+			min_power REAL NOT NULL,
+			max_power REAL NOT NULL,
+			energy_delta INTEGER NOT NULL,
+			last_energy INTEGER NOT NULL,
+			last_timestamp INTEGER NOT NULL,
+			PRIMARY KEY (plug, resolution, start)
+		)`,
+	)},
+	{2, "create prices table", sqlite_statements(
+		`CREATE TABLE prices (
+			start INTEGER PRIMARY KEY,
+			price REAL NOT NULL
+		)`,
+	)},
+	{3, "cumulative energy of measurements", migrate_sqlite_cumulative_energy},
+	{4, "plug generation, voltage, current and temperature", sqlite_statements(
+		`ALTER TABLE plugs ADD COLUMN generation INTEGER NOT NULL DEFAULT 1`,
+		`ALTER TABLE measurements ADD COLUMN voltage REAL NOT NULL DEFAULT 0`,
+		`ALTER TABLE measurements ADD COLUMN current REAL NOT NULL DEFAULT 0`,
+		`ALTER TABLE measurements ADD COLUMN temperature REAL NOT NULL DEFAULT 0`,
+	)},
+	{5, "plug driver", sqlite_statements(
+		`ALTER TABLE plugs ADD COLUMN driver TEXT NOT NULL DEFAULT 'shelly'`,
+	)},
+	{6, "create schedules table", sqlite_statements(
+		`CREATE TABLE schedules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			plug TEXT NOT NULL,
+			name TEXT NOT NULL,
+			enabled INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			timer INTEGER NOT NULL,
+			cron TEXT NOT NULL,
+			weekdays TEXT NOT NULL,
+			time TEXT NOT NULL,
+			time_offset INTEGER NOT NULL,
+			last_run INTEGER NOT NULL
+		)`,
+	)},
+	{7, "create rules table", sqlite_statements(
+		`CREATE TABLE rules (
+			name TEXT PRIMARY KEY,
+			enabled INTEGER NOT NULL,
+			plug TEXT NOT NULL,
+			condition TEXT NOT NULL,
+			threshold REAL NOT NULL,
+			hysteresis REAL NOT NULL,
+			duration INTEGER NOT NULL,
+			target TEXT NOT NULL,
+			action TEXT NOT NULL,
+			timer INTEGER NOT NULL,
+			cooldown INTEGER NOT NULL,
+			dry_run INTEGER NOT NULL
+		)`,
+	)},
+	{8, "create rule firings table", sqlite_statements(
+		`CREATE TABLE rule_firings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			rule TEXT NOT NULL,
+			time INTEGER NOT NULL,
+			plug TEXT NOT NULL,
+			power REAL NOT NULL,
+			target TEXT NOT NULL,
+			action TEXT NOT NULL,
+			timer INTEGER NOT NULL,
+			dry_run INTEGER NOT NULL,
+			state TEXT NOT NULL,
+			error TEXT NOT NULL
+		)`,
+		`CREATE INDEX rule_firings_rule ON rule_firings (rule, id)`,
+	)},
+	{9, "create meta table", sqlite_statements(
+		`CREATE TABLE meta (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		)`,
+	)},
+}
+
+// Version 3.
+// Add the cumulative energy of measurements, and the energy counters,
+// computed from the measurements already stored.
+func migrate_sqlite_cumulative_energy(tx *sql.Tx) (string, error) {
+	_, err := sqlite_statements(
+		`ALTER TABLE measurements ADD COLUMN cumulative INTEGER NOT NULL DEFAULT 0`,
+		`CREATE TABLE energy_counters (
+			plug TEXT PRIMARY KEY,
+			last_energy INTEGER NOT NULL,
+			last_timestamp INTEGER NOT NULL,
+			energy_offset INTEGER NOT NULL
+		)`,
+	)(tx)
+	if err != nil {
+		return "", err
+	}
+
+	type row struct {
+		id     int64
+		plug   string
+		time   uint64
+		energy uint32
+	}
+	rows, err := tx.Query(`SELECT id, plug, time, energy FROM measurements ORDER BY plug, time, id`)
+	if err != nil {
+		return "", err
+	}
+	var measures []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.plug, &r.time, &r.energy); err != nil {
+			rows.Close()
+			return "", err
+		}
+		measures = append(measures, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	counters := make(EnergyCounters)
+	for _, r := range measures {
+		m := Measure{Id: r.plug, Energy: r.energy, Timestamp: r.time}
+		counters.advance(&m)
+		if _, err := tx.Exec(`UPDATE measurements SET cumulative = ? WHERE id = ?`, m.Cumulative, r.id); err != nil {
+			return "", err
+		}
+	}
+	for _, c := range counters {
+		if err := sqlite_put_energy_counters(tx, []EnergyCounter{*c}); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%d measurements of %d plugs updated", len(measures), len(counters)), nil
+}
+
+func (s *SqliteStore) Migrate(dry_run bool) (reports []MigrationReport, err error) {
+	var version int
+	if err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return nil, fmt.Errorf("reading schema version: %s", err)
+	}
+	latest := sqlite_migrations[len(sqlite_migrations)-1].Version
+	if version > latest {
+		return nil, fmt.Errorf("database schema version %d is newer than supported version %d", version, latest)
+	}
+
+	var pending []SqliteMigration
+	for _, migration := range sqlite_migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	report := func(migration SqliteMigration, changes string) MigrationReport {
+		return MigrationReport{
+			From:        migration.Version - 1,
+			To:          migration.Version,
+			Description: migration.Description,
+			Changes:     changes,
+		}
+	}
+
+	if dry_run {
+		// Later migrations may depend on earlier ones: all of them run in a
+		// single transaction, rolled back
+		err := s.update(func(tx *sql.Tx) error {
+			for _, migration := range pending {
+				changes, err := migration.Apply(tx)
+				if err != nil {
+					return fmt.Errorf("migration to version %d: %s", migration.Version, err)
+				}
+				reports = append(reports, report(migration, changes))
+			}
+			return errDryRun
+		})
+		if !errors.Is(err, errDryRun) {
+			return reports, err
+		}
+		return reports, nil
+	}
+
+	for _, migration := range pending {
+		start := time.Now()
+		var changes string
+		err := s.update(func(tx *sql.Tx) (err error) {
+			if changes, err = migration.Apply(tx); err != nil {
+				return err
+			}
+			_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, migration.Version))
+			return err
+		})
+		if err != nil {
+			return reports, fmt.Errorf("migration to version %d: %s", migration.Version, err)
+		}
+		reports = append(reports, report(migration, changes))
+		log.Infof("Migrated database to version %d (%s) in %v: %s",
+			migration.Version, migration.Description, time.Since(start), changes)
+	}
+	return reports, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Sunrise and sunset times, from the sunrise equation.
+// See https://en.wikipedia.org/wiki/Sunrise_equation
+
+const (
+	// Julian day of 2000-01-01 12:00 UTC
+	JULIAN_2000 = 2451545.0
+	// Julian day of the unix epoch
+	JULIAN_UNIX = 2440587.5
+	// Sun altitude at sunrise and sunset, accounting for refraction and
+	// the radius of the sun
+	SUN_ALTITUDE = -0.833
+	EARTH_TILT   = 23.4397
+)
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func degrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
+
+func julian_time(jd float64) time.Time {
+	return time.Unix(int64(math.Round((jd-JULIAN_UNIX)*86400)), 0)
+}
+
+// Sunrise and sunset of the day `date` (in its location) at the given
+// coordinates, in degrees, east and north positive. `ok` is false when
+// the sun does not rise or does not set that day.
+func sun_times(date time.Time, latitude float64, longitude float64) (sunrise time.Time, sunset time.Time, ok bool) {
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, time.UTC)
+	day := math.Round(float64(noon.Unix())/86400 + JULIAN_UNIX - JULIAN_2000)
+
+	// mean solar time at the longitude
+	solar := day - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*solar, 360)
+	m := radians(anomaly)
+	center := 1.9148*math.Sin(m) + 0.02*math.Sin(2*m) + 0.0003*math.Sin(3*m)
+	ecliptic := radians(math.Mod(anomaly+center+180+102.9372, 360))
+	transit := JULIAN_2000 + solar + 0.0053*math.Sin(m) - 0.0069*math.Sin(2*ecliptic)
+
+	declination := math.Asin(math.Sin(ecliptic) * math.Sin(radians(EARTH_TILT)))
+	lat := radians(latitude)
+	cos_hour_angle := (math.Sin(radians(SUN_ALTITUDE)) - math.Sin(lat)*math.Sin(declination)) /
+		(math.Cos(lat) * math.Cos(declination))
+	if cos_hour_angle < -1 || cos_hour_angle > 1 {
+		// midnight sun or polar night
+		return sunrise, sunset, false
+	}
+	hour_angle := degrees(math.Acos(cos_hour_angle))
+
+	loc := date.Location()
+	sunrise = julian_time(transit - hour_angle/360).In(loc)
+	sunset = julian_time(transit + hour_angle/360).In(loc)
+	return sunrise, sunset, true
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	viper "github.com/spf13/viper"
+)
+
+// Time-of-use electricity tariffs, from the `[tariffs]` configuration:
+// the price of a kWh is given by the first rule matching the day and the
+// time of day, or `default_price` if no rule matches. A fixed
+// `daily_charge` is added once per day, whatever the consumption.
+
+// A tariff rule as written in the configuration.
+type TariffRule struct {
+	Name  string
+	Price float64
+	// Days the rule applies to: "mon" to "sun", "weekdays", "weekend"
+	// or "holiday". Holidays only match rules listing "holiday" or
+	// without days.
+	Days []string
+	// Time of day the rule starts and ends, as "HH:MM" in the tariff
+	// timezone. The end is excluded, an end before the start wraps
+	// around midnight. Empty means the whole day.
+	Start string
+	End   string
+}
+
+type TariffsConfig struct {
+	Currency     string
+	Timezone     string
+	DefaultPrice float64
+	DailyCharge  float64
+	// Dates as "YYYY-MM-DD"
+	Holidays []string
+	Rules    []TariffRule
+	Spot     SpotConfig
+}
+
+type tariffRule struct {
+	TariffRule
+	days map[string]bool
+	// minutes since midnight
+	start int
+	end   int
+}
+
+// Tariffs ready to price energy, built from a TariffsConfig.
+type Tariffs struct {
+	Currency     string
+	DefaultPrice float64
+	DailyCharge  float64
+	Spot         SpotConfig
+	location     *time.Location
+	holidays     map[string]bool
+	rules        []tariffRule
+}
+
+// Tariffs loaded in main.
+var tariffs *Tariffs
+
+var tariff_day_names = map[string][]string{
+	"mon":      {"mon"},
+	"tue":      {"tue"},
+	"wed":      {"wed"},
+	"thu":      {"thu"},
+	"fri":      {"fri"},
+	"sat":      {"sat"},
+	"sun":      {"sun"},
+	"weekdays": {"mon", "tue", "wed", "thu", "fri"},
+	"weekend":  {"sat", "sun"},
+	"holiday":  {"holiday"},
+}
+
+const HOLIDAY_FORMAT = "2006-01-02"
+
+func load_tariffs() (*Tariffs, error) {
+	// Unmarshalling the whole section would ignore the defaults of the
+	// keys missing from the configuration file
+	config := TariffsConfig{
+		Currency:     viper.GetString("tariffs.currency"),
+		Timezone:     viper.GetString("tariffs.timezone"),
+		DefaultPrice: viper.GetFloat64("tariffs.default_price"),
+		DailyCharge:  viper.GetFloat64("tariffs.daily_charge"),
+		Holidays:     viper.GetStringSlice("tariffs.holidays"),
+		Spot: SpotConfig{
+			Enabled:     viper.GetBool("tariffs.spot.enabled"),
+			Unit:        viper.GetString("tariffs.spot.unit"),
+			Markup:      viper.GetFloat64("tariffs.spot.markup"),
+			WatchDir:    viper.GetString("tariffs.spot.watch_dir"),
+			WatchPeriod: viper.GetInt("tariffs.spot.watch_period"),
+		},
+	}
+	if err := viper.UnmarshalKey("tariffs.rules", &config.Rules); err != nil {
+		return nil, fmt.Errorf("reading tariff rules: %s", err)
+	}
+	return new_tariffs(config)
+}
+
+func new_tariffs(config TariffsConfig) (*Tariffs, error) {
+	t := &Tariffs{
+		Currency:     config.Currency,
+		DefaultPrice: config.DefaultPrice,
+		DailyCharge:  config.DailyCharge,
+		Spot:         config.Spot,
+		holidays:     make(map[string]bool),
+	}
+
+	var err error
+	if _, err = price_unit_divisor(config.Spot.Unit); err != nil {
+		return nil, err
+	}
+	t.location, err = time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tariffs timezone '%s': %s", config.Timezone, err)
+	}
+	for _, day := range config.Holidays {
+		if _, err := time.Parse(HOLIDAY_FORMAT, day); err != nil {
+			return nil, fmt.Errorf("invalid holiday '%s', expected YYYY-MM-DD", day)
+		}
+		t.holidays[day] = true
+	}
+
+	for i, r := range config.Rules {
+		rule := tariffRule{TariffRule: r, end: 24 * 60}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if len(r.Days) > 0 {
+			rule.days = make(map[string]bool)
+			for _, name := range r.Days {
+				days, ok := tariff_day_names[strings.ToLower(name)]
+				if !ok {
+					return nil, fmt.Errorf("tariff %s: unknown day '%s'", rule.Name, name)
+				}
+				for _, d := range days {
+					rule.days[d] = true
+				}
+			}
+		}
+		if r.Start != "" {
+			if rule.start, err = parse_time_of_day(r.Start); err != nil {
+				return nil, fmt.Errorf("tariff %s: invalid start: %s", rule.Name, err)
+			}
+		}
+		if r.End != "" {
+			if rule.end, err = parse_time_of_day(r.End); err != nil {
+				return nil, fmt.Errorf("tariff %s: invalid end: %s", rule.Name, err)
+			}
+		}
+		t.rules = append(t.rules, rule)
+	}
+	return t, nil
+}
+
+// Parse a "HH:MM" time of day into minutes since midnight,
+// "24:00" is accepted for the end of the day.
+func parse_time_of_day(val string) (int, error) {
+	parts := strings.Split(val, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("'%s' is not HH:MM", val)
+	}
+	hours, err1 := strconv.Atoi(parts[0])
+	minutes, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 ||
+		hours > 24 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("'%s' is not HH:MM", val)
+	}
+	return hours*60 + minutes, nil
+}
+
+// Whether any price is configured, costs are meaningless otherwise.
+func (t *Tariffs) Configured() bool {
+	return t.DefaultPrice != 0 || t.DailyCharge != 0 || len(t.rules) > 0 || t.Spot.Enabled
+}
+
+func (t *Tariffs) Location() *time.Location {
+	return t.location
+}
+
+// Day of `ts` used to match rules: "holiday" or the weekday.
+func (t *Tariffs) day_name(ts time.Time) string {
+	if t.holidays[ts.Format(HOLIDAY_FORMAT)] {
+		return "holiday"
+	}
+	return strings.ToLower(ts.Weekday().String()[:3])
+}
+
+func (r *tariffRule) matches(day string, minute int) bool {
+	if r.days != nil && !r.days[day] {
+		return false
+	}
+	if r.start < r.end {
+		return minute >= r.start && minute < r.end
+	}
+	// wraps around midnight, or the whole day if start == end
+	return minute >= r.start || minute < r.end
+}
+
+// Price of a kWh consumed at `ts`, and the name of the rule giving it,
+// empty for the default price.
+func (t *Tariffs) Price(ts time.Time) (float64, string) {
+	local := ts.In(t.location)
+	day := t.day_name(local)
+	minute := local.Hour()*60 + local.Minute()
+	for i := range t.rules {
+		if t.rules[i].matches(day, minute) {
+			return t.rules[i].Price, t.rules[i].Name
+		}
+	}
+	return t.DefaultPrice, ""
+}
+
+// Price of a kWh consumed at `ts`: the imported spot price of its hour
+// plus the markup if there is one, the tariff rules otherwise.
+func (t *Tariffs) energy_price(ts time.Time, spot map[uint64]float64) float64 {
+	if price, ok := spot[rollup_start(ROLLUP_HOUR, uint64(ts.Unix()))]; ok {
+		return price + t.Spot.Markup
+	}
+	price, _ := t.Price(ts)
+	return price
+}
+
+// Calendar periods used to group costs, in the tariff timezone.
+const (
+	PERIOD_DAY   = "day"
+	PERIOD_WEEK  = "week"
+	PERIOD_MONTH = "month"
+)
+
+func is_calendar_period(period string) bool {
+	return period == PERIOD_DAY || period == PERIOD_WEEK || period == PERIOD_MONTH
+}
+
+// Start of the calendar period containing `ts`, weeks start on monday.
+func period_start(period string, ts time.Time, loc *time.Location) time.Time {
+	local := ts.In(loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	switch period {
+	case PERIOD_WEEK:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case PERIOD_MONTH:
+		return time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, loc)
+	}
+	return day
+}
+
+// Start of the period following the one starting at `start`.
+func period_next(period string, start time.Time) time.Time {
+	switch period {
+	case PERIOD_WEEK:
+		return start.AddDate(0, 0, 7)
+	case PERIOD_MONTH:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Driver for plugs running the Tasmota firmware with power monitoring,
+// using the commands served on `http://<plug>/cm?cmnd=<command>`.
+// See https://tasmota.github.io/docs/Commands/
+type TasmotaDriver struct{}
+
+func init() {
+	register_plug_driver(TasmotaDriver{})
+}
+
+func (TasmotaDriver) Name() string {
+	return "tasmota"
+}
+
+// Run a Tasmota command and decode its response.
+func tasmota_command(plug_host string, command string, result interface{}) error {
+	cmd_url := fmt.Sprintf("http://%v/cm?cmnd=%s", plug_host, url.PathEscape(command))
+	resp, err := http.Get(cmd_url)
+	if err != nil {
+		log.Println("Error getting response for ", command, ": ", plug_host, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("Error reading ", command, " response: ", err)
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed: %d %s", command, resp.StatusCode, body)
+	}
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		log.Println("ERROR parsing ", command, " response: ", err)
+		return err
+	}
+	return nil
+}
+
+// type for `Status 0`, only the parts used
+type TasmotaStatus struct {
+	Status struct {
+		DeviceName   string
+		FriendlyName []string
+	}
+	StatusFWR struct {
+		Version  string
+		Hardware string
+	}
+	StatusNET struct {
+		Hostname  string
+		IPAddress string
+		Mac       string
+	}
+}
+
+// type for `Status 8`
+type TasmotaEnergyStatus struct {
+	StatusSNS struct {
+		ENERGY struct {
+			// in kWh
+			Total float64
+			Today float64
+			// in W
+			Power   float64
+			Voltage float64
+			Current float64
+		}
+	}
+}
+
+// type for `Power` commands
+type TasmotaPower struct {
+	POWER string
+}
+
+// "AA:BB:CC:00:11:22" -> "AABBCC001122", as Shelly plugs report it
+func tasmota_mac(mac string) string {
+	return strings.ToUpper(strings.ReplaceAll(mac, ":", ""))
+}
+
+// get plug description from `Status 0`
+func (TasmotaDriver) Describe(plug_host string) (PlugDescription, error) {
+	var plug_desc PlugDescription
+	var status TasmotaStatus
+	if err := tasmota_command(plug_host, "Status 0", &status); err != nil {
+		return plug_desc, err
+	}
+	mac := tasmota_mac(status.StatusNET.Mac)
+	if mac == "" {
+		return plug_desc, fmt.Errorf("no mac address in status of %s", plug_host)
+	}
+
+	// the relay name is more specific, the device name is used if unset
+	name := status.Status.DeviceName
+	if len(status.Status.FriendlyName) > 0 && status.Status.FriendlyName[0] != "" {
+		name = status.Status.FriendlyName[0]
+	}
+	plug_type := "Tasmota"
+	if status.StatusFWR.Hardware != "" {
+		plug_type += " " + status.StatusFWR.Hardware
+	}
+	addr := status.StatusNET.IPAddress
+	if addr == "" {
+		addr = plug_host
+	}
+
+	plug_desc = PlugDescription{
+		Id:           mac,
+		Hostname:     status.StatusNET.Hostname,
+		Name:         name,
+		Type:         plug_type,
+		LastSeen:     time.Now(),
+		AddrV4:       addr,
+		Mac:          mac,
+		Is_available: true,
+	}
+	return plug_desc, nil
+}
+
+// get energy data from `Status 8`
+func (TasmotaDriver) ReadMeter(plug_desc PlugDescription, plug_host string) (MeterInfo, error) {
+	var m MeterInfo
+	var status TasmotaEnergyStatus
+	if err := tasmota_command(plug_host, "Status 8", &status); err != nil {
+		return m, err
+	}
+	energy := status.StatusSNS.ENERGY
+
+	m = MeterInfo{
+		Power:   energy.Power,
+		Voltage: energy.Voltage,
+		Current: energy.Current,
+		// kWh to Wmin
+		Total:     uint32(math.Round(energy.Total * WMIN_PER_KWH)),
+		Is_valid:  true,
+		Timestamp: uint64(time.Now().Unix()),
+	}
+	return m, nil
+}
+
+func (TasmotaDriver) SetRelay(plug_desc PlugDescription, plug_host string, on bool, timer int) (bool, error) {
+	if timer > 0 {
+		return false, ErrTimerNotSupported
+	}
+	if on {
+		return tasmota_power(plug_host, "Power On")
+	}
+	return tasmota_power(plug_host, "Power Off")
+}
+
+func (TasmotaDriver) ToggleRelay(plug_desc PlugDescription, plug_host string) (bool, error) {
+	return tasmota_power(plug_host, "Power Toggle")
+}
+
+// Run a `Power` command, return the state of the relay.
+func tasmota_power(plug_host string, command string) (bool, error) {
+	var power TasmotaPower
+	if err := tasmota_command(plug_host, command, &power); err != nil {
+		return false, err
+	}
+	return power.POWER == "ON", nil
+}
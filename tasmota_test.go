@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Responses of Tasmota 13 on a Nous A1T plug, trimmed to a few fields.
+const (
+	TASMOTA_STATUS_0 = `{"Status":{"Module":0,"DeviceName":"Nous A1T","FriendlyName":["Desk"],"Topic":"tasmota_5A1B2C","Power":1},
+"StatusFWR":{"Version":"13.2.0(tasmota)","BuildDateTime":"2023-10-20T14:18:17","Core":"2_7_4_9","Hardware":"ESP8266EX"},
+"StatusNET":{"Hostname":"tasmota-5A1B2C-6956","IPAddress":"192.168.1.42","Gateway":"192.168.1.1","Mac":"4C:75:25:5A:1B:2C"}}`
+	TASMOTA_STATUS_8 = `{"StatusSNS":{"Time":"2024-03-10T12:00:00","ENERGY":{"TotalStartTime":"2023-11-02T18:40:12",
+"Total":12.345,"Yesterday":0.512,"Today":0.231,"Power":42,"ApparentPower":50,"ReactivePower":27,"Factor":0.84,
+"Voltage":231,"Current":0.216}}}`
+)
+
+// Fake Tasmota plug answering `responses` by command, returns its host.
+func fake_tasmota(t *testing.T, status int, responses map[string]string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cm" {
+			http.NotFound(w, r)
+			return
+		}
+		response, ok := responses[r.URL.Query().Get("cmnd")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestTasmotaDescribe(t *testing.T) {
+	host := fake_tasmota(t, http.StatusOK, map[string]string{"Status 0": TASMOTA_STATUS_0})
+	plug, err := TasmotaDriver{}.Describe(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PlugDescription{
+		Id:           "4C75255A1B2C",
+		Hostname:     "tasmota-5A1B2C-6956",
+		Name:         "Desk",
+		Type:         "Tasmota ESP8266EX",
+		AddrV4:       "192.168.1.42",
+		Mac:          "4C75255A1B2C",
+		Is_available: true,
+	}
+	plug.LastSeen = expected.LastSeen
+	if plug != expected {
+		t.Errorf("Describe:\n got %+v\nwant %+v", plug, expected)
+	}
+}
+
+func TestTasmotaDescribeDeviceName(t *testing.T) {
+	status := strings.Replace(TASMOTA_STATUS_0, `"FriendlyName":["Desk"]`, `"FriendlyName":[""]`, 1)
+	host := fake_tasmota(t, http.StatusOK, map[string]string{"Status 0": status})
+	plug, err := TasmotaDriver{}.Describe(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plug.Name != "Nous A1T" {
+		t.Errorf("name without friendly name: %s", plug.Name)
+	}
+}
+
+func TestTasmotaReadMeter(t *testing.T) {
+	host := fake_tasmota(t, http.StatusOK, map[string]string{"Status 8": TASMOTA_STATUS_8})
+	m, err := TasmotaDriver{}.ReadMeter(PlugDescription{}, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Power != 42 || m.Voltage != 231 || m.Current != 0.216 || !m.Is_valid {
+		t.Errorf("ReadMeter: %+v", m)
+	}
+	// 12.345 kWh
+	if m.Total != 740700 {
+		t.Errorf("energy is %d Wmin, want 740700", m.Total)
+	}
+	if m.Timestamp == 0 {
+		t.Error("no timestamp")
+	}
+}
+
+func TestTasmotaErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		response string
+	}{
+		{"server error", http.StatusInternalServerError, `{"Command":"Error"}`},
+		{"unauthorized", http.StatusUnauthorized, `{"WARNING":"Need user=<username>&password=<password>"}`},
+		{"bad json", http.StatusOK, `{"StatusSNS":{"ENERGY":`},
+		{"not json", http.StatusOK, `<html>Tasmota</html>`},
+	}
+	for _, test := range tests {
+		host := fake_tasmota(t, test.status, map[string]string{"Status 0": test.response, "Status 8": test.response})
+		if _, err := (TasmotaDriver{}).Describe(host); err == nil {
+			t.Errorf("%s: Describe did not fail", test.name)
+		}
+		if _, err := (TasmotaDriver{}).ReadMeter(PlugDescription{}, host); err == nil {
+			t.Errorf("%s: ReadMeter did not fail", test.name)
+		}
+	}
+}
+
+func TestTasmotaDescribeWithoutMac(t *testing.T) {
+	host := fake_tasmota(t, http.StatusOK, map[string]string{"Status 0": `{"Status":{"DeviceName":"Plug"}}`})
+	if _, err := (TasmotaDriver{}).Describe(host); err == nil {
+		t.Error("Describe did not fail without a mac address")
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"plugmeter/web"
 	"strconv"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	viper "github.com/spf13/viper"
 )
 
 func start_webui(port int) {
@@ -21,6 +23,9 @@ func start_webui(port int) {
 	// Add handler for static files
 	r.PathPrefix("/static/").Handler(handler)
 
+	// Prometheus metrics
+	r.Handle("/metrics", metrics_handler()).Methods(http.MethodGet)
+
 	// r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 	// 	fmt.Fprintf(w, "Hello, %q", html.EscapeString(r.URL.Path))
 	// })
@@ -30,16 +35,42 @@ func start_webui(port int) {
 	api.HandleFunc("/user/{userID}/comment/{commentID}", params).Methods(http.MethodGet)
 	api.HandleFunc("/plugs", api_plugs).Methods(http.MethodGet)
 	api.HandleFunc("/plugs/{plugID}", api_plug).Methods(http.MethodGet)
+	api.HandleFunc("/plugs/{plugID}", api_forget_plug).Methods(http.MethodDelete)
+	api.HandleFunc("/plugs/{plugID}/relay", api_relay).Methods(http.MethodPost)
+	api.HandleFunc("/plugs/{plugID}/measurements", api_measurements).Methods(http.MethodGet)
+	api.HandleFunc("/plugs/{plugID}/energy", api_energy).Methods(http.MethodGet)
+	api.HandleFunc("/plugs/{plugID}/rollups/{resolution}", api_rollups).Methods(http.MethodGet)
+	api.HandleFunc("/plugs/{plugID}/rollups/rebuild", api_rebuild_rollups).Methods(http.MethodPost)
+	api.HandleFunc("/plugs/{plugID}/cost", api_plug_cost).Methods(http.MethodGet)
+	api.HandleFunc("/cost", api_cost).Methods(http.MethodGet)
+	api.HandleFunc("/prices", api_prices).Methods(http.MethodGet)
+	api.HandleFunc("/reports/{period}", api_report).Methods(http.MethodGet)
+	api.HandleFunc("/rollups/rebuild", api_rebuild_all_rollups).Methods(http.MethodPost)
+	api.HandleFunc("/maintenance/prune", api_prune).Methods(http.MethodPost)
+	api.HandleFunc("/websocket/devices", api_ws_devices).Methods(http.MethodGet)
+	api.HandleFunc("/schedules", api_schedules).Methods(http.MethodGet)
+	api.HandleFunc("/schedules", api_create_schedule).Methods(http.MethodPost)
+	api.HandleFunc("/schedules/{scheduleID}", api_schedule).Methods(http.MethodGet)
+	api.HandleFunc("/schedules/{scheduleID}", api_update_schedule).Methods(http.MethodPut)
+	api.HandleFunc("/schedules/{scheduleID}", api_delete_schedule).Methods(http.MethodDelete)
+	api.HandleFunc("/rules", api_rules).Methods(http.MethodGet)
+	api.HandleFunc("/rules", api_create_rule).Methods(http.MethodPost)
+	api.HandleFunc("/rules/{ruleName}", api_rule).Methods(http.MethodGet)
+	api.HandleFunc("/rules/{ruleName}", api_update_rule).Methods(http.MethodPut)
+	api.HandleFunc("/rules/{ruleName}", api_delete_rule).Methods(http.MethodDelete)
+	api.HandleFunc("/rules/{ruleName}/firings", api_firings).Methods(http.MethodGet)
+	api.HandleFunc("/firings", api_firings).Methods(http.MethodGet)
+	api.HandleFunc("/alerts", api_alerts).Methods(http.MethodGet)
 
 	// r.HandleFunc(0)
 
-	h := handlers.CORS(handlers.AllowedMethods([]string{"POST", "GET"}),
+	h := handlers.CORS(handlers.AllowedMethods([]string{"POST", "GET", "PUT", "DELETE"}),
 		handlers.AllowedOrigins([]string{"*"}),
 		handlers.AllowedHeaders([]string{"X-Requested-With"}))(r)
 
 	srv := &http.Server{
 		Handler: h,
-		Addr:    "127.0.0.1:3000",
+		Addr:    fmt.Sprintf("%s:%d", viper.GetString("web_ui.address"), port),
 		// Good practice: enforce timeouts for servers you create!
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
@@ -89,13 +120,57 @@ func params(w http.ResponseWriter, r *http.Request) {
 // API
 //   /plugs
 //   /plugs/<plugID>
-//   /power/<plugID>
+//   DELETE /plugs/<plugID>
+//   POST /plugs/<plugID>/relay {"action": "on|off|toggle", "timer": <seconds>}
+//   /plugs/<plugID>/measurements?from=<time>&to=<time>&limit=<n>
+//   /plugs/<plugID>/energy
+//   /plugs/<plugID>/rollups/<minute|hour|day>?from=<time>&to=<time>&limit=<n>
+//   POST /plugs/<plugID>/rollups/rebuild
+//   /plugs/<plugID>/cost?from=<time>&to=<time>&period=<day|week|month>
+//   /cost?from=<time>&to=<time>&period=<day|week|month>
+//   /prices?from=<time>&to=<time>
+//   /reports/<day|week|month>?date=<time>
+//   POST /rollups/rebuild
+//   POST /maintenance/prune?compact=<bool>
+//   /websocket/devices
+//   /schedules?plug=<plugID>
+//   POST /schedules
+//   /schedules/<scheduleID>
+//   PUT /schedules/<scheduleID>
+//   DELETE /schedules/<scheduleID>
+//   /rules?plug=<plugID>
+//   POST /rules
+//   /rules/<ruleName>
+//   PUT /rules/<ruleName>
+//   DELETE /rules/<ruleName>
+//   /rules/<ruleName>/firings?limit=<n>
+//   /firings?rule=<ruleName>&limit=<n>
+//   /alerts?plug=<plugID>
+
+const (
+	DEFAULT_MEASUREMENTS_LIMIT = 1000
+)
+
+// Write an error response: {"message": "<err>"}.
+func json_error(w http.ResponseWriter, status int, err error) {
+	encoded, _ := json.Marshal(struct {
+		Message string `json:"message"`
+	}{err.Error()})
+	w.WriteHeader(status)
+	w.Write(encoded)
+}
 
 // Handler
 func api_plugs(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	plugs := get_plugs()
+	plugs, err := store.GetPlugs()
+	if err != nil {
+		fmt.Println("Error reading plugs", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not read plugs"}`))
+		return
+	}
 	encoded, err := json.Marshal(plugs)
 	if err != nil {
 		fmt.Println("Error marshalling plugs", err)
@@ -112,7 +187,17 @@ func api_plug(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	plugID := pathParams["plugID"]
-	plug := get_plug(plugID)
+	plug, err := store.GetPlug(plugID)
+	if err == ErrPlugNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "unknown plug"}`))
+		return
+	} else if err != nil {
+		fmt.Println("Error reading plug", plugID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not read plug"}`))
+		return
+	}
 	encoded, err := json.Marshal(plug)
 	if err != nil {
 		fmt.Println("Error marshalling plug", plug, err)
@@ -121,3 +206,810 @@ func api_plug(w http.ResponseWriter, r *http.Request) {
 
 	// w.Write([]byte(fmt.Sprintf(`{"plugId": "%s"}`, plugID)))
 }
+
+// Handler
+// Forget a plug: its description is removed, listeners are notified and
+// it is no longer polled until it is detected again. Recorded
+// measurements are kept.
+func api_forget_plug(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	plugID := pathParams["plugID"]
+	err := store.DeletePlug(plugID)
+	if err == ErrPlugNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "unknown plug"}`))
+		return
+	} else if err != nil {
+		fmt.Println("Error deleting plug", plugID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not delete plug"}`))
+		return
+	}
+	notify_plug_forgotten(plugID)
+	w.Write([]byte(`{"message": "plug forgotten"}`))
+}
+
+type RelayResponse struct {
+	Id     string
+	Action string
+	Timer  int `json:",omitempty"`
+	// State of the relay after the command
+	Ison  bool
+	State string
+}
+
+// Handler
+// Switch the relay of a plug on, off, or toggle it. With a timer, the
+// relay is switched back after that many seconds.
+func api_relay(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	var command RelayCommand
+	if err := json.NewDecoder(r.Body).Decode(&command); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "invalid relay command"}`))
+		return
+	}
+	if err := command.validate(); err != nil {
+		json_error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	plugID := pathParams["plugID"]
+	plug, err := store.GetPlug(plugID)
+	if err == ErrPlugNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "unknown plug"}`))
+		return
+	} else if err != nil {
+		fmt.Println("Error reading plug", plugID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not read plug"}`))
+		return
+	}
+
+	ison, err := switch_relay(plug, command, "API client "+r.RemoteAddr)
+	if err == ErrRelayNotSupported || err == ErrTimerNotSupported {
+		json_error(w, http.StatusNotImplemented, err)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`{"message": "could not switch the relay"}`))
+		return
+	}
+	encoded, err := json.Marshal(RelayResponse{plug.Mac, command.Action, command.Timer, ison, relay_state(ison)})
+	if err != nil {
+		fmt.Println("Error marshalling relay state", err)
+	}
+	w.Write([]byte(encoded))
+}
+
+// Handler
+func api_measurements(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	from, to, limit, err := parse_range_query(r.URL.Query())
+	if err != nil {
+		json_error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	plugID := pathParams["plugID"]
+	measures, err := store.GetMeasurements(plugID, from, to, limit)
+	if err != nil {
+		fmt.Println("Error reading measurements", plugID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not read measurements"}`))
+		return
+	}
+	encoded, err := json.Marshal(measures)
+	if err != nil {
+		fmt.Println("Error marshalling measurements", plugID, err)
+	}
+	w.Write([]byte(encoded))
+}
+
+type EnergyResponse struct {
+	EnergyCounter
+	// Energy consumed since the plug is monitored, in Wmin and in kWh
+	Cumulative uint64
+	TotalKWh   float64
+}
+
+// Handler
+// Energy counter of a plug, corrected for counter resets.
+func api_energy(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	plugID := pathParams["plugID"]
+	counters, err := store.GetEnergyCounters()
+	if err != nil {
+		fmt.Println("Error reading energy counters", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not read energy counters"}`))
+		return
+	}
+	for _, c := range counters {
+		if c.Id != plugID {
+			continue
+		}
+		encoded, err := json.Marshal(EnergyResponse{c, c.Cumulative(), energy_kwh(c.Cumulative())})
+		if err != nil {
+			fmt.Println("Error marshalling energy counter", err)
+		}
+		w.Write([]byte(encoded))
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte(`{"message": "no energy reading for this plug"}`))
+}
+
+// Handler
+func api_rollups(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	resolution := pathParams["resolution"]
+	if !is_rollup_resolution(resolution) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "unknown rollup resolution"}`))
+		return
+	}
+
+	from, to, limit, err := parse_range_query(r.URL.Query())
+	if err != nil {
+		json_error(w, http.StatusBadRequest, err)
+		return
+	}
+
+	plugID := pathParams["plugID"]
+	rollups, err := store.GetRollups(plugID, resolution, from, to, limit)
+	if err != nil {
+		fmt.Println("Error reading rollups", plugID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not read rollups"}`))
+		return
+	}
+	encoded, err := json.Marshal(rollups)
+	if err != nil {
+		fmt.Println("Error marshalling rollups", plugID, err)
+	}
+	w.Write([]byte(encoded))
+}
+
+// Handler
+func api_rebuild_rollups(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	plugID := pathParams["plugID"]
+	if err := store.RebuildRollups(plugID); err != nil {
+		fmt.Println("Error rebuilding rollups", plugID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not rebuild rollups"}`))
+		return
+	}
+	w.Write([]byte(`{"message": "rollups rebuilt"}`))
+}
+
+// Handler
+func api_rebuild_all_rollups(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := rebuild_all_rollups(); err != nil {
+		fmt.Println("Error rebuilding rollups", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not rebuild rollups"}`))
+		return
+	}
+	w.Write([]byte(`{"message": "rollups rebuilt"}`))
+}
+
+// Handler
+func api_prune(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	compact := viper.GetBool("data.retention.compact")
+	if val := r.URL.Query().Get("compact"); val != "" {
+		var err error
+		compact, err = strconv.ParseBool(val)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message": "invalid 'compact' parameter"}`))
+			return
+		}
+	}
+
+	report, err := prune(retention_policy(), compact)
+	if err != nil {
+		fmt.Println("Error pruning database", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not prune database"}`))
+		return
+	}
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		fmt.Println("Error marshalling prune report", err)
+	}
+	w.Write([]byte(encoded))
+}
+
+// Handler
+// Cost of all the known plugs.
+func api_cost(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	plugs, err := store.GetPlugs()
+	if err != nil {
+		fmt.Println("Error reading plugs", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not read plugs"}`))
+		return
+	}
+	write_cost(w, r, plugs)
+}
+
+// Handler
+func api_plug_cost(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	plugID := pathParams["plugID"]
+	plug, err := store.GetPlug(plugID)
+	if err == ErrPlugNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "unknown plug"}`))
+		return
+	} else if err != nil {
+		fmt.Println("Error reading plug", plugID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not read plug"}`))
+		return
+	}
+	write_cost(w, r, []PlugDescription{plug})
+}
+
+// Write the cost report of `plugs` for the `from`, `to` and `period`
+// query parameters. The range defaults to the current month.
+func write_cost(w http.ResponseWriter, r *http.Request, plugs []PlugDescription) {
+	query := r.URL.Query()
+	now := time.Now()
+	from, err := parse_time_param(query.Get("from"), period_start(PERIOD_MONTH, now, tariffs.Location()))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "invalid 'from' parameter"}`))
+		return
+	}
+	to, err := parse_time_param(query.Get("to"), now)
+	if err != nil || !to.After(from) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "invalid 'to' parameter"}`))
+		return
+	}
+	period := query.Get("period")
+	if period != "" && !is_calendar_period(period) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "invalid 'period' parameter"}`))
+		return
+	}
+
+	report, err := compute_cost(tariffs, plugs, from, to, period)
+	if err != nil {
+		fmt.Println("Error computing cost", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not compute cost"}`))
+		return
+	}
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		fmt.Println("Error marshalling cost report", err)
+	}
+	w.Write([]byte(encoded))
+}
+
+// Handler
+// Report of the period containing `date`, the current one by default.
+func api_report(w http.ResponseWriter, r *http.Request) {
+	pathParams := mux.Vars(r)
+	w.Header().Set("Content-Type", "application/json")
+
+	period := pathParams["period"]
+	if !is_calendar_period(period) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "unknown report period"}`))
+		return
+	}
+	date, err := parse_time_param(r.URL.Query().Get("date"), time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "invalid 'date' parameter"}`))
+		return
+	}
+
+	plugs, err := store.GetPlugs()
+	if err != nil {
+		fmt.Println("Error reading plugs", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not read plugs"}`))
+		return
+	}
+	report, err := build_report(plugs, period, date)
+	if err != nil {
+		fmt.Println("Error building report", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not build report"}`))
+		return
+	}
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		fmt.Println("Error marshalling report", err)
+	}
+	w.Write([]byte(encoded))
+}
+
+type PricesResponse struct {
+	Currency string
+	// Added to each imported price by the cost computation
+	Markup float64
+	// Prices per kWh
+	Prices []Price
+}
+
+// Handler
+// Imported hourly prices, for today and tomorrow by default.
+func api_prices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	today := period_start(PERIOD_DAY, time.Now(), tariffs.Location())
+	from, err := parse_time_param(query.Get("from"), today)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "invalid 'from' parameter"}`))
+		return
+	}
+	to, err := parse_time_param(query.Get("to"), today.AddDate(0, 0, 2).Add(-time.Second))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "invalid 'to' parameter"}`))
+		return
+	}
+
+	prices, err := store.GetPrices(from, to)
+	if err != nil {
+		fmt.Println("Error reading prices", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not read prices"}`))
+		return
+	}
+	encoded, err := json.Marshal(PricesResponse{tariffs.Currency, tariffs.Spot.Markup, prices})
+	if err != nil {
+		fmt.Println("Error marshalling prices", err)
+	}
+	w.Write([]byte(encoded))
+}
+
+// Parse the `from`, `to` and `limit` query parameters used by the
+// endpoints returning time series.
+func parse_range_query(query url.Values) (from time.Time, to time.Time, limit int, err error) {
+	from, err = parse_time_param(query.Get("from"), time.Unix(0, 0))
+	if err != nil {
+		return from, to, limit, fmt.Errorf("invalid 'from' parameter")
+	}
+	to, err = parse_time_param(query.Get("to"), time.Now())
+	if err != nil {
+		return from, to, limit, fmt.Errorf("invalid 'to' parameter")
+	}
+	limit = DEFAULT_MEASUREMENTS_LIMIT
+	if val := query.Get("limit"); val != "" {
+		limit, err = strconv.Atoi(val)
+		if err != nil || limit < 0 {
+			return from, to, limit, fmt.Errorf("invalid 'limit' parameter")
+		}
+	}
+	return from, to, limit, nil
+}
+
+// Parse a time query parameter, given either as a RFC3339 string
+// or as a unix timestamp in seconds.
+// Returns `def` when the parameter is empty.
+func parse_time_param(val string, def time.Time) (time.Time, error) {
+	if val == "" {
+		return def, nil
+	}
+	if ts, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	return time.Parse(time.RFC3339, val)
+}
+
+// Handler
+// Connection state of the devices allowed on the Shelly WebSocket server.
+func api_ws_devices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if shelly_ws == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "WebSocket server is disabled"}`))
+		return
+	}
+	encoded, err := json.Marshal(shelly_ws.States())
+	if err != nil {
+		fmt.Println("Error marshalling WebSocket devices", err)
+	}
+	w.Write([]byte(encoded))
+}
+
+// Handler
+// All schedules, or those of a plug.
+func api_schedules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	schedules, err := store.GetSchedules()
+	if err != nil {
+		fmt.Println("Error reading schedules", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not read schedules"}`))
+		return
+	}
+	plugID := r.URL.Query().Get("plug")
+	responses := make([]ScheduleResponse, 0, len(schedules))
+	for _, s := range schedules {
+		if plugID == "" || s.Plug == plugID {
+			responses = append(responses, schedule_response(s))
+		}
+	}
+	encoded, err := json.Marshal(responses)
+	if err != nil {
+		fmt.Println("Error marshalling schedules", err)
+	}
+	w.Write([]byte(encoded))
+}
+
+// Read the schedule id of the path, writes the error response if invalid.
+func schedule_id_param(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["scheduleID"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "invalid schedule id"}`))
+		return 0, false
+	}
+	return id, true
+}
+
+// Read and check the schedule of the request body, writes the error
+// response if invalid.
+func schedule_body(w http.ResponseWriter, r *http.Request) (Schedule, bool) {
+	var schedule Schedule
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "invalid schedule"}`))
+		return schedule, false
+	}
+	if err := schedule.validate(schedule_config); err != nil {
+		json_error(w, http.StatusBadRequest, err)
+		return schedule, false
+	}
+	if _, err := store.GetPlug(schedule.Plug); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "unknown plug"}`))
+		return schedule, false
+	}
+	// runs before the schedule was saved are not missed runs
+	schedule.LastRun = time.Now()
+	return schedule, true
+}
+
+func write_schedule(w http.ResponseWriter, schedule Schedule) {
+	encoded, err := json.Marshal(schedule_response(schedule))
+	if err != nil {
+		fmt.Println("Error marshalling schedule", err)
+	}
+	w.Write([]byte(encoded))
+}
+
+// Handler
+func api_create_schedule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	schedule, ok := schedule_body(w, r)
+	if !ok {
+		return
+	}
+	schedule.Id = 0
+	schedule, err := store.PutSchedule(schedule)
+	if err != nil {
+		fmt.Println("Error saving schedule", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not save schedule"}`))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	write_schedule(w, schedule)
+}
+
+// Handler
+func api_schedule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := schedule_id_param(w, r)
+	if !ok {
+		return
+	}
+	schedule, err := store.GetSchedule(id)
+	if err == ErrScheduleNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "unknown schedule"}`))
+		return
+	} else if err != nil {
+		fmt.Println("Error reading schedule", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not read schedule"}`))
+		return
+	}
+	write_schedule(w, schedule)
+}
+
+// Handler
+// Replace a schedule.
+func api_update_schedule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := schedule_id_param(w, r)
+	if !ok {
+		return
+	}
+	schedule, ok := schedule_body(w, r)
+	if !ok {
+		return
+	}
+	schedule.Id = id
+	schedule, err := store.PutSchedule(schedule)
+	if err == ErrScheduleNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "unknown schedule"}`))
+		return
+	} else if err != nil {
+		fmt.Println("Error saving schedule", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not save schedule"}`))
+		return
+	}
+	write_schedule(w, schedule)
+}
+
+// Handler
+func api_delete_schedule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := schedule_id_param(w, r)
+	if !ok {
+		return
+	}
+	err := store.DeleteSchedule(id)
+	if err == ErrScheduleNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "unknown schedule"}`))
+		return
+	} else if err != nil {
+		fmt.Println("Error deleting schedule", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not delete schedule"}`))
+		return
+	}
+	w.Write([]byte(`{"message": "schedule deleted"}`))
+}
+
+// Handler
+// All automation rules with their state, or those watching or switching
+// a plug.
+func api_rules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	plugID := r.URL.Query().Get("plug")
+	responses := make([]RuleResponse, 0)
+	for _, rule := range rule_engine.Rules() {
+		if plugID == "" || rule.Plug == plugID || rule.Target == plugID {
+			responses = append(responses, rule)
+		}
+	}
+	encoded, err := json.Marshal(responses)
+	if err != nil {
+		fmt.Println("Error marshalling rules", err)
+	}
+	w.Write([]byte(encoded))
+}
+
+// Read and check the rule of the request body, writes the error response
+// if invalid.
+func rule_body(w http.ResponseWriter, r *http.Request) (Rule, bool) {
+	var rule Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "invalid rule"}`))
+		return rule, false
+	}
+	if err := rule.validate(); err != nil {
+		json_error(w, http.StatusBadRequest, err)
+		return rule, false
+	}
+	for _, plugID := range []string{rule.Plug, rule.Target} {
+		if _, err := store.GetPlug(plugID); err != nil {
+			json_error(w, http.StatusBadRequest, fmt.Errorf("unknown plug %s", plugID))
+			return rule, false
+		}
+	}
+	return rule, true
+}
+
+// Save a rule of the API and reload the rules, then write it.
+func save_rule(w http.ResponseWriter, rule Rule, status int) {
+	if err := store.PutRule(rule); err != nil {
+		fmt.Println("Error saving rule", rule.Name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not save rule"}`))
+		return
+	}
+	if err := rule_engine.reload(); err != nil {
+		fmt.Println("Error reloading rules", err)
+	}
+	response, err := rule_engine.Rule(rule.Name)
+	if err != nil {
+		fmt.Println("Error reading rule", rule.Name, err)
+	}
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		fmt.Println("Error marshalling rule", err)
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(encoded))
+}
+
+// Writes the error response if the rule of the path is declared in the
+// configuration.
+func check_api_rule(w http.ResponseWriter, name string) bool {
+	if rule_engine.is_config_rule(name) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"message": "rule is declared in the configuration"}`))
+		return false
+	}
+	return true
+}
+
+// Handler
+func api_create_rule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rule, ok := rule_body(w, r)
+	if !ok {
+		return
+	}
+	if _, err := rule_engine.Rule(rule.Name); err == nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"message": "a rule with this name already exists"}`))
+		return
+	}
+	save_rule(w, rule, http.StatusCreated)
+}
+
+// Handler
+func api_rule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	response, err := rule_engine.Rule(mux.Vars(r)["ruleName"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "unknown rule"}`))
+		return
+	}
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		fmt.Println("Error marshalling rule", err)
+	}
+	w.Write([]byte(encoded))
+}
+
+// Handler
+// Replace a rule declared through the API, the state of the rule is
+// reset.
+func api_update_rule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := mux.Vars(r)["ruleName"]
+	if !check_api_rule(w, name) {
+		return
+	}
+	if _, err := rule_engine.Rule(name); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "unknown rule"}`))
+		return
+	}
+	rule, ok := rule_body(w, r)
+	if !ok {
+		return
+	}
+	if rule.Name != name {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "rules cannot be renamed"}`))
+		return
+	}
+	save_rule(w, rule, http.StatusOK)
+}
+
+// Handler
+func api_delete_rule(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := mux.Vars(r)["ruleName"]
+	if !check_api_rule(w, name) {
+		return
+	}
+	err := store.DeleteRule(name)
+	if err == ErrRuleNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "unknown rule"}`))
+		return
+	} else if err != nil {
+		fmt.Println("Error deleting rule", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not delete rule"}`))
+		return
+	}
+	if err := rule_engine.reload(); err != nil {
+		fmt.Println("Error reloading rules", err)
+	}
+	w.Write([]byte(`{"message": "rule deleted"}`))
+}
+
+// Handler
+// Last firings of all rules or of a rule, most recent first. The rule is
+// either in the path or in the `rule` parameter.
+func api_firings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 0
+	if val := r.URL.Query().Get("limit"); val != "" {
+		var err error
+		if limit, err = strconv.Atoi(val); err != nil || limit < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message": "invalid limit"}`))
+			return
+		}
+	}
+	name := mux.Vars(r)["ruleName"]
+	if name == "" {
+		name = r.URL.Query().Get("rule")
+	}
+	firings, err := rule_engine.History(name, limit)
+	if err != nil {
+		fmt.Println("Error reading rule firings", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message": "could not read rule firings"}`))
+		return
+	}
+	encoded, err := json.Marshal(firings)
+	if err != nil {
+		fmt.Println("Error marshalling rule firings", err)
+	}
+	w.Write([]byte(encoded))
+}
+
+// Handler
+// Active alerts, or those of a plug.
+func api_alerts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if alert_manager == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "alerts are disabled"}`))
+		return
+	}
+	encoded, err := json.Marshal(alert_manager.Active(r.URL.Query().Get("plug")))
+	if err != nil {
+		fmt.Println("Error marshalling alerts", err)
+	}
+	w.Write([]byte(encoded))
+}